@@ -1,6 +1,8 @@
 package connect3270
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -26,12 +28,17 @@ var (
 	s3270BinaryPath   string
 	x3270ifBinaryPath string
 	binaryFileMutex   sync.Mutex
+
+	// Redact is applied to commands before they are logged and to screen
+	// captures before they are written, so that callers can mask secrets.
+	Redact = func(s string) string { return s }
 )
 
 // These constants represent the keyboard keys
 const (
 	Enter = "Enter"
 	Tab   = "Tab"
+	Clear = "Clear"
 	F1    = "PF(1)"
 	F2    = "PF(2)"
 	F3    = "PF(3)"
@@ -58,6 +65,13 @@ const (
 	F24   = "PF(24)"
 )
 
+// The terminal model emulated by every session and its screen size.
+const (
+	Model         = "3279-2"
+	ScreenRows    = 24
+	ScreenColumns = 80
+)
+
 const (
 	maxRetries = 10          // Maximum number of retries
 	retryDelay = time.Second // Delay between retries (e.g., 1 second)
@@ -68,13 +82,30 @@ type Emulator struct {
 	Host       string
 	Port       int
 	ScriptPort string
+	// Ports, if set, leases a script port for each start of the process
+	// when ScriptPort is empty, and takes it back when the process exits.
+	Ports *PortAllocator
+	// CommandHook, if set, is called with each command, redacted, before
+	// it is sent to the emulator, and the function it returns is called
+	// with the result of the command. It is used to trace commands.
+	CommandHook func(command string) func(error)
+
+	mu         sync.Mutex
+	cmd        *exec.Cmd // x3270 or s3270 process, once started
+	exited     bool      // The process has exited
+	terminated bool
+	commands   context.Context    // Context of x3270if commands, cancelled by Terminate
+	cancel     context.CancelFunc // Cancels commands
+	assigned   bool               // ScriptPort was chosen when the process started
+	leasedFrom *PortAllocator     // Holds the lease on ScriptPort, if any
+	script     *stdinScript       // Standard input and output with TransportStdin
 }
 
 // Coordinates represents the screen coordinates (row and column)
 type Coordinates struct {
-	Row    int
-	Column int
-	Length int
+	Row    int `yaml:"Row,omitempty"`
+	Column int `yaml:"Column,omitempty"`
+	Length int `yaml:"Length,omitempty"`
 }
 
 // NewEmulator creates a new Emulator instance.
@@ -112,12 +143,24 @@ func (e *Emulator) WaitForField(timeout time.Duration) error {
 			return nil // Successful operation, exit the retry loop
 		}
 
-		time.Sleep(retryDelay)
+		if !e.retryPause(retryDelay) {
+			break
+		}
 	}
 
 	return fmt.Errorf("maximum WaitForField retries reached")
 }
 
+// WaitForUnlock waits until the host has unlocked the keyboard, which marks the
+// end of the host's response to an attention key.
+func (e *Emulator) WaitForUnlock(timeout time.Duration) error {
+	command := fmt.Sprintf("Wait(%d, Unlock)", int(timeout.Seconds()))
+	if _, err := e.execCommand(command); err != nil {
+		return fmt.Errorf("error waiting for keyboard unlock: %v", err)
+	}
+	return nil
+}
+
 // moveCursor moves the cursor to the specified row (x) and column (y) with retry logic.
 func (e *Emulator) moveCursor(x, y int) error {
 	// Retry logic parameters
@@ -136,12 +179,19 @@ func (e *Emulator) moveCursor(x, y int) error {
 		}
 		//log.Printf("Error moving cursor (Retry %d) to row %d, column %d\n", retries+1, x, y)
 
-		time.Sleep(retryDelay)
+		if !e.retryPause(retryDelay) {
+			break
+		}
 	}
 
 	return fmt.Errorf("maximum MoveCursor retries reached")
 }
 
+// MoveCursor moves the cursor to the specified row (x) and column (y).
+func (e *Emulator) MoveCursor(x, y int) error {
+	return e.moveCursor(x, y)
+}
+
 // SetString fills the field at the current cursor position with the given value and retries in case of failure.
 func (e *Emulator) SetString(value string) error {
 	// Retry logic parameters
@@ -156,7 +206,9 @@ func (e *Emulator) SetString(value string) error {
 			return nil // Successful operation, exit the retry loop
 		}
 		//log.Printf("Error executing String command (Retry %d)\n", retries+1)
-		time.Sleep(retryDelay)
+		if !e.retryPause(retryDelay) {
+			break
+		}
 	}
 
 	return fmt.Errorf("maximum SetString retries reached")
@@ -178,7 +230,9 @@ func (e *Emulator) GetRows() (int, error) {
 			}
 		}
 		//log.Printf("Error getting number of rows (Retry %d): %v\n", retries+1, err)
-		time.Sleep(retryDelay)
+		if !e.retryPause(retryDelay) {
+			break
+		}
 	}
 
 	return 0, fmt.Errorf("maximum GetRows retries reached")
@@ -200,7 +254,9 @@ func (e *Emulator) GetColumns() (int, error) {
 			}
 		}
 		//log.Printf("Error getting number of columns (Retry %d): %v\n", retries+1, err)
-		time.Sleep(retryDelay)
+		if !e.retryPause(retryDelay) {
+			break
+		}
 	}
 
 	return 0, fmt.Errorf("maximum GetColumns retries reached")
@@ -226,7 +282,9 @@ func (e *Emulator) FillString(x, y int, value string) error {
 			return nil // Successful operation, exit the retry loop
 		}
 		//log.Printf("Error filling string (Retry %d) at row %d, column %d: %v\n", retries+1, x, y, err)
-		time.Sleep(retryDelay)
+		if !e.retryPause(retryDelay) {
+			break
+		}
 	}
 
 	return fmt.Errorf("maximum FillString retries reached")
@@ -253,6 +311,10 @@ func (e *Emulator) validateKeyboard(key string) bool {
 		return true
 	case Enter:
 		return true
+	case Clear:
+		return true
+	case F1, F2, F3, F4, F5, F6, F7, F8, F9, F10, F11, F12:
+		return true
 	case F13, F14, F15, F16, F17, F18, F19, F20, F21, F22, F23, F24:
 		return true
 	default:
@@ -289,12 +351,86 @@ func (e *Emulator) GetValue(x, y, length int) (string, error) {
 			return output, nil // Successful operation, exit the retry loop
 		}
 		//log.Printf("Error executing Ascii command (Retry %d): %v\n", retries+1, err)
-		time.Sleep(retryDelay)
+		if !e.retryPause(retryDelay) {
+			break
+		}
 	}
 
 	return "", fmt.Errorf("maximum GetValue retries reached")
 }
 
+// Field describes a field on the screen. Row and Column are 1-based and give
+// the position of the first character after the field attribute.
+type Field struct {
+	Row       int
+	Column    int
+	Length    int
+	Protected bool
+}
+
+// ScreenText returns the current screen as one string per row.
+func (e *Emulator) ScreenText() ([]string, error) {
+	output, err := e.execCommandOutput("Ascii()")
+	if err != nil {
+		return nil, fmt.Errorf("error reading screen: %v", err)
+	}
+	return strings.Split(strings.TrimRight(output, "\r\n"), "\n"), nil
+}
+
+// PeekScreen is ScreenText for someone watching the session rather than the
+// session itself: the command is not passed to CommandHook, so it does not
+// show up in the session's trace.
+func (e *Emulator) PeekScreen() ([]string, error) {
+	output, err := e.commandOutput("Ascii()")
+	if err != nil {
+		return nil, fmt.Errorf("error reading screen: %v", err)
+	}
+	return strings.Split(strings.TrimRight(output, "\r\n"), "\n"), nil
+}
+
+// Fields returns the fields defined on the current screen.
+func (e *Emulator) Fields() ([]Field, error) {
+	output, err := e.execCommandOutput("ReadBuffer(Ascii)")
+	if err != nil {
+		return nil, fmt.Errorf("error reading buffer: %v", err)
+	}
+	return parseFields(output, ScreenColumns), nil
+}
+
+// parseFields extracts the fields from ReadBuffer(Ascii) output, in which each
+// buffer position is either a character code or an SF(c0=xx,...) start field
+// order holding the field attribute. SA(...) orders take up no position.
+func parseFields(buffer string, columns int) []Field {
+	var starts []int
+	var fields []Field
+	pos := 0
+	for _, token := range strings.Fields(buffer) {
+		if strings.HasPrefix(token, "SA(") {
+			continue
+		}
+		if strings.HasPrefix(token, "SF(") {
+			var attribute int64
+			for _, pair := range strings.Split(strings.Trim(token[3:], ")"), ",") {
+				if strings.HasPrefix(pair, "c0=") {
+					attribute, _ = strconv.ParseInt(strings.TrimPrefix(pair, "c0="), 16, 32)
+				}
+			}
+			starts = append(starts, pos)
+			fields = append(fields, Field{Protected: attribute&0x20 != 0})
+		}
+		pos++
+	}
+	size := pos
+	for i := range fields {
+		first := (starts[i] + 1) % size
+		next := starts[(i+1)%len(starts)]
+		fields[i].Row = first/columns + 1
+		fields[i].Column = first%columns + 1
+		fields[i].Length = (next - first + size) % size
+	}
+	return fields
+}
+
 // CursorPosition return actual position by cursor
 func (e *Emulator) CursorPosition() (string, error) {
 	return e.query("cursor")
@@ -311,21 +447,15 @@ func (e *Emulator) Connect() error {
 
 	// Retry logic for connecting
 	for retries := 0; retries < maxRetries; retries++ {
+		if e.isTerminated() {
+			return errors.New("emulator was terminated")
+		}
 		if e.IsConnected() {
 			return nil // Successfully connected, exit the retry loop
 		}
 
-		if e.ScriptPort == "" {
-			log.Println("ScriptPort not set, using default 5000")
-			e.ScriptPort = "5000"
-		}
-
-		if Verbose {
-			log.Println("func Connect: using -scriptport: " + e.ScriptPort)
-		}
-
 		var err error
-		for attempt := 0; attempt < maxRetries; attempt++ {
+		for attempt := 0; attempt < maxRetries && !e.isTerminated(); attempt++ {
 			err = e.createApp()
 			if err == nil {
 				break
@@ -367,18 +497,118 @@ func (e *Emulator) Disconnect() error {
 	return nil
 }
 
+// Terminate kills the x3270 or s3270 process at once, dropping the host
+// session without logging off, and stops Connect from starting another. It
+// is for abandoning a workflow that cannot be left to finish.
+func (e *Emulator) Terminate() error {
+	e.mu.Lock()
+	e.terminated = true
+	if e.cancel != nil {
+		e.cancel()
+	}
+	cmd := e.cmd
+	e.mu.Unlock()
+	if cmd == nil || cmd.Process == nil {
+		return nil
+	}
+	if Verbose {
+		log.Printf("Terminating 3270 instance on %s", e.Where())
+	}
+	if err := cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return fmt.Errorf("error terminating 3270 instance: %v", err)
+	}
+	return nil
+}
+
+// Revive undoes Terminate, so that the next Connect starts a new x3270 or
+// s3270 process.
+func (e *Emulator) Revive() {
+	e.mu.Lock()
+	e.terminated = false
+	e.commands, e.cancel = nil, nil
+	e.mu.Unlock()
+}
+
+// commandContext returns the context x3270if commands run in. Terminate
+// cancels it, which kills the commands that are still running.
+func (e *Emulator) commandContext() context.Context {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.commands == nil {
+		e.commands, e.cancel = context.WithCancel(context.Background())
+		if e.terminated {
+			e.cancel()
+		}
+	}
+	return e.commands
+}
+
+// retryPause waits delay before a command is tried again. It reports false
+// at once if the emulator has been terminated, since no retry can succeed.
+func (e *Emulator) retryPause(delay time.Duration) bool {
+	if e.isTerminated() {
+		return false
+	}
+	time.Sleep(delay)
+	return !e.isTerminated()
+}
+
+// runStdin sends a command to the process's standard input.
+func (e *Emulator) runStdin(command string, withStatus bool) (string, error) {
+	e.mu.Lock()
+	script := e.script
+	e.mu.Unlock()
+	if script == nil {
+		return "", errors.New("3270 instance is not running")
+	}
+	return script.run(command, withStatus)
+}
+
+func (e *Emulator) isTerminated() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.terminated
+}
+
 // query returns state information from x3270
 func (e *Emulator) query(keyword string) (string, error) {
 	command := fmt.Sprintf("query(%s)", keyword)
 	return e.execCommandOutput(command)
 }
 
-// createApp creates a connection to the host using embedded x3270 or s3270
+// createApp creates a connection to the host using embedded x3270 or s3270.
+// A process that is still starting from an earlier attempt is given more
+// time rather than being started again; one that has exited, for example
+// because its script port was taken, is replaced on a new port.
 func (e *Emulator) createApp() error {
-	if Verbose {
-		log.Println("func createApp: using -scriptport: " + e.ScriptPort)
+	e.mu.Lock()
+	running := e.cmd != nil && !e.exited
+	e.mu.Unlock()
+	if !running {
+		if err := e.startApp(); err != nil {
+			return err
+		}
+	}
+
+	const maxAttempts = 1
+	const sleepDuration = time.Second
+
+	for i := 0; i < maxAttempts; i++ {
+		if e.IsConnected() {
+			break
+		}
+		time.Sleep(sleepDuration)
+	}
+
+	if !e.IsConnected() {
+		return fmt.Errorf("Failed to connect to %s", e.hostname())
 	}
 
+	return nil
+}
+
+// startApp starts the x3270 or s3270 process.
+func (e *Emulator) startApp() error {
 	binaryFilePath, err := e.prepareBinaryFilePath()
 	if err != nil {
 		log.Printf("Error preparing binary file path: %v", err)
@@ -387,11 +617,17 @@ func (e *Emulator) createApp() error {
 	if Verbose {
 		log.Printf("createApp binaryFilePath: %s", binaryFilePath)
 	}
+	scriptArgs, err := e.scriptArgs()
+	if err != nil {
+		return err
+	}
+	if Verbose {
+		log.Printf("func createApp: using %s", e.Where())
+	}
 
 	// Choose the correct model type
-	modelType := "3279-2" // Adjust this based on your application's requirements
+	modelType := Model
 
-	var cmd *exec.Cmd
 	var resourceString string
 
 	// Conditional resource string based on OS
@@ -401,11 +637,13 @@ func (e *Emulator) createApp() error {
 		resourceString = "x3270.unlockDelay: False"
 	}
 
+	var args []string
 	if Headless {
-		cmd = exec.Command(binaryFilePath, "-scriptport", e.ScriptPort, "-xrm", resourceString, "-model", modelType, e.hostname())
+		args = append(append(args, scriptArgs...), "-xrm", resourceString)
 	} else {
-		cmd = exec.Command(binaryFilePath, "-xrm", resourceString, "-scriptport", e.ScriptPort, "-model", modelType, e.hostname())
+		args = append([]string{"-xrm", resourceString}, scriptArgs...)
 	}
+	cmd := exec.Command(binaryFilePath, append(args, "-model", modelType, e.hostname())...)
 
 	if Verbose {
 		log.Printf("Executing command: %s %v", cmd.Path, cmd.Args)
@@ -415,46 +653,59 @@ func (e *Emulator) createApp() error {
 	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		log.Printf("Failed to get stderr pipe: %v", err)
+		e.releasePort()
 		return err
 	}
+	var script *stdinScript
+	if Transport == TransportStdin {
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			return err
+		}
+		script = &stdinScript{in: in, out: bufio.NewReader(out)}
+	}
 
 	if err := cmd.Start(); err != nil {
 		log.Printf("Error starting 3270 instance: %v", err)
+		e.releasePort()
 		return err
 	}
+	e.mu.Lock()
+	e.cmd = cmd
+	e.exited = false
+	e.script = script
+	terminated := e.terminated
+	e.mu.Unlock()
+	if terminated {
+		cmd.Process.Kill()
+	}
 
 	go func() {
-		for retries := 0; retries < maxRetries; retries++ {
-			errMsg, _ := ioutil.ReadAll(stderr)
-			if Verbose && len(errMsg) > 0 {
-				log.Printf("3270 stderr: %s", string(errMsg))
-			}
-			if err := cmd.Wait(); err == nil {
-				if Verbose {
-					log.Printf("Successfully started 3270 instance")
-				}
-				return // Successful execution, exit the Goroutine
+		errMsg, _ := ioutil.ReadAll(stderr)
+		if Verbose && len(errMsg) > 0 {
+			log.Printf("3270 stderr: %s", string(errMsg))
+		}
+		err := cmd.Wait()
+		where := e.Where()
+		e.releasePort()
+		e.mu.Lock()
+		e.exited = true
+		e.mu.Unlock()
+		if err == nil {
+			if Verbose {
+				log.Printf("3270 instance on %s exited", where)
 			}
-			log.Printf("Error creating 3270 instance (Retry %d): %v", retries+1, err)
-			time.Sleep(retryDelay)
+			return
 		}
-		log.Printf("Max retries reached. Could not create an instance of 3270.")
-	}()
-
-	const maxAttempts = 1
-	const sleepDuration = time.Second
-
-	for i := 0; i < maxAttempts; i++ {
-		if e.IsConnected() {
-			break
+		if e.isTerminated() {
+			return
 		}
-		time.Sleep(sleepDuration)
-	}
-
-	if !e.IsConnected() {
-		return fmt.Errorf("Failed to connect to %s", e.hostname())
-	}
-
+		log.Printf("3270 instance on %s failed: %v %s", where, err, strings.TrimSpace(string(errMsg)))
+	}()
 	return nil
 }
 
@@ -464,23 +715,31 @@ func (e *Emulator) hostname() string {
 }
 
 // execCommand executes a command on the connected x3270 or s3270 instance based on Headless flag
-func (e *Emulator) execCommand(command string) (string, error) {
+func (e *Emulator) execCommand(command string) (output string, err error) {
 	if Verbose {
-		log.Printf("Executing command: %s", command)
+		log.Printf("Executing command: %s", Redact(command))
+	}
+	if e.CommandHook != nil {
+		done := e.CommandHook(Redact(command))
+		defer func() { done(err) }()
 	}
 
+	if Transport == TransportStdin {
+		return e.runStdin(command, true)
+	}
 	x3270ifBinaryPath, err := e.getX3270ifPath()
 	if err != nil {
 		return "", err
 	}
+	target := e.target()
 
 	if Verbose {
-		log.Printf("func execCommand: CMD: %s -t %s %s\n", x3270ifBinaryPath, e.ScriptPort, command)
+		log.Printf("func execCommand: CMD: %s %s %s\n", x3270ifBinaryPath, strings.Join(target, " "), Redact(command))
 	}
 
 	// Retry logic for executing the command
 	for retries := 0; retries < maxRetries; retries++ {
-		cmd := exec.Command(x3270ifBinaryPath, "-S", "-t", e.ScriptPort, command)
+		cmd := exec.CommandContext(e.commandContext(), x3270ifBinaryPath, append(append([]string{"-S"}, target...), command)...)
 		if output, err := cmd.Output(); err == nil {
 			return string(output), nil
 		} else if strings.Contains(err.Error(), "text file busy") {
@@ -495,28 +754,40 @@ func (e *Emulator) execCommand(command string) (string, error) {
 }
 
 // execCommandOutput executes a command on the connected x3270 or s3270 instance based on Headless flag and returns output
-func (e *Emulator) execCommandOutput(command string) (string, error) {
+func (e *Emulator) execCommandOutput(command string) (output string, err error) {
 	if Verbose {
-		log.Printf("Executing command with output: %s", command)
+		log.Printf("Executing command with output: %s", Redact(command))
+	}
+	if e.CommandHook != nil {
+		done := e.CommandHook(Redact(command))
+		defer func() { done(err) }()
 	}
+	return e.commandOutput(command)
+}
 
+// commandOutput is execCommandOutput without the CommandHook.
+func (e *Emulator) commandOutput(command string) (string, error) {
+	if Transport == TransportStdin {
+		return e.runStdin(command, false)
+	}
 	x3270ifBinaryPath, err := e.getX3270ifPath()
 	if err != nil {
 		return "", err
 	}
+	target := e.target()
 
 	if Verbose {
-		log.Printf("func execCommandOutput: CMD: %s -t %s %s\n", x3270ifBinaryPath, e.ScriptPort, command)
+		log.Printf("func execCommandOutput: CMD: %s %s %s\n", x3270ifBinaryPath, strings.Join(target, " "), Redact(command))
 	}
 
 	// Execute the command using the selected binary file
-	cmd := exec.Command(x3270ifBinaryPath, "-t", e.ScriptPort, command)
-	output, err := cmd.Output()
+	cmd := exec.CommandContext(e.commandContext(), x3270ifBinaryPath, append(target, command)...)
+	out, err := cmd.Output()
 	if err != nil {
 		return "", err
 	}
 
-	return string(output), nil
+	return string(out), nil
 }
 
 // InitializeOutput initializes the output file with run details
@@ -568,6 +839,7 @@ func (e *Emulator) AsciiScreenGrab(filePath string, apiMode bool) error {
 	for retries := 0; retries < maxRetries; retries++ {
 		output, err := e.execCommandOutput("Ascii()")
 		if err == nil {
+			output = Redact(output)
 			var content string
 			if apiMode {
 				// In API mode, just use plain ASCII output
@@ -595,7 +867,9 @@ func (e *Emulator) AsciiScreenGrab(filePath string, apiMode bool) error {
 			file.Close() // Ensure the file is properly closed
 			return nil
 		}
-		time.Sleep(retryDelay)
+		if !e.retryPause(retryDelay) {
+			break
+		}
 	}
 
 	return fmt.Errorf("maximum capture retries reached")
@@ -696,6 +970,34 @@ func (e *Emulator) prepareBinaryFilePath() (string, error) {
 	return *binaryFilePath, nil
 }
 
+// OpenTerminal starts an interactive x3270 (wc3270 on Windows) connected to
+// host and port, for a person to use, and returns the running process.
+func OpenTerminal(host string, port int) (*exec.Cmd, error) {
+	binaryName := "x3270"
+	if runtime.GOOS == "windows" {
+		binaryName = "wc3270"
+	}
+	binaryFileMutex.Lock()
+	if x3270BinaryPath == "" {
+		var err error
+		if x3270BinaryPath, err = getOrCreateBinaryFile(binaryName); err != nil {
+			binaryFileMutex.Unlock()
+			return nil, err
+		}
+	}
+	binaryFilePath := x3270BinaryPath
+	binaryFileMutex.Unlock()
+
+	cmd := exec.Command(binaryFilePath, "-model", Model, fmt.Sprintf("%s:%d", host, port))
+	if Verbose {
+		log.Printf("Executing command: %s %v", cmd.Path, cmd.Args)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting %s: %v", binaryName, err)
+	}
+	return cmd, nil
+}
+
 // getX3270ifPath retrieves the path for the x3270if binary.
 func (e *Emulator) getX3270ifPath() (string, error) {
 	binaryFileMutex.Lock()
@@ -0,0 +1,52 @@
+package connect3270
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		buffer  string
+		columns int
+		want    []Field
+	}{
+		{
+			name:    "unformatted",
+			buffer:  "41 42 43 44 20 20 20 20",
+			columns: 4,
+		},
+		{
+			// A protected label then an input field that wraps round to
+			// the start of the buffer.
+			name:    "two fields",
+			buffer:  "SF(c0=60) 41 42 SF(c0=c0) 43 SA(41=f4) 20 20 20",
+			columns: 4,
+			want: []Field{
+				{Row: 1, Column: 2, Length: 2, Protected: true},
+				{Row: 2, Column: 1, Length: 4},
+			},
+		},
+		{
+			name:    "one field",
+			buffer:  "SF(c0=c8,41=f2) 20 20 20 20 20 20 20",
+			columns: 4,
+			want:    []Field{{Row: 1, Column: 2, Length: 7}},
+		},
+		{
+			name:    "field at the end of a row",
+			buffer:  "20 20 20 SF(c0=e0) 41 41 SF(c0=40) 20",
+			columns: 4,
+			want: []Field{
+				{Row: 2, Column: 1, Length: 2, Protected: true},
+				{Row: 2, Column: 4, Length: 4},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := parseFields(tt.buffer, tt.columns); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseFields = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package connect3270
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Ways of sending script commands to the emulator, set with Transport.
+const (
+	// TransportPort sends commands to a TCP script port, ScriptPort or one
+	// leased from the emulator's Ports.
+	TransportPort = "port"
+	// TransportSocket sends commands to a Unix-domain socket that the
+	// emulator names after its process ID, so no port is used at all. It is
+	// not available on Windows.
+	TransportSocket = "socket"
+	// TransportStdin writes commands to s3270's standard input and reads the
+	// results from its standard output. It needs Headless.
+	TransportStdin = "stdin"
+)
+
+// Transports lists the values Transport can take.
+var Transports = []string{TransportPort, TransportSocket, TransportStdin}
+
+// Transport is how every emulator receives script commands.
+var Transport = TransportPort
+
+// CheckTransport reports whether transport can be used with the current
+// settings.
+func CheckTransport(transport string) error {
+	switch transport {
+	case TransportPort:
+	case TransportSocket:
+		if runtime.GOOS == "windows" {
+			return errors.New("the socket transport is not available on Windows")
+		}
+	case TransportStdin:
+		if !Headless {
+			return errors.New("the stdin transport needs headless mode")
+		}
+	default:
+		return fmt.Errorf("unknown transport %q, use one of %s", transport, strings.Join(Transports, ", "))
+	}
+	return nil
+}
+
+// PortAllocator leases script ports from a range so that no two emulators
+// are given the same port, and takes them back when the emulators exit. A
+// port that another process is listening on is skipped, and a port that
+// an emulator still fails to bind can be returned and another leased.
+type PortAllocator struct {
+	start, end int
+	mu         sync.Mutex
+	next       int
+	leased     map[int]bool
+}
+
+// NewPortAllocator returns an allocator for the ports from start to end.
+func NewPortAllocator(start, end int) *PortAllocator {
+	return &PortAllocator{start: start, end: end, next: start, leased: map[int]bool{}}
+}
+
+// Lease returns a port that is free and not leased. Ports are handed out in
+// turn, wrapping around at the end of the range, so a port just returned is
+// the last to be used again.
+func (a *PortAllocator) Lease() (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	size := a.end - a.start + 1
+	for i := 0; i < size; i++ {
+		port := a.next
+		a.next++
+		if a.next > a.end {
+			a.next = a.start
+		}
+		if a.leased[port] || !portFree(port) {
+			continue
+		}
+		a.leased[port] = true
+		return port, nil
+	}
+	return 0, fmt.Errorf("no free script port from %d to %d, %d are leased", a.start, a.end, len(a.leased))
+}
+
+// Release returns a leased port.
+func (a *PortAllocator) Release(port int) {
+	a.mu.Lock()
+	delete(a.leased, port)
+	a.mu.Unlock()
+}
+
+// Leased returns the number of ports leased.
+func (a *PortAllocator) Leased() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.leased)
+}
+
+// portFree reports whether nothing is listening on port. It is only a hint:
+// another process can take the port before the emulator binds it, which is
+// why an emulator that fails to bind is started again on another port.
+func portFree(port int) bool {
+	ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return false
+	}
+	ln.Close()
+	return true
+}
+
+// scriptArgs returns the emulator options that say where it takes script
+// commands, leasing a port first if it needs one.
+func (e *Emulator) scriptArgs() ([]string, error) {
+	switch Transport {
+	case TransportSocket:
+		return []string{"-socket"}, nil
+	case TransportStdin:
+		return nil, nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ScriptPort == "" {
+		if e.Ports == nil {
+			log.Println("ScriptPort not set, using default 5000")
+			e.ScriptPort = "5000"
+			return []string{"-scriptport", e.ScriptPort}, nil
+		}
+		port, err := e.Ports.Lease()
+		if err != nil {
+			return nil, err
+		}
+		e.leasedFrom = e.Ports
+		e.ScriptPort = strconv.Itoa(port)
+		e.assigned = true
+	}
+	return []string{"-scriptport", e.ScriptPort}, nil
+}
+
+// releasePort gives up a script port the emulator was assigned once the
+// process using it has exited, so that the next start gets another one.
+func (e *Emulator) releasePort() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !e.assigned {
+		return
+	}
+	if e.leasedFrom != nil {
+		port, _ := strconv.Atoi(e.ScriptPort)
+		e.leasedFrom.Release(port)
+		e.leasedFrom = nil
+	}
+	e.ScriptPort = ""
+	e.assigned = false
+}
+
+// target returns the x3270if options that address the emulator.
+func (e *Emulator) target() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if Transport == TransportSocket && e.cmd != nil && e.cmd.Process != nil {
+		return []string{"-p", strconv.Itoa(e.cmd.Process.Pid)}
+	}
+	return []string{"-t", e.ScriptPort}
+}
+
+// Where returns where the emulator takes script commands, for logging.
+func (e *Emulator) Where() string {
+	switch Transport {
+	case TransportSocket, TransportStdin:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if e.cmd != nil && e.cmd.Process != nil {
+			return fmt.Sprintf("%s of process %d", Transport, e.cmd.Process.Pid)
+		}
+		return Transport
+	}
+	return "script port " + e.CurrentScriptPort()
+}
+
+// CurrentScriptPort returns ScriptPort, which changes as ports are leased
+// and released, so that it can be read while the emulator runs.
+func (e *Emulator) CurrentScriptPort() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.ScriptPort
+}
+
+// stdinScript is the standard input and output of an s3270 process that
+// takes commands with TransportStdin.
+type stdinScript struct {
+	mu  sync.Mutex
+	in  io.WriteCloser
+	out *bufio.Reader
+}
+
+// run sends command and returns the data lines of the result, and the status
+// line after them if withStatus is set, as x3270if does.
+func (s *stdinScript) run(command string, withStatus bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := io.WriteString(s.in, command+"\n"); err != nil {
+		return "", err
+	}
+	var data []string
+	status := ""
+	for {
+		line, err := s.out.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && strings.EqualFold(command, "quit") {
+				return "", nil
+			}
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		case line == "ok" || line == "error":
+			output := ""
+			if len(data) > 0 {
+				output = strings.Join(data, "\n") + "\n"
+			}
+			if line == "error" {
+				return "", fmt.Errorf("%s failed: %s", Redact(command), strings.TrimSpace(output))
+			}
+			if withStatus {
+				output += status + "\n"
+			}
+			return output, nil
+		default:
+			// The status line comes just before ok or error.
+			status = line
+		}
+	}
+}
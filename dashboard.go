@@ -0,0 +1,430 @@
+package main
+
+// Live dashboard. The dashboard page subscribes to /events, a stream of
+// server-sent events, instead of reloading itself. One hub reads the metrics
+// files of every process once a second, when someone is watching, and sends
+// each subscriber only the parts of the results that changed, the log lines
+// written since the last tick, a point of host CPU and memory use, and the
+// state of the run when it changes.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	dashboardTick        = time.Second      // How often the hub looks for changes
+	dashboardKeepAlive   = 15 * time.Second // How often an idle stream gets a comment, so proxies keep it open
+	dashboardLogBacklog  = 100              // Log lines a new subscriber is sent
+	dashboardHostPoints  = 600              // Host CPU and memory points kept for new subscribers
+	dashboardSubscriberQ = 64               // Events queued for a subscriber before it is dropped
+)
+
+// dashboardTotals is the workflow counts at the top of the dashboard.
+type dashboardTotals struct {
+	ActiveWorkflows         int   `json:"activeWorkflows"`
+	TotalWorkflowsStarted   int64 `json:"totalWorkflowsStarted"`
+	TotalWorkflowsCompleted int64 `json:"totalWorkflowsCompleted"`
+	TotalWorkflowsFailed    int64 `json:"totalWorkflowsFailed"`
+	TotalIterationsDropped  int64 `json:"totalIterationsDropped"`
+}
+
+// dashboardView is what the dashboard shows. The page is rendered with the
+// whole view, and each of its fields is sent again when it changes.
+type dashboardView struct {
+	Totals         dashboardTotals    `json:"totals"`
+	Durations      []TransactionStats `json:"durations"` // Workflows, then each transaction
+	Rates          []rateStats        `json:"rates"`
+	Steps          []stepStats        `json:"steps"`
+	StepFailures   []stepFailure      `json:"stepFailures"`
+	StepTypes      []stepStats        `json:"stepTypes"`
+	FailureScreens map[string]int64   `json:"failureScreens"`
+	Processes      []processMetrics   `json:"processes"`
+	Sessions       []dashboardSession `json:"sessions"`
+}
+
+// dashboardSession is a session of one of the processes on the dashboard.
+// Watchable says whether its screen can be watched from this dashboard.
+type dashboardSession struct {
+	sessionInfo
+	PID       int    `json:"pid"`
+	Agent     string `json:"agent,omitempty"`
+	Watchable bool   `json:"watchable"`
+}
+
+// newDashboardView adds up the results of processes.
+func newDashboardView(processes []Metrics, now time.Time) dashboardView {
+	var agg Metrics
+	for _, m := range processes {
+		agg.add(m)
+	}
+	v := dashboardView{
+		Totals: dashboardTotals{
+			ActiveWorkflows:         agg.ActiveWorkflows,
+			TotalWorkflowsStarted:   agg.TotalWorkflowsStarted,
+			TotalWorkflowsCompleted: agg.TotalWorkflowsCompleted,
+			TotalWorkflowsFailed:    agg.TotalWorkflowsFailed,
+			TotalIterationsDropped:  agg.TotalIterationsDropped,
+		},
+		Rates:          summarizeRates(agg, now),
+		Steps:          summarizeSteps(agg.Steps),
+		StepFailures:   summarizeStepFailures(agg.StepFailures),
+		StepTypes:      summarizeSteps(agg.StepTypes),
+		FailureScreens: agg.FailureScreens,
+		Processes:      make([]processMetrics, len(processes)),
+	}
+	if agg.Durations.Count > 0 {
+		v.Durations = append([]TransactionStats{{Name: "Workflow", Summary: agg.Durations.Summarize()}}, summarizeTransactions(agg.Transactions)...)
+	}
+	for i, m := range processes {
+		// The host chart has its own points, so the histories are left out.
+		v.Processes[i] = newProcessMetrics(m, now)
+		v.Processes[i].CPUUsage = nil
+		v.Processes[i].MemoryUsage = nil
+		for _, session := range m.Sessions {
+			v.Sessions = append(v.Sessions, dashboardSession{
+				sessionInfo: session,
+				PID:         m.PID,
+				Agent:       m.Agent,
+				Watchable:   m.Agent != "" || m.PID == os.Getpid(),
+			})
+		}
+	}
+	return v
+}
+
+// sections returns each field of v as JSON, keyed by its name.
+func (v dashboardView) sections() map[string]json.RawMessage {
+	sections := map[string]json.RawMessage{}
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = json.Unmarshal(data, &sections)
+	}
+	if err != nil {
+		log.Printf("Error encoding dashboard view: %v", err)
+	}
+	return sections
+}
+
+// metricsFileEntry is a metrics file as it was last read.
+type metricsFileEntry struct {
+	modTime time.Time
+	size    int64
+	metrics Metrics
+}
+
+// metricsFiles caches the metrics files, so that each is read again only
+// once its process has rewritten it.
+var (
+	metricsFiles      = map[string]metricsFileEntry{}
+	metricsFilesMutex sync.Mutex
+)
+
+// readMetricsFiles returns the results in every metrics file, in the order
+// of their names. The results are shared and must not be changed.
+func readMetricsFiles() []Metrics {
+	files, err := filepath.Glob(filepath.Join(metricsDir(), "metrics_*.json"))
+	if err != nil {
+		log.Printf("Error listing metrics files: %v", err)
+		return nil
+	}
+	metricsFilesMutex.Lock()
+	defer metricsFilesMutex.Unlock()
+	seen := make(map[string]bool, len(files))
+	var list []Metrics
+	for _, f := range files {
+		seen[f] = true
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		entry, ok := metricsFiles[f]
+		if !ok || !entry.modTime.Equal(info.ModTime()) || entry.size != info.Size() {
+			data, err := ioutil.ReadFile(f)
+			if err != nil {
+				log.Printf("Error reading file %s: %v", f, err)
+				continue
+			}
+			var m Metrics
+			if err := json.Unmarshal(data, &m); err != nil {
+				// The file may be being rewritten; use what was read last.
+				if ok {
+					list = append(list, entry.metrics)
+				}
+				continue
+			}
+			entry = metricsFileEntry{modTime: info.ModTime(), size: info.Size(), metrics: m}
+			metricsFiles[f] = entry
+		}
+		list = append(list, entry.metrics)
+	}
+	for f := range metricsFiles {
+		if !seen[f] {
+			delete(metricsFiles, f)
+		}
+	}
+	return list
+}
+
+// The run is finished once its results have been written, while the
+// dashboard may go on being served.
+var (
+	runFinished   int32
+	runFinishedRC int32
+)
+
+// finishRun records that the run has ended with exit code code.
+func finishRun(code int) {
+	atomic.StoreInt32(&runFinishedRC, int32(code))
+	atomic.StoreInt32(&runFinished, 1)
+}
+
+// runState is the state of the run the dashboard shows.
+type runState struct {
+	State    string `json:"state"` // running, stopping, aborting or finished
+	ExitCode *int   `json:"exitCode,omitempty"`
+}
+
+func currentRunState() runState {
+	switch {
+	case atomic.LoadInt32(&runFinished) == 1:
+		code := int(atomic.LoadInt32(&runFinishedRC))
+		return runState{State: "finished", ExitCode: &code}
+	case aborting():
+		return runState{State: "aborting"}
+	case stopping():
+		return runState{State: "stopping"}
+	}
+	return runState{State: "running"}
+}
+
+// hostPoint is the CPU and memory use of the host at Time seconds after the
+// dashboard started.
+type hostPoint struct {
+	Time   float64 `json:"t"`
+	CPU    float64 `json:"cpu"`
+	Memory float64 `json:"memory"`
+}
+
+// dashboardEvent is a server-sent event.
+type dashboardEvent struct {
+	name string
+	data []byte
+}
+
+// dashboardHub sends the changes to the dashboard to its subscribers.
+type dashboardHub struct {
+	mu          sync.Mutex
+	started     time.Time
+	subscribers map[chan dashboardEvent]bool
+	sections    map[string]json.RawMessage // Last sent to every subscriber
+	state       []byte
+	host        []hostPoint
+	logs        []LogEntry
+	logOffsets  map[string]int64 // Bytes of each log file already sent
+}
+
+// liveDashboard is the hub of the dashboard server.
+var liveDashboard = &dashboardHub{
+	subscribers: map[chan dashboardEvent]bool{},
+	logOffsets:  map[string]int64{},
+}
+
+// event encodes v as the data of an event.
+func event(name string, v interface{}) dashboardEvent {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error encoding dashboard %s event: %v", name, err)
+	}
+	return dashboardEvent{name: name, data: data}
+}
+
+// run looks for changes every dashboardTick.
+func (h *dashboardHub) run() {
+	h.mu.Lock()
+	h.started = time.Now()
+	h.mu.Unlock()
+	for {
+		h.tick()
+		time.Sleep(dashboardTick)
+	}
+}
+
+// tick sends what changed since the last tick.
+func (h *dashboardHub) tick() {
+	now := time.Now()
+	lines := tailLogs(h.logOffsets)
+	mutex.Lock()
+	var point *hostPoint
+	if len(cpuHistory) > 0 && len(memHistory) > 0 {
+		point = &hostPoint{Time: math.Round(now.Sub(h.started).Seconds()*10) / 10, CPU: cpuHistory[len(cpuHistory)-1], Memory: memHistory[len(memHistory)-1]}
+	}
+	mutex.Unlock()
+	state, _ := json.Marshal(currentRunState())
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if point != nil {
+		h.host = append(h.host, *point)
+		if len(h.host) > dashboardHostPoints {
+			h.host = h.host[len(h.host)-dashboardHostPoints:]
+		}
+		h.broadcast(event("host", []hostPoint{*point}))
+	}
+	if len(lines) > 0 {
+		h.logs = append(h.logs, lines...)
+		if len(h.logs) > dashboardLogBacklog {
+			h.logs = h.logs[len(h.logs)-dashboardLogBacklog:]
+		}
+		h.broadcast(event("log", lines))
+	}
+	if !bytes.Equal(state, h.state) {
+		h.state = state
+		h.broadcast(dashboardEvent{name: "state", data: state})
+	}
+	if len(h.subscribers) == 0 {
+		// Nobody is watching: do not read the metrics files, and send the
+		// whole view to the next subscriber.
+		h.sections = nil
+		return
+	}
+	sections := newDashboardView(readMetricsFiles(), now).sections()
+	changed := map[string]json.RawMessage{}
+	for name, data := range sections {
+		if !bytes.Equal(data, h.sections[name]) {
+			changed[name] = data
+		}
+	}
+	h.sections = sections
+	if len(changed) > 0 {
+		h.broadcast(event("metrics", changed))
+	}
+}
+
+// broadcast sends e to every subscriber. A subscriber that has fallen behind
+// is dropped; its browser reconnects and is sent everything again.
+func (h *dashboardHub) broadcast(e dashboardEvent) {
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel of events that starts with the whole state of
+// the dashboard.
+func (h *dashboardHub) subscribe() chan dashboardEvent {
+	sections := newDashboardView(readMetricsFiles(), time.Now()).sections()
+	ch := make(chan dashboardEvent, dashboardSubscriberQ)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch <- event("metrics", sections)
+	ch <- event("host", h.host)
+	ch <- event("log", h.logs)
+	state := h.state
+	if state == nil {
+		state, _ = json.Marshal(currentRunState())
+	}
+	ch <- dashboardEvent{name: "state", data: state}
+	h.subscribers[ch] = true
+	return ch
+}
+
+func (h *dashboardHub) unsubscribe(ch chan dashboardEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscribers[ch] {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// eventsHandler streams the changes to the dashboard as server-sent events.
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	ch := liveDashboard.subscribe()
+	defer liveDashboard.unsubscribe(ch)
+	keepAlive := time.NewTicker(dashboardKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.name, e.data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// tailLogs returns the log entries written to the log files since offsets,
+// oldest first, and moves offsets past them.
+func tailLogs(offsets map[string]int64) []LogEntry {
+	files, err := filepath.Glob(filepath.Join("logs", "logs_*.json"))
+	if err != nil {
+		return nil
+	}
+	var entries []LogEntry
+	for _, lf := range files {
+		info, err := os.Stat(lf)
+		if err != nil || info.Size() <= offsets[lf] {
+			continue
+		}
+		file, err := os.Open(lf)
+		if err != nil {
+			continue
+		}
+		if _, err := file.Seek(offsets[lf], 0); err != nil {
+			file.Close()
+			continue
+		}
+		reader := bufio.NewReader(file)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil {
+				// A line without its newline is still being written.
+				break
+			}
+			offsets[lf] += int64(len(line))
+			var entry LogEntry
+			if err := json.Unmarshal(line, &entry); err == nil {
+				entries = append(entries, entry)
+			}
+		}
+		file.Close()
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp.Before(entries[j].Timestamp)
+	})
+	return entries
+}
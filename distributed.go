@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	connect3270 "github.com/3270io/3270Connect/connect3270"
+	"github.com/3270io/3270Connect/secrets"
+	"github.com/gin-gonic/gin"
+)
+
+// A distributed run has one controller, started with -agents, and an agent
+// on each load machine, started with -agent. The controller splits the load
+// of its workflow among the agents, sends each its share, collects their
+// results for its dashboard and thresholds as they run, and stops them
+// together. An agent runs one share and exits once the controller has
+// collected its final results.
+
+// agentRun is the share of a run the controller sends an agent.
+type agentRun struct {
+	Name          string        `json:"name"` // Address the controller knows the agent by
+	Configuration Configuration `json:"configuration"`
+	Concurrent    int           `json:"concurrent"`
+	Runtime       int           `json:"runtime"`
+	ShutdownGrace int           `json:"shutdownGrace"`
+}
+
+// agentStatus is what an agent reports about its run.
+type agentStatus struct {
+	State   string  `json:"state"`
+	Metrics Metrics `json:"metrics"`
+}
+
+// agentScreen is what an agent reports about the screen of one of its
+// sessions. Screen is nil if there is no such session.
+type agentScreen struct {
+	Screen *sessionScreen `json:"screen"`
+}
+
+// States an agent reports.
+const (
+	agentIdle     = "idle"
+	agentRunning  = "running"
+	agentFinished = "finished"
+)
+
+const (
+	// agentPollInterval is how often the controller collects results.
+	agentPollInterval = 2 * time.Second
+	// agentLostTimeout is how long an agent can go unreachable before the
+	// controller stops waiting for it.
+	agentLostTimeout = 30 * time.Second
+	// agentResultTimeout is how long a finished agent waits for the
+	// controller to collect its results before exiting.
+	agentResultTimeout = time.Minute
+)
+
+var agentClient = &http.Client{Timeout: 10 * time.Second}
+
+// resolveAgentToken resolves a reference in -agentToken and masks the token
+// in logs.
+func resolveAgentToken() error {
+	token, err := secrets.Resolve(agentToken)
+	if err != nil {
+		return err
+	}
+	agentToken = token
+	secrets.Register(agentToken)
+	return nil
+}
+
+// agentAuth rejects requests without the agent token, if one is set.
+func agentAuth(c *gin.Context) {
+	if agentToken == "" {
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte("Bearer "+agentToken)) != 1 {
+		sendErrorResponse(c, http.StatusUnauthorized, "Not authorized", errors.New("missing or wrong agent token"))
+		c.Abort()
+	}
+}
+
+// runAgent serves a controller until its run has finished and returns the
+// process exit code.
+func runAgent() int {
+	connect3270.Headless = true
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.Default()
+	r.SetTrustedProxies(nil)
+	r.Use(agentAuth)
+
+	var (
+		stateMutex    sync.Mutex
+		state         = agentIdle
+		name          string
+		finished      = make(chan struct{})
+		collected     = make(chan struct{})
+		collectedOnce sync.Once
+	)
+	r.POST("/agent/run", func(c *gin.Context) {
+		var run agentRun
+		if err := c.ShouldBindJSON(&run); err != nil {
+			sendErrorResponse(c, http.StatusBadRequest, "Invalid request payload", err)
+			return
+		}
+		config := run.Configuration
+		if err := resolveConfiguration(&config, nil); err != nil {
+			sendErrorResponse(c, http.StatusBadRequest, "Failed to resolve configuration", err)
+			return
+		}
+		if err := validateConfiguration(&config); err != nil {
+			sendErrorResponse(c, http.StatusBadRequest, "Invalid configuration", err)
+			return
+		}
+		setConfigurationDefaults(&config)
+		stateMutex.Lock()
+		if state != agentIdle || stopping() {
+			stateMutex.Unlock()
+			sendErrorResponse(c, http.StatusConflict, "Agent is busy", fmt.Errorf("agent is %s", state))
+			return
+		}
+		state = agentRunning
+		name = run.Name
+		stateMutex.Unlock()
+
+		concurrent = run.Concurrent
+		runtimeDuration = run.Runtime
+		shutdownGrace = run.ShutdownGrace
+		msg := fmt.Sprintf("Starting run from controller at %s: %d concurrent workflows for %ds", c.ClientIP(), concurrent, runtimeDuration)
+		log.Print(msg)
+		storeLog(msg)
+		if err := openResults(); err != nil {
+			log.Printf("Error opening -results: %v", err)
+		}
+		go func() {
+			runConcurrentWorkflows(&config)
+			writeResults(&config, currentMetrics(), nil, exitCode())
+			stateMutex.Lock()
+			state = agentFinished
+			stateMutex.Unlock()
+			close(finished)
+		}()
+		c.JSON(http.StatusOK, gin.H{"returnCode": http.StatusOK, "status": "okay", "message": "Run started"})
+	})
+	r.GET("/agent/status", func(c *gin.Context) {
+		stateMutex.Lock()
+		status := agentStatus{State: state}
+		status.Metrics = currentMetrics()
+		status.Metrics.Agent = name
+		stateMutex.Unlock()
+		c.JSON(http.StatusOK, status)
+		if status.State == agentFinished {
+			collectedOnce.Do(func() { close(collected) })
+		}
+	})
+	r.GET("/agent/screen", func(c *gin.Context) {
+		vu, err := strconv.ParseInt(c.Query("vu"), 10, 64)
+		if err != nil {
+			sendErrorResponse(c, http.StatusBadRequest, "Invalid vu", err)
+			return
+		}
+		var reply agentScreen
+		if screen, ok := readSessionScreen(vu); ok {
+			reply.Screen = &screen
+		}
+		c.JSON(http.StatusOK, reply)
+	})
+	r.POST("/agent/stop", func(c *gin.Context) {
+		requestStop("Controller asked to stop", nil)
+		c.JSON(http.StatusOK, gin.H{"returnCode": http.StatusOK, "status": "okay", "message": "Stopping"})
+	})
+	r.POST("/agent/abort", func(c *gin.Context) {
+		requestStop("Controller asked to abort", nil)
+		abortWorkflows()
+		c.JSON(http.StatusOK, gin.H{"returnCode": http.StatusOK, "status": "okay", "message": "Aborting"})
+	})
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", agentPort), Handler: r}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Failed to start agent: %v", err)
+		}
+	}()
+	log.Printf("Agent waiting for a controller on port %d", agentPort)
+	if agentToken == "" {
+		log.Printf("No -agentToken is set, so anyone who can reach port %d can start a run", agentPort)
+	}
+
+	stop := stopRun
+	for waiting := true; waiting; {
+		select {
+		case <-finished:
+			waiting = false
+		case <-stop:
+			stateMutex.Lock()
+			idle := state == agentIdle
+			stateMutex.Unlock()
+			if idle {
+				return exitCode()
+			}
+			stop = nil
+		}
+	}
+	log.Printf("Run finished, waiting for the controller to collect the results")
+	select {
+	case <-collected:
+	case <-time.After(agentResultTimeout):
+		log.Printf("The controller did not collect the results within %v", agentResultTimeout)
+	}
+	// Let the status response reach the controller before exiting.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	server.Shutdown(ctx)
+	return exitCode()
+}
+
+// controlledAgent is an agent as the controller tracks it.
+type controlledAgent struct {
+	addr     string
+	run      agentRun
+	status   agentStatus
+	lastSeen time.Time
+	lost     bool
+}
+
+func (a *controlledAgent) done() bool {
+	return a.lost || a.status.State == agentFinished
+}
+
+// callAgent sends a request to the agent at addr and decodes its JSON
+// response into result, if given.
+func callAgent(method, addr, path string, body, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	url := addr
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(url, "/")+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if agentToken != "" {
+		req.Header.Set("Authorization", "Bearer "+agentToken)
+	}
+	resp, err := agentClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Message != "" {
+			return fmt.Errorf("%s: %s", e.Message, e.Error)
+		}
+		return fmt.Errorf("%s", resp.Status)
+	}
+	if result != nil {
+		return json.Unmarshal(data, result)
+	}
+	return nil
+}
+
+// splitCount returns the share of total that part i of n gets, giving the
+// remainder to the first parts.
+func splitCount(total, i, n int) int {
+	share := total / n
+	if i < total%n {
+		share++
+	}
+	return share
+}
+
+// agentShare returns the part of the load of config that agent i of n runs.
+// Concurrency, Iterations and stage targets are split as evenly as whole
+// workflows allow, and rates are divided. Thresholds are left to the controller,
+// which checks them against the results of every agent.
+func agentShare(config Configuration, i, n int) agentRun {
+	share := config
+	share.Thresholds = nil
+	share.ArrivalRate = config.ArrivalRate / float64(n)
+	// A MaxInFlight of 0 means -concurrent, which is split as well.
+	maxInFlight := config.MaxInFlight
+	if maxInFlight == 0 {
+		maxInFlight = concurrent
+	}
+	share.MaxInFlight = splitCount(maxInFlight, i, n)
+	if config.ArrivalRate > 0 && share.MaxInFlight == 0 {
+		share.MaxInFlight = 1
+	}
+	// Iterations go to the agents that get workflows to run them.
+	share.Iterations = 0
+	if vus := min(n, concurrent); i < vus {
+		share.Iterations = splitCount(config.Iterations, i, vus)
+	}
+	share.Stages = nil
+	for _, stage := range config.Stages {
+		stage.Target = splitCount(stage.Target, i, n)
+		stage.Rate = stage.Rate / float64(n)
+		share.Stages = append(share.Stages, stage)
+	}
+	return agentRun{
+		Configuration: share,
+		Concurrent:    splitCount(concurrent, i, n),
+		Runtime:       runtimeDuration,
+		ShutdownGrace: shutdownGrace,
+	}
+}
+
+// idle reports whether a share never starts a workflow.
+func (r agentRun) idle() bool {
+	c := r.Configuration
+	if c.ArrivalRate > 0 {
+		return false
+	}
+	for _, stage := range c.Stages {
+		if stage.Target > 0 || stage.Rate > 0 {
+			return false
+		}
+	}
+	return len(c.Stages) > 0 || r.Concurrent == 0
+}
+
+// runController splits the workflow in filePath among the agents in
+// -agents, follows their run and returns the process exit code.
+func runController(filePath string) int {
+	configs, err := readConfigurations(filePath)
+	if err != nil {
+		log.Errorf("%v", err)
+		return 1
+	}
+	selected, err := selectConfiguration(configs, workflowName)
+	if err != nil {
+		log.Errorf("%s: %v", filePath, err)
+		return 1
+	}
+	// References are sent as they are, for each agent to resolve, so that
+	// secrets stay on the agents and are never sent over the network.
+	config := *selected
+	if err := validateConfiguration(&config); err != nil {
+		log.Errorf("%s: invalid configuration: %v", filePath, err)
+		return 1
+	}
+	if config.InputFilePath != "" {
+		steps, err := loadInputFile(config.InputFilePath)
+		if err != nil {
+			log.Errorf("%s: %v", filePath, err)
+			return 1
+		}
+		config.Steps = steps
+		config.InputFilePath = ""
+	}
+	switch {
+	case len(config.Stages) > 0:
+	case config.Iterations > 0 || config.IterationsPerVU > 0:
+	case runtimeDuration <= 0:
+		log.Errorf("A distributed run needs -runtime, Stages, Iterations or IterationsPerVU to say how long to run")
+		return 1
+	case config.ArrivalRate == 0 && concurrent < 1:
+		log.Errorf("-concurrent must be at least 1")
+		return 1
+	}
+
+	var agents []*controlledAgent
+	for _, addr := range strings.Split(agentList, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			agents = append(agents, &controlledAgent{addr: addr})
+		}
+	}
+	if len(agents) == 0 {
+		log.Errorf("-agents lists no agents")
+		return 1
+	}
+	var active []*controlledAgent
+	for i, a := range agents {
+		a.run = agentShare(config, i, len(agents))
+		a.run.Name = a.addr
+		if a.run.idle() {
+			log.Printf("Agent %s has no share of the load and is not used", a.addr)
+			continue
+		}
+		active = append(active, a)
+	}
+	agents = active
+
+	// The controller runs no iterations itself, so its iterations file stays
+	// empty; each agent started with -results writes its own.
+	if err := openResults(); err != nil {
+		log.Errorf("-results: %v", err)
+		return 1
+	}
+	go runDashboard()
+	for i, a := range agents {
+		if err := callAgent(http.MethodPost, a.addr, "/agent/run", a.run, nil); err != nil {
+			log.Errorf("Starting agent %s: %v", a.addr, err)
+			for _, started := range agents[:i] {
+				if err := callAgent(http.MethodPost, started.addr, "/agent/abort", nil, nil); err != nil {
+					log.Printf("Stopping agent %s: %v", started.addr, err)
+				}
+			}
+			return 1
+		}
+		a.lastSeen = time.Now()
+		msg := fmt.Sprintf("Agent %s started with %d concurrent workflows", a.addr, a.run.Concurrent)
+		if a.run.Configuration.ArrivalRate > 0 {
+			msg = fmt.Sprintf("Agent %s started with %g iterations per %s", a.addr, a.run.Configuration.ArrivalRate, newLoadProfile(&a.run.Configuration).per)
+		} else if len(a.run.Configuration.Stages) > 0 {
+			msg = fmt.Sprintf("Agent %s started with its share of %d stages", a.addr, len(a.run.Configuration.Stages))
+		}
+		log.Print(msg)
+		storeLog(msg)
+	}
+
+	var resultsMutex sync.Mutex
+	results := func() Metrics {
+		resultsMutex.Lock()
+		defer resultsMutex.Unlock()
+		var agg Metrics
+		for _, a := range agents {
+			agg.add(a.status.Metrics)
+		}
+		return agg
+	}
+	if config.Thresholds != nil && config.Thresholds.AbortOnBreach {
+		go watchThresholds(config.Thresholds, results)
+	}
+
+	stop, abort := stopRun, abortRun
+	broadcast := func(path string) {
+		for _, a := range agents {
+			if a.done() {
+				continue
+			}
+			if err := callAgent(http.MethodPost, a.addr, path, nil, nil); err != nil {
+				log.Printf("Sending %s to agent %s: %v", path, a.addr, err)
+			}
+		}
+	}
+	for {
+		select {
+		case <-stop:
+			broadcast("/agent/stop")
+			stop = nil
+		case <-abort:
+			broadcast("/agent/abort")
+			abort = nil
+		case <-time.After(agentPollInterval):
+		}
+		if pollAgents(agents, &resultsMutex) {
+			break
+		}
+	}
+
+	final := results()
+	msg := fmt.Sprintf("All agents finished: %d workflows completed, %d failed", final.TotalWorkflowsCompleted, final.TotalWorkflowsFailed)
+	log.Print(msg)
+	storeLog(msg)
+	logFailureBreakdown(final)
+	var checks []thresholdCheck
+	if config.Thresholds != nil {
+		checks = checkThresholds(config.Thresholds, final)
+	}
+	code := exitCode()
+	for _, a := range agents {
+		if a.lost && code == 0 {
+			code = 1
+		}
+	}
+	writeResults(&config, final, checks, code)
+	finishRun(code)
+	if stopping() {
+		return code
+	}
+	if dashboardStarted {
+		log.Printf("The dashboard is still running on port %d. Press Ctrl+C to exit.", dashboardPort)
+		<-stopRun
+	}
+	return code
+}
+
+// pollAgents collects the status of every agent still running, writes each
+// one's results for the dashboard and reports whether all have finished.
+func pollAgents(agents []*controlledAgent, resultsMutex *sync.Mutex) bool {
+	var wg sync.WaitGroup
+	for i, a := range agents {
+		if a.done() {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, a *controlledAgent) {
+			defer wg.Done()
+			var status agentStatus
+			if err := callAgent(http.MethodGet, a.addr, "/agent/status", nil, &status); err != nil {
+				if time.Since(a.lastSeen) > agentLostTimeout {
+					a.lost = true
+					msg := fmt.Sprintf("Agent %s has not answered for %v and is left out of the results: %v", a.addr, agentLostTimeout, err)
+					log.Print(msg)
+					storeLog(msg)
+				}
+				return
+			}
+			status.Metrics.Agent = a.addr
+			resultsMutex.Lock()
+			a.status = status
+			a.lastSeen = time.Now()
+			resultsMutex.Unlock()
+			writeMetricsFile(fmt.Sprintf("metrics_agent%d.json", i+1), status.Metrics)
+			if status.State == agentFinished {
+				msg := fmt.Sprintf("Agent %s finished: %d workflows completed, %d failed", a.addr, status.Metrics.TotalWorkflowsCompleted, status.Metrics.TotalWorkflowsFailed)
+				log.Print(msg)
+				storeLog(msg)
+			}
+		}(i, a)
+	}
+	wg.Wait()
+	for _, a := range agents {
+		if !a.done() {
+			return false
+		}
+	}
+	return true
+}
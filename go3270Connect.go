@@ -1,32 +1,48 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	connect3270 "github.com/3270io/3270Connect/connect3270"
+	"github.com/3270io/3270Connect/histogram"
+	"github.com/3270io/3270Connect/macro"
+	"github.com/3270io/3270Connect/recorder"
 	"github.com/3270io/3270Connect/sampleapps/app1"
 	app2 "github.com/3270io/3270Connect/sampleapps/app2"
+	"github.com/3270io/3270Connect/screens"
+	"github.com/3270io/3270Connect/secrets"
+	"github.com/3270io/3270Connect/tracing"
 
 	"github.com/gin-gonic/gin"
 	"github.com/shirou/gopsutil/cpu"
 	"github.com/shirou/gopsutil/mem"
 	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
 const version = "1.3"
@@ -34,27 +50,173 @@ const version = "1.3"
 var log = logrus.New()
 
 func init() {
-	log.SetFormatter(&logrus.TextFormatter{})
+	log.SetFormatter(&redactingFormatter{&logrus.TextFormatter{}})
 	log.SetOutput(os.Stdout)
 	log.SetLevel(logrus.InfoLevel)
 }
 
+// redactingFormatter masks secret values in formatted log entries.
+type redactingFormatter struct {
+	logrus.Formatter
+}
+
+func (f *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	data, err := f.Formatter.Format(entry)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(secrets.Redact(string(data))), nil
+}
+
 // Configuration holds the settings for the terminal connection and the steps to be executed.
 type Configuration struct {
-	Host            string
-	Port            int
-	OutputFilePath  string `json:"OutputFilePath"`
-	Steps           []Step
-	InputFilePath   string  `json:"InputFilePath"` // New field for the input file path
-	RampUpBatchSize int     `json:"RampUpBatchSize"`
-	RampUpDelay     float64 `json:"RampUpDelay"`
+	Schema          string      `json:"$schema,omitempty" yaml:"$schema,omitempty"` // JSON Schema reference for editors, ignored when running
+	Name            string      `json:"Name,omitempty" yaml:"Name,omitempty"`       // Selects this workflow with -workflow when a file defines several
+	Host            string      `yaml:"Host"`
+	Port            int         `yaml:"Port"`
+	OutputFilePath  string      `json:"OutputFilePath" yaml:"OutputFilePath"`
+	Steps           []Step      `yaml:"Steps"`
+	InputFilePath   string      `json:"InputFilePath" yaml:"InputFilePath,omitempty"` // New field for the input file path
+	RampUpBatchSize int         `json:"RampUpBatchSize" yaml:"RampUpBatchSize,omitempty"`
+	RampUpDelay     float64     `json:"RampUpDelay" yaml:"RampUpDelay,omitempty"`
+	OnFailure       []Step      `json:"OnFailure,omitempty" yaml:"OnFailure,omitempty"`             // Run when a step fails, e.g. to capture the screen and log off
+	Finally         []Step      `json:"Finally,omitempty" yaml:"Finally,omitempty"`                 // Always run at the end of the workflow
+	Pacing          float64     `json:"Pacing,omitempty" yaml:"Pacing,omitempty"`                   // Seconds between iteration starts in concurrent mode, 0 to start immediately
+	ScreenCatalogue string      `json:"ScreenCatalogue,omitempty" yaml:"ScreenCatalogue,omitempty"` // Path to the screen catalogue used by ExpectScreen and WaitForScreen
+	ArrivalRate     float64     `json:"ArrivalRate,omitempty" yaml:"ArrivalRate,omitempty"`         // Iterations started per ArrivalRateUnit regardless of response time, 0 to keep -concurrent workflows running instead
+	ArrivalRateUnit string      `json:"ArrivalRateUnit,omitempty" yaml:"ArrivalRateUnit,omitempty"` // "second" (default) or "minute"
+	MaxInFlight     int         `json:"MaxInFlight,omitempty" yaml:"MaxInFlight,omitempty"`         // Most iterations running at once with ArrivalRate, -concurrent if 0
+	Stages          []Stage     `json:"Stages,omitempty" yaml:"Stages,omitempty"`                   // Load profile that replaces -concurrent, -runtime and ArrivalRate
+	Iterations      int         `json:"Iterations,omitempty" yaml:"Iterations,omitempty"`           // Iterations run in total by the -concurrent workflows, 0 for no limit
+	IterationsPerVU int         `json:"IterationsPerVU,omitempty" yaml:"IterationsPerVU,omitempty"` // Iterations each of the -concurrent workflows runs, 0 for no limit
+	KeepSession     bool        `json:"KeepSession,omitempty" yaml:"KeepSession,omitempty"`         // Each workflow keeps its session open: Setup once, Steps every iteration, then Teardown
+	Setup           []Step      `json:"Setup,omitempty" yaml:"Setup,omitempty"`                     // Run when a KeepSession session opens, e.g. to connect and log on
+	Teardown        []Step      `json:"Teardown,omitempty" yaml:"Teardown,omitempty"`               // Run when a KeepSession session closes, e.g. to log off
+	Thresholds      *Thresholds `json:"Thresholds,omitempty" yaml:"Thresholds,omitempty"`           // Pass/fail rules for the run
+}
+
+// Thresholds are pass/fail rules checked when a run ends. A run that breaks
+// any of them exits with exitThresholdsFailed. Rules that are not set are not
+// checked.
+type Thresholds struct {
+	MaxErrorRate      *float64           `json:",omitempty" yaml:"MaxErrorRate,omitempty"`      // Percentage of finished workflows that may fail
+	MaxP95Duration    float64            `json:",omitempty" yaml:"MaxP95Duration,omitempty"`    // Seconds, 95th percentile of workflow durations
+	MaxTransactionP95 map[string]float64 `json:",omitempty" yaml:"MaxTransactionP95,omitempty"` // Seconds, 95th percentile of each named transaction
+	MinCompleted      int64              `json:",omitempty" yaml:"MinCompleted,omitempty"`      // Workflows that must complete successfully
+	AbortOnBreach     bool               `json:",omitempty" yaml:"AbortOnBreach,omitempty"`     // Also check while running and stop the run on the first breach
+	AbortMinWorkflows int64              `json:",omitempty" yaml:"AbortMinWorkflows,omitempty"` // Finished workflows needed before AbortOnBreach checks, 10 if 0
+}
+
+// Stage is one phase of a load profile, such as a ramp-up, a steady state or
+// a spike. Each stage reaches Target concurrent workflows, or starts Rate
+// iterations per ArrivalRateUnit; every stage of a profile uses the same one.
+type Stage struct {
+	Duration      float64 `yaml:"Duration"`                                  // Seconds
+	Target        int     `json:",omitempty" yaml:"Target,omitempty"`        // Concurrent workflows
+	Rate          float64 `json:",omitempty" yaml:"Rate,omitempty"`          // Iterations started per ArrivalRateUnit
+	Interpolation string  `json:",omitempty" yaml:"Interpolation,omitempty"` // "linear" (default) moves from the previous stage's value, "step" switches at once
 }
 
 // Step represents an individual action to be taken on the terminal.
 type Step struct {
-	Type        string
-	Coordinates connect3270.Coordinates // Use go3270 package's Coordinates type
-	Text        string
+	Type            string                  `yaml:"Type"`
+	Coordinates     connect3270.Coordinates `yaml:"Coordinates,omitempty"` // Use go3270 package's Coordinates type
+	Text            string                  `yaml:"Text,omitempty"`
+	Timeout         float64                 `json:"Timeout,omitempty" yaml:"Timeout,omitempty"`                 // Seconds before the step is abandoned, 0 for no limit
+	Retries         int                     `json:"Retries,omitempty" yaml:"Retries,omitempty"`                 // Additional attempts after a failure
+	RetryDelay      float64                 `json:"RetryDelay,omitempty" yaml:"RetryDelay,omitempty"`           // Seconds to wait between attempts
+	ContinueOnError bool                    `json:"ContinueOnError,omitempty" yaml:"ContinueOnError,omitempty"` // Carry on with the next step if this one fails
+	Think           *ThinkTime              `json:"Think,omitempty" yaml:"Think,omitempty"`                     // Pause used by Think steps
+	Transaction     string                  `json:"Transaction,omitempty" yaml:"Transaction,omitempty"`         // Transaction name for Begin/EndTransaction, or timed from key press to unlock on Press steps
+	Secret          bool                    `json:"Secret,omitempty" yaml:"Secret,omitempty"`                   // Mask Text wherever it would be logged or captured
+	Screen          string                  `json:"Screen,omitempty" yaml:"Screen,omitempty"`                   // Screen catalogue name for ExpectScreen and WaitForScreen
+}
+
+// ThinkTime describes the pause taken by a Think step. All values are in seconds.
+type ThinkTime struct {
+	Distribution string  `yaml:"Distribution,omitempty"`               // "fixed" (default), "uniform", "normal" or "exponential"
+	Duration     float64 `json:",omitempty" yaml:"Duration,omitempty"` // fixed
+	Min          float64 `json:",omitempty" yaml:"Min,omitempty"`      // uniform; lower bound for normal and exponential
+	Max          float64 `json:",omitempty" yaml:"Max,omitempty"`      // uniform; upper bound for normal and exponential, 0 for none
+	Mean         float64 `json:",omitempty" yaml:"Mean,omitempty"`     // normal and exponential
+	StdDev       float64 `json:",omitempty" yaml:"StdDev,omitempty"`   // normal
+}
+
+var (
+	thinkRand      = rand.New(rand.NewSource(time.Now().UnixNano()))
+	thinkRandMutex sync.Mutex
+)
+
+// Sample draws a pause from the distribution.
+func (t *ThinkTime) Sample() time.Duration {
+	thinkRandMutex.Lock()
+	var seconds float64
+	switch strings.ToLower(t.Distribution) {
+	case "uniform":
+		seconds = t.Min + thinkRand.Float64()*(t.Max-t.Min)
+	case "normal":
+		seconds = t.Mean + thinkRand.NormFloat64()*t.StdDev
+	case "exponential":
+		seconds = thinkRand.ExpFloat64() * t.Mean
+	default:
+		seconds = t.Duration
+	}
+	thinkRandMutex.Unlock()
+	if seconds < t.Min {
+		seconds = t.Min
+	}
+	if t.Max > 0 && seconds > t.Max {
+		seconds = t.Max
+	}
+	if seconds < 0 {
+		seconds = 0
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// average returns the mean pause of the distribution, ignoring Min and Max.
+func (t *ThinkTime) average() time.Duration {
+	var seconds float64
+	switch strings.ToLower(t.Distribution) {
+	case "uniform":
+		seconds = (t.Min + t.Max) / 2
+	case "normal", "exponential":
+		seconds = t.Mean
+	default:
+		seconds = t.Duration
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// validate checks that the parameters required by the distribution are set.
+func (t *ThinkTime) validate() error {
+	if t.Duration < 0 || t.Min < 0 || t.Max < 0 || t.Mean < 0 || t.StdDev < 0 {
+		return fmt.Errorf("think time values must not be negative")
+	}
+	if t.Max > 0 && t.Max < t.Min {
+		return fmt.Errorf("think time Max is less than Min")
+	}
+	switch strings.ToLower(t.Distribution) {
+	case "", "fixed":
+		if t.Duration == 0 {
+			return fmt.Errorf("fixed think time needs a Duration")
+		}
+	case "uniform":
+		if t.Max == 0 {
+			return fmt.Errorf("uniform think time needs Min and Max")
+		}
+	case "normal":
+		if t.Mean == 0 || t.StdDev == 0 {
+			return fmt.Errorf("normal think time needs Mean and StdDev")
+		}
+	case "exponential":
+		if t.Mean == 0 {
+			return fmt.Errorf("exponential think time needs a Mean")
+		}
+	default:
+		return fmt.Errorf("unknown think time distribution: %s", t.Distribution)
+	}
+	return nil
 }
 
 var (
@@ -66,9 +228,26 @@ var (
 	headless        bool // Run go3270 in headless mode
 	verbose         bool
 	runApp          string
-	runtimeDuration int // Duration to run workflows (only used in concurrent mode)
-	lastUsedPort    int // Will be set from startPort flag
-	startPort       int // Starting port for workflow connections
+	runtimeDuration int    // Duration to run workflows (only used in concurrent mode)
+	startPort       int    // First script port leased to emulators
+	endPort         int    // Last script port leased to emulators, 0 for startPort+9999
+	scriptTransport string // How emulators take script commands
+	workflowName    string
+	validateOnly    bool   // Validate the configuration file and exit
+	printSchema     bool   // Print the configuration JSON Schema and exit
+	convertFile     string // Macro to convert to a workflow
+	convertFormat   string // Format of convertFile, detected if empty
+	convertOutput   string // Workflow file written by -convert
+	exportFormat    string // Format to export the workflow to
+	exportOutput    string // File written by -export, standard output if empty
+	recordOutput    string // Workflow file written by -record
+	recordHost      string // Host recorded, as host or host:port
+	recordListen    int    // Local port the recording proxy listens on, 0 for any
+	shutdownGrace   int    // Seconds running workflows get to finish after a signal
+	agentMode       bool   // Run as an agent that takes its load from a controller
+	agentPort       int    // Port an agent listens on
+	agentList       string // Comma-separated agent addresses; runs as a controller if set
+	agentToken      string // Token agents require from the controller
 )
 
 var dashboardStarted bool
@@ -78,6 +257,10 @@ var totalWorkflowsStarted int64
 var totalWorkflowsCompleted int64
 var totalWorkflowsFailed int64
 
+// totalIterationsDropped counts arrivals that were not started because
+// MaxInFlight iterations were already running.
+var totalIterationsDropped int64
+
 // Flag for the dashboard port.
 var dashboardPort int
 
@@ -86,7 +269,184 @@ var mutex sync.Mutex
 
 // Global variables for workflow durations.
 var timingsMutex sync.Mutex
-var workflowDurations []float64
+var workflowDurations histogram.Histogram
+
+// Per-transaction durations, keyed by transaction name and guarded by
+// timingsMutex.
+var transactionDurations = map[string]*histogram.Histogram{}
+
+// Workflows completed and failed per second, for the recent rates, guarded
+// by timingsMutex.
+var completedSeries, failedSeries histogram.Series
+
+// Step results keyed by step type and by stepName, and failed steps by
+// stepName and error category, guarded by timingsMutex.
+var stepTypeMetrics = map[string]*StepMetrics{}
+var stepMetrics = map[string]*StepMetrics{}
+var stepFailures = map[string]map[string]int64{}
+
+// Number of failed workflows per catalogued screen the failure happened on.
+var failureScreens = map[string]int64{}
+var failureScreensMutex sync.Mutex
+
+// recordFailureScreen counts a workflow failure against a screen name.
+func recordFailureScreen(name string) {
+	if name == "" {
+		name = "unknown"
+	}
+	failureScreensMutex.Lock()
+	failureScreens[name]++
+	failureScreensMutex.Unlock()
+}
+
+// recordTransaction stores the duration of a completed transaction.
+func recordTransaction(name string, duration time.Duration) {
+	if connect3270.Verbose {
+		log.Printf("Transaction %s took %v", name, duration)
+	}
+	timingsMutex.Lock()
+	h := transactionDurations[name]
+	if h == nil {
+		h = &histogram.Histogram{}
+		transactionDurations[name] = h
+	}
+	h.Record(duration)
+	timingsMutex.Unlock()
+}
+
+// recordWorkflowDuration stores the duration of a workflow or iteration.
+func recordWorkflowDuration(duration time.Duration) {
+	timingsMutex.Lock()
+	workflowDurations.Record(duration)
+	timingsMutex.Unlock()
+}
+
+// stepLists are the lists of steps a workflow can have, in the order they run.
+var stepLists = []string{"Setup", "Steps", "Teardown", "OnFailure", "Finally"}
+
+// StepMetrics counts the executions of one step of a workflow, or of every
+// step of one type.
+type StepMetrics struct {
+	List       string              `json:"list,omitempty"`  // Steps, Setup, Teardown, OnFailure or Finally
+	Index      int                 `json:"index,omitempty"` // 1-based position in List
+	Type       string              `json:"type"`
+	Executions int64               `json:"executions"`
+	Failures   int64               `json:"failures"`
+	Retries    int64               `json:"retries"`
+	Durations  histogram.Histogram `json:"durations"` // Including retries
+}
+
+// merge adds the counts in o.
+func (sm *StepMetrics) merge(o *StepMetrics) {
+	sm.Executions += o.Executions
+	sm.Failures += o.Failures
+	sm.Retries += o.Retries
+	sm.Durations.Merge(&o.Durations)
+}
+
+// copyStepMetrics returns a copy of steps that shares nothing with it.
+func copyStepMetrics(steps map[string]*StepMetrics) map[string]*StepMetrics {
+	c := make(map[string]*StepMetrics, len(steps))
+	for name, sm := range steps {
+		c[name] = &StepMetrics{List: sm.List, Index: sm.Index, Type: sm.Type}
+		c[name].merge(sm)
+	}
+	return c
+}
+
+// mergeStepMetrics adds the counts in from to those in *into.
+func mergeStepMetrics(into *map[string]*StepMetrics, from map[string]*StepMetrics) {
+	for name, sm := range from {
+		if *into == nil {
+			*into = map[string]*StepMetrics{}
+		}
+		if (*into)[name] == nil {
+			(*into)[name] = &StepMetrics{List: sm.List, Index: sm.Index, Type: sm.Type}
+		}
+		(*into)[name].merge(sm)
+	}
+}
+
+// stepName names a step by its list and 1-based position, as in "Steps 3
+// CheckValue".
+func stepName(list string, index int, step Step) string {
+	return fmt.Sprintf("%s %d %s", list, index+1, step.Type)
+}
+
+// Categories of step errors in the failure breakdown.
+const (
+	errorAborted  = "aborted"
+	errorTimeout  = "timeout"
+	errorConnect  = "connect"
+	errorCheck    = "check value"
+	errorScreen   = "wrong screen"
+	errorEmulator = "emulator"
+)
+
+// errorCategory sorts the error of a failed step into one of the categories
+// of the failure breakdown.
+func errorCategory(step Step, err error) string {
+	msg := strings.ToLower(err.Error())
+	switch {
+	case errors.Is(err, errRunAborted):
+		return errorAborted
+	case strings.Contains(msg, "timed out") || strings.Contains(msg, "timeout"):
+		return errorTimeout
+	case step.Type == "Connect":
+		return errorConnect
+	case step.Type == "CheckValue":
+		return errorCheck
+	case step.Type == "ExpectScreen" || step.Type == "WaitForScreen":
+		return errorScreen
+	}
+	return errorEmulator
+}
+
+// recordStep counts one execution of the step at index in list, which took
+// attempts tries and ended with err.
+func recordStep(list string, index int, step Step, duration time.Duration, attempts int, err error) {
+	name := stepName(list, index, step)
+	timingsMutex.Lock()
+	defer timingsMutex.Unlock()
+	if stepTypeMetrics[step.Type] == nil {
+		stepTypeMetrics[step.Type] = &StepMetrics{Type: step.Type}
+	}
+	if stepMetrics[name] == nil {
+		stepMetrics[name] = &StepMetrics{List: list, Index: index + 1, Type: step.Type}
+	}
+	for _, sm := range []*StepMetrics{stepTypeMetrics[step.Type], stepMetrics[name]} {
+		sm.Executions++
+		sm.Retries += int64(attempts - 1)
+		sm.Durations.Record(duration)
+		if err != nil {
+			sm.Failures++
+		}
+	}
+	if err != nil {
+		if stepFailures[name] == nil {
+			stepFailures[name] = map[string]int64{}
+		}
+		stepFailures[name][errorCategory(step, err)]++
+	}
+}
+
+// finishIteration counts a finished workflow, or iteration of a KeepSession
+// workflow, as failed if err is set and completed otherwise, and writes it to
+// the results. vu is the number of the workflow or session and iteration the
+// 1-based iteration in it.
+func finishIteration(vu int64, iteration int, start time.Time, err error) {
+	recordIteration(vu, iteration, start, err)
+	failed := err != nil
+	timingsMutex.Lock()
+	if failed {
+		atomic.AddInt64(&totalWorkflowsFailed, 1)
+		failedSeries.Add(time.Now())
+	} else {
+		atomic.AddInt64(&totalWorkflowsCompleted, 1)
+		completedSeries.Add(time.Now())
+	}
+	timingsMutex.Unlock()
+}
 
 // Global variables for host-wide CPU and memory usage history.
 var cpuHistory []float64
@@ -114,12 +474,12 @@ func storeLog(message string) {
 
 	// Get the entire command-line arguments except the program name
 	args := os.Args[1:]
-	parameters := strings.Join(args, " ")
+	parameters := secrets.Redact(strings.Join(args, " "))
 
 	logEntry := LogEntry{
 		PID:        strconv.Itoa(pid),
 		Parameters: parameters,
-		Log:        message,
+		Log:        secrets.Redact(message),
 		Timestamp:  time.Now(),
 	}
 	inMemoryLogs = append(inMemoryLogs, logEntry)
@@ -145,7 +505,27 @@ var dashboardTemplateFS embed.FS
 var dashboardTemplate *template.Template
 
 func init() {
-	flag.StringVar(&configFile, "config", "workflow.json", "Path to the configuration file")
+	flag.StringVar(&configFile, "config", "workflow.json", "Path to the configuration file (JSON or YAML)")
+	flag.StringVar(&workflowName, "workflow", "", "Name of the workflow to run when the configuration file defines several")
+	flag.BoolVar(&validateOnly, "validate", false, "Validate the configuration file, report every problem found and exit non-zero if it is invalid")
+	flag.BoolVar(&printSchema, "schema", false, "Print the JSON Schema for configuration files and exit")
+	flag.StringVar(&convertFile, "convert", "", "Convert a macro or script from another 3270 tool to a workflow file and exit")
+	flag.StringVar(&convertFormat, "convertFormat", "", "Format of the -convert file: "+strings.Join(macro.Formats, ", ")+" (detected if not set)")
+	flag.StringVar(&convertOutput, "convertOutput", "", "Workflow file written by -convert, as YAML if it ends in .yaml or .yml and JSON otherwise (default: the macro name with .json)")
+	flag.StringVar(&exportFormat, "export", "", "Export the workflow as "+strings.Join(macro.ExportFormats, ", ")+" and exit")
+	flag.StringVar(&exportOutput, "exportOutput", "", "File written by -export (default: standard output)")
+	flag.StringVar(&recordOutput, "record", "", "Record an interactive session with -recordHost and write it as a workflow to this file (YAML if it ends in .yaml or .yml, JSON otherwise)")
+	flag.StringVar(&recordHost, "recordHost", "", "Host to record, as host or host:port (default port 23)")
+	flag.IntVar(&recordListen, "recordListen", 0, "Local port the recording proxy listens on (default: any free port)")
+	flag.StringVar(&resultsDir, "results", "", "Directory to write the run results to: "+resultsSummaryFile+", "+resultsIterationsFile+" and "+resultsJUnitFile)
+	flag.StringVar(&traceFile, "traceFile", "", "File to append a trace of every workflow iteration to, as OTLP JSON")
+	flag.StringVar(&traceEndpoint, "traceEndpoint", "", "OTLP/HTTP collector to send a trace of every workflow iteration to, such as http://localhost:4318")
+	flag.Float64Var(&traceSample, "traceSample", 1, "Fraction of workflow iterations to trace, from 0 to 1")
+	flag.IntVar(&shutdownGrace, "shutdownGrace", 30, "Seconds running workflows get to finish after SIGINT or SIGTERM before they are aborted")
+	flag.BoolVar(&agentMode, "agent", false, "Run as an agent that runs its share of a load test for a controller started with -agents")
+	flag.IntVar(&agentPort, "agentPort", 9300, "Port an agent listens on for its controller")
+	flag.StringVar(&agentList, "agents", "", "Comma-separated host:port addresses of agents to split the load among; runs this process as their controller")
+	flag.StringVar(&agentToken, "agentToken", "", "Token the controller and its agents share to authenticate, given directly or as an ${env:NAME} or ${file:/path} reference")
 	flag.BoolVar(&showHelp, "help", false, "Show usage information")
 	flag.BoolVar(&runAPI, "api", false, "Run as API")
 	flag.IntVar(&apiPort, "api-port", 8080, "API port")
@@ -155,7 +535,9 @@ func init() {
 	flag.IntVar(&runtimeDuration, "runtime", 0, "Duration to run workflows in seconds. Only used in concurrent mode.")
 	flag.StringVar(&runApp, "runApp", "", "Select which sample 3270 application to run (e.g., '1' for app1, '2' for app2)")
 	flag.IntVar(&runAppPort, "runApp-port", 3270, "Port for the sample 3270 application (default 3270)")
-	flag.IntVar(&startPort, "startPort", 5000, "Starting port number for workflow connections")
+	flag.IntVar(&startPort, "startPort", 5000, "First port of the range emulators are given script ports from")
+	flag.IntVar(&endPort, "endPort", 0, "Last port of the range emulators are given script ports from (default startPort+9999, at most 65535)")
+	flag.StringVar(&scriptTransport, "scriptTransport", connect3270.TransportPort, "How emulators take script commands: "+strings.Join(connect3270.Transports, ", "))
 	flag.IntVar(&dashboardPort, "dashboardPort", 9200, "Port for the dashboard server")
 
 	// Create logs directory if it doesn't exist
@@ -168,451 +550,1282 @@ func init() {
 	handleError(err, "Error parsing dashboard template")
 }
 
-func loadConfiguration(filePath string) *Configuration {
+func loadConfiguration(filePath string) (*Configuration, error) {
 	if connect3270.Verbose {
 		log.Printf("Loading configuration from %s", filePath)
 	}
-	configFile, err := os.Open(filePath)
-	handleError(err, fmt.Sprintf("Error opening config file at %s", filePath))
-	defer configFile.Close()
-	var config Configuration
-	decoder := json.NewDecoder(configFile)
-	err = decoder.Decode(&config)
-	handleError(err, "Error decoding config JSON")
-	if config.RampUpBatchSize <= 0 {
+	configs, err := readConfigurations(filePath)
+	if err != nil {
+		return nil, err
+	}
+	config, err := selectConfiguration(configs, workflowName)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	if err := resolveConfiguration(config, nil); err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	if err := validateConfiguration(config); err != nil {
+		return nil, fmt.Errorf("%s: invalid configuration: %v", filePath, err)
+	}
+	setConfigurationDefaults(config)
+	return config, nil
+}
+
+// setConfigurationDefaults fills in settings that have defaults.
+func setConfigurationDefaults(config *Configuration) {
+	if config.RampUpBatchSize == 0 {
 		config.RampUpBatchSize = 10
 	}
-	if config.RampUpDelay <= 0 {
+	if config.RampUpDelay == 0 {
 		config.RampUpDelay = 1.0
 	}
-	err = validateConfiguration(&config)
-	handleError(err, "Invalid configuration")
-	return &config
 }
 
-func handleError(err error, message string) {
-	if err != nil {
-		log.Fatalf("%s: %v", message, err)
+// resolveConfiguration replaces ${env:NAME} and ${file:/path} references in
+// every string value of the configuration and registers the resolved values
+// and the text of Secret steps in scope, so that they are masked in logs,
+// screen captures and API responses. A nil scope keeps them registered for
+// the life of the process.
+func resolveConfiguration(config *Configuration, scope *secrets.Scope) error {
+	var errs validationErrors
+	resolveReferences(reflect.ValueOf(config).Elem(), "", scope, &errs)
+	if len(errs) > 0 {
+		return errs
 	}
+	registerSecrets(config, scope)
+	return nil
 }
 
-func loadInputFile(filePath string) ([]Step, error) {
-	if connect3270.Verbose {
-		log.Printf("Loading input file: %s", filePath)
+// registerSecrets registers the text of every Secret step in config.
+func registerSecrets(config *Configuration, scope *secrets.Scope) {
+	for _, steps := range [][]Step{config.Setup, config.Steps, config.Teardown, config.OnFailure, config.Finally} {
+		for _, step := range steps {
+			if step.Secret {
+				scope.Register(step.Text)
+			}
+		}
+	}
+}
+
+// resolveReferences walks v and resolves references in every settable
+// string, recording failures against the field path.
+func resolveReferences(v reflect.Value, path string, scope *secrets.Scope, errs *validationErrors) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			resolveReferences(v.Elem(), path, scope, errs)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name := v.Type().Field(i).Name
+			if path != "" {
+				name = path + "." + name
+			}
+			resolveReferences(v.Field(i), name, scope, errs)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			resolveReferences(v.Index(i), fmt.Sprintf("%s[%d]", path, i+1), scope, errs)
+		}
+	case reflect.String:
+		resolved, err := scope.Resolve(v.String())
+		if err != nil {
+			errs.add("%s: %v", path, err)
+			return
+		}
+		v.SetString(resolved)
+	}
+}
+
+// validateConfigurationFile validates the workflow selected by -workflow, or
+// every workflow in the file if none is selected, and returns the process exit
+// code.
+func validateConfigurationFile(filePath string) int {
+	configs, err := readConfigurations(filePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if workflowName != "" {
+		config, err := selectConfiguration(configs, workflowName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filePath, err)
+			return 1
+		}
+		configs = []Configuration{*config}
+	}
+	exitCode := 0
+	for i := range configs {
+		label := filePath
+		if configs[i].Name != "" {
+			label = fmt.Sprintf("%s (%s)", filePath, configs[i].Name)
+		}
+		if err := resolveConfiguration(&configs[i], nil); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", label, err)
+			exitCode = 1
+			continue
+		}
+		if err := validateConfiguration(&configs[i]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", label, err)
+			exitCode = 1
+			continue
+		}
+		fmt.Printf("%s: configuration is valid\n", label)
 	}
+	return exitCode
+}
+
+// convertMacroFile converts a macro written for another 3270 tool to a
+// workflow file and returns the process exit code. Nothing is written if any
+// part of the macro cannot be converted.
+func convertMacroFile(filePath, format, outputPath string) int {
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		log.Printf("Error reading input file %s: %v", filePath, err)
-		return nil, fmt.Errorf("error reading input file: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-	if connect3270.Verbose {
-		log.Printf("Successfully read input file: %d bytes", len(data))
+	if format == "" {
+		if format, err = macro.DetectFormat(filePath, data); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
 	}
-	var steps []Step
-	steps = append(steps, Step{Type: "Connect"})
-	if connect3270.Verbose {
-		log.Printf("Added initial Connect step")
+	script, err := macro.Import(filePath, data, format)
+	if list, ok := err.(macro.ErrorList); ok {
+		fmt.Fprintf(os.Stderr, "%s: %d construct(s) could not be converted:\n", filePath, len(list))
+		for _, e := range list {
+			fmt.Fprintf(os.Stderr, "  %v\n", e)
+		}
+		return 1
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
-	lines := strings.Split(string(data), "\n")
-	for idx, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
+
+	config := &Configuration{
+		Host:           script.Host,
+		Port:           script.Port,
+		OutputFilePath: "output.html",
+		Steps:          append(append([]Step{{Type: "Connect"}}, stepsFromActions(script.Actions)...), Step{Type: "Disconnect"}),
+	}
+	if config.Host == "" {
+		config.Host = "localhost"
+		fmt.Fprintf(os.Stderr, "%s: the macro does not name a host, so Host is set to %s\n", filePath, config.Host)
+	}
+	if config.Port == 0 {
+		config.Port = 23
+	}
+	if err := validateConfiguration(config); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: the converted workflow is not valid: %v\n", filePath, err)
+		return 1
+	}
+	if outputPath == "" {
+		outputPath = strings.TrimSuffix(filePath, filepath.Ext(filePath)) + ".json"
+	}
+	if err := writeConfiguration(outputPath, config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", outputPath, err)
+		return 1
+	}
+	fmt.Printf("%s: converted %s macro to %s with %d steps\n", filePath, format, outputPath, len(config.Steps))
+	return 0
+}
+
+// recordCheckTimeout is how long recorded CheckValue steps wait for their
+// screen to arrive.
+const recordCheckTimeout = 10 * time.Second
+
+// recordWorkflow relays an interactive session with host through a local
+// proxy, opening x3270 on it unless running headless, and writes what the
+// user did as a workflow when the session ends or on Ctrl+C. It returns the
+// process exit code.
+func recordWorkflow(host, outputPath string) int {
+	if host == "" {
+		fmt.Fprintln(os.Stderr, "-record needs -recordHost")
+		return 1
+	}
+	script := &macro.Script{}
+	if err := script.SetHost(host); err != nil {
+		fmt.Fprintf(os.Stderr, "-recordHost: %v\n", err)
+		return 1
+	}
+	if script.Port == 0 {
+		script.Port = 23
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", recordListen))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error starting the recording proxy: %v\n", err)
+		return 1
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	stopRecording := func() { stopOnce.Do(func() { close(stop) }) }
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		if _, ok := <-signals; ok {
+			stopRecording()
 		}
-		if connect3270.Verbose {
-			log.Printf("Processing line %d: %s", idx+1, line)
-		}
-		if strings.HasPrefix(line, "yield ps.sendKeys") {
-			key := strings.TrimPrefix(line, "yield ps.sendKeys(")
-			key = strings.TrimSuffix(key, ");")
-			key = strings.Trim(key, "'")
-			stepType := ""
-			switch key {
-			case "ControlKey.TAB":
-				stepType = "PressTab"
-			case "ControlKey.ENTER":
-				stepType = "PressEnter"
-			case "ControlKey.F1":
-				stepType = "PressPF1"
-			case "ControlKey.F2":
-				stepType = "PressPF2"
-			case "ControlKey.F3":
-				stepType = "PressPF3"
-			case "ControlKey.F4":
-				stepType = "PressPF4"
-			case "ControlKey.F5":
-				stepType = "PressPF5"
-			case "ControlKey.F6":
-				stepType = "PressPF6"
-			case "ControlKey.F7":
-				stepType = "PressPF7"
-			case "ControlKey.F8":
-				stepType = "PressPF8"
-			case "ControlKey.F9":
-				stepType = "PressPF9"
-			case "ControlKey.F10":
-				stepType = "PressPF10"
-			case "ControlKey.F11":
-				stepType = "PressPF11"
-			case "ControlKey.F12":
-				stepType = "PressPF12"
-			case "ControlKey.F13":
-				stepType = "PressPF13"
-			case "ControlKey.F14":
-				stepType = "PressPF14"
-			case "ControlKey.F15":
-				stepType = "PressPF15"
-			case "ControlKey.F16":
-				stepType = "PressPF16"
-			case "ControlKey.F17":
-				stepType = "PressPF17"
-			case "ControlKey.F18":
-				stepType = "PressPF18"
-			case "ControlKey.F19":
-				stepType = "PressPF19"
-			case "ControlKey.F20":
-				stepType = "PressPF20"
-			case "ControlKey.F21":
-				stepType = "PressPF21"
-			case "ControlKey.F22":
-				stepType = "PressPF22"
-			case "ControlKey.F23":
-				stepType = "PressPF23"
-			case "ControlKey.F24":
-				stepType = "PressPF24"
-			default:
-				stepType = "FillString"
+	}()
+
+	if headless {
+		fmt.Printf("Recording %s:%d. Connect your emulator to 127.0.0.1:%d and press Ctrl+C when you are done.\n", script.Host, script.Port, port)
+	} else {
+		cmd, err := connect3270.OpenTerminal("127.0.0.1", port)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		// Closing the terminal before it connects would leave nothing to end
+		// the recording.
+		go func() {
+			cmd.Wait()
+			stopRecording()
+		}()
+		fmt.Printf("Recording %s:%d. Close x3270 or press Ctrl+C when you are done.\n", script.Host, script.Port)
+	}
+
+	r := &recorder.Recorder{
+		Host:         script.Host,
+		Port:         script.Port,
+		Rows:         connect3270.ScreenRows,
+		Columns:      connect3270.ScreenColumns,
+		CheckTimeout: recordCheckTimeout,
+		OnAction: func(a macro.Action) {
+			switch a.Kind {
+			case macro.Key:
+				fmt.Printf("  Press%s\n", a.Key)
+			case macro.WaitText:
+				fmt.Printf("  screen %q at row %d, column %d\n", a.Text, a.Row, a.Column)
 			}
-			step := Step{Type: stepType, Text: key}
-			steps = append(steps, step)
-			if connect3270.Verbose {
-				log.Printf("Added step: %s with text: %s", stepType, key)
+		},
+	}
+	recording, err := r.Record(l, stop)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Recording ended with an error: %v\n", err)
+	}
+	for _, w := range recording.Warnings {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", outputPath, w)
+	}
+	if len(recording.Script.Actions) == 0 {
+		fmt.Fprintln(os.Stderr, "Nothing was recorded")
+		return 1
+	}
+
+	config := &Configuration{
+		Host:           script.Host,
+		Port:           script.Port,
+		OutputFilePath: "output.html",
+		Steps:          append(append([]Step{{Type: "Connect"}}, stepsFromActions(recording.Script.Actions)...), Step{Type: "Disconnect"}),
+	}
+	// Text typed into hidden fields is read from the environment rather than
+	// written to the workflow.
+	secretCount := 0
+	for i := range config.Steps {
+		step := &config.Steps[i]
+		if step.Type != "FillString" || !step.Secret {
+			continue
+		}
+		secretCount++
+		step.Text = fmt.Sprintf("${env:RECORDED_SECRET_%d}", secretCount)
+		fmt.Fprintf(os.Stderr, "%s: the hidden field at row %d, column %d reads %s\n", outputPath, step.Coordinates.Row, step.Coordinates.Column, step.Text)
+	}
+	if err := validateConfiguration(config); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: the recorded workflow is not valid: %v\n", outputPath, err)
+	}
+	if err := writeConfiguration(outputPath, config); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", outputPath, err)
+		return 1
+	}
+	screensPath := strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".screens.txt"
+	var screensText strings.Builder
+	for i, screen := range recording.Screens {
+		fmt.Fprintf(&screensText, "--- screen %d ---\n%s", i+1, screen)
+	}
+	if err := ioutil.WriteFile(screensPath, []byte(screensText.String()), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", screensPath, err)
+		return 1
+	}
+	fmt.Printf("Recorded %d steps to %s and %d screens to %s\n", len(config.Steps), outputPath, len(recording.Screens), screensPath)
+	return 0
+}
+
+// exportWorkflow writes the workflow selected by -workflow as a macro, script
+// or program for another tool and returns the process exit code. References
+// to the environment and files are exported unresolved so that no secret is
+// written out.
+func exportWorkflow(filePath, target, outputPath string) int {
+	configs, err := readConfigurations(filePath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	config, err := selectConfiguration(configs, workflowName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filePath, err)
+		return 1
+	}
+	script, labels, warnings, err := scriptFromConfiguration(config)
+	for _, w := range warnings {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filePath, w)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filePath, err)
+		return 1
+	}
+	data, exportWarnings, err := macro.Export(target, script, filepath.Base(filePath))
+	for _, w := range exportWarnings {
+		fmt.Fprintf(os.Stderr, "%s: %s: %s\n", filePath, labels[w.Line], w.Msg)
+	}
+	if list, ok := err.(macro.ErrorList); ok {
+		fmt.Fprintf(os.Stderr, "%s: %d step(s) could not be exported:\n", filePath, len(list))
+		for _, e := range list {
+			fmt.Fprintf(os.Stderr, "  %s: %s\n", labels[e.Line], e.Msg)
+		}
+		return 1
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if outputPath == "" {
+		os.Stdout.Write(data)
+		return 0
+	}
+	if err := ioutil.WriteFile(outputPath, data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing %s: %v\n", outputPath, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%s: exported to %s\n", filePath, outputPath)
+	return 0
+}
+
+// scriptFromConfiguration turns the steps of a workflow into macro actions,
+// running Setup, Steps and Teardown once, then Finally. The Line of each
+// action indexes labels, which describe the step it came from. Steps that
+// only affect timing or reporting are left out and reported in warnings.
+func scriptFromConfiguration(config *Configuration) (*macro.Script, []string, []string, error) {
+	steps := config.Steps
+	section := "Steps"
+	if config.InputFilePath != "" {
+		var err error
+		if steps, err = loadInputFile(config.InputFilePath); err != nil {
+			return nil, nil, nil, err
+		}
+		section = config.InputFilePath
+	}
+	var catalogue *screens.Catalogue
+	if config.ScreenCatalogue != "" {
+		var err error
+		if catalogue, err = loadScreenCatalogue(config.ScreenCatalogue); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	script := &macro.Script{Host: config.Host, Port: config.Port, OutputFile: config.OutputFilePath}
+	labels := []string{"workflow"}
+	var errs validationErrors
+	var warnings []string
+	warn := func(label, format string, args ...interface{}) {
+		warnings = append(warnings, label+": "+fmt.Sprintf(format, args...))
+	}
+	if len(config.OnFailure) > 0 {
+		warn("OnFailure", "OnFailure steps are not exported")
+	}
+	add := func(actions ...macro.Action) {
+		for _, a := range actions {
+			a.Line = len(labels) - 1
+			script.Actions = append(script.Actions, a)
+		}
+	}
+	exportSteps := func(section string, steps []Step) {
+		for i, step := range steps {
+			label := fmt.Sprintf("%s[%d] (%s)", section, i+1, step.Type)
+			labels = append(labels, label)
+			if step.Transaction != "" || step.Retries > 0 || step.ContinueOnError || (step.Timeout > 0 && step.Type != "WaitForInputReady" && step.Type != "WaitForScreen") {
+				warn(label, "Transaction, Retries, Timeout and ContinueOnError are not exported")
 			}
-		} else if strings.HasPrefix(line, "yield wait.forText") {
-			parts := strings.Split(line, ",")
-			if len(parts) >= 2 {
-				text := strings.TrimPrefix(parts[0], "yield wait.forText('")
-				text = strings.TrimSuffix(text, "'")
-				position := strings.TrimPrefix(parts[1], "new Position(")
-				position = strings.TrimSuffix(position, ");")
-				posParts := strings.Split(position, ",")
-				if len(posParts) == 2 {
-					row, errRow := strconv.Atoi(strings.TrimSpace(posParts[0]))
-					column, errCol := strconv.Atoi(strings.TrimSpace(posParts[1]))
-					if errRow != nil || errCol != nil {
-						if connect3270.Verbose {
-							log.Printf("Error parsing position values in line %d: row or column conversion error", idx+1)
+			coordinates := step.Coordinates
+			switch {
+			case step.Type == "Connect", step.Type == "Disconnect", step.Type == "InitializeOutput":
+				// Exported scripts always connect first and disconnect last.
+			case step.Type == "BeginTransaction", step.Type == "EndTransaction":
+				warn(label, "transaction timings are not exported")
+			case step.Type == "FillString":
+				if coordinates.Row > 0 && coordinates.Column > 0 {
+					add(macro.Action{Kind: macro.Cursor, Row: coordinates.Row, Column: coordinates.Column})
+				}
+				add(macro.Action{Kind: macro.Text, Text: step.Text})
+			case step.Type == "MoveCursor":
+				add(macro.Action{Kind: macro.Cursor, Row: coordinates.Row, Column: coordinates.Column})
+			case step.Type == "CheckValue":
+				if coordinates.Length != len(step.Text) {
+					warn(label, "the exported check compares the %d characters of Text rather than Length %d", len(step.Text), coordinates.Length)
+				}
+				timeout := time.Duration(float64(step.Retries) * step.RetryDelay * float64(time.Second))
+				add(macro.Action{Kind: macro.WaitText, Text: step.Text, Row: coordinates.Row, Column: coordinates.Column, Timeout: timeout})
+			case step.Type == "WaitForInputReady":
+				add(macro.Action{Kind: macro.WaitInputReady, Timeout: time.Duration(step.Timeout * float64(time.Second))})
+			case step.Type == "AsciiScreenGrab":
+				add(macro.Action{Kind: macro.Capture})
+			case step.Type == "Think":
+				if step.Think == nil {
+					errs.add("%s: Think is missing", label)
+					continue
+				}
+				pause := step.Think.average()
+				if strings.ToLower(step.Think.Distribution) != "fixed" && step.Think.Distribution != "" {
+					warn(label, "the %s think time is exported as its average of %v", step.Think.Distribution, pause)
+				}
+				add(macro.Action{Kind: macro.Pause, Timeout: pause})
+			case step.Type == "ExpectScreen", step.Type == "WaitForScreen":
+				var screen *screens.Screen
+				if catalogue != nil {
+					for j := range catalogue.Screens {
+						if catalogue.Screens[j].Name == step.Screen {
+							screen = &catalogue.Screens[j]
 						}
-						continue
-					}
-					step := Step{
-						Type: "CheckValue",
-						Coordinates: connect3270.Coordinates{
-							Row:    row,
-							Column: column,
-							Length: len(text),
-						},
-						Text: text,
-					}
-					steps = append(steps, step)
-					if connect3270.Verbose {
-						log.Printf("Added CheckValue step: text '%s' at position (%d,%d), length %d", text, row, column, len(text))
 					}
 				}
-			}
-		} else if strings.HasPrefix(line, "// Fill in the first name at row") || strings.HasPrefix(line, "// Fill in the last name at row") {
-			parts := strings.Split(line, " ")
-			if len(parts) >= 8 {
-				row, errRow := strconv.Atoi(parts[6])
-				column, errCol := strconv.Atoi(parts[9])
-				if errRow != nil || errCol != nil {
-					if connect3270.Verbose {
-						log.Printf("Error parsing coordinates in line %d: row or column conversion error", idx+1)
-					}
+				if screen == nil {
+					errs.add("%s: screen %s is not in the screen catalogue", label, step.Screen)
 					continue
 				}
-				if idx+1 < len(lines) {
-					nextLine := strings.TrimSpace(lines[idx+1])
-					if strings.HasPrefix(nextLine, "yield ps.sendKeys") {
-						key := strings.TrimPrefix(nextLine, "yield ps.sendKeys(")
-						key = strings.TrimSuffix(key, ");")
-						key = strings.Trim(key, "'")
-						step := Step{
-							Type: "FillString",
-							Coordinates: connect3270.Coordinates{
-								Row:    row,
-								Column: column,
-							},
-							Text: key,
-						}
-						steps = append(steps, step)
-						if connect3270.Verbose {
-							log.Printf("Added FillString step: text '%s' at position (%d,%d)", key, row, column)
-						}
+				var timeout time.Duration
+				if step.Type == "WaitForScreen" {
+					timeout = waitForScreenTimeout
+					if step.Timeout > 0 {
+						timeout = time.Duration(step.Timeout * float64(time.Second))
+					}
+				}
+				if len(screen.Fields) > 0 {
+					warn(label, "only the signatures of screen %s are checked, not its fields", screen.Name)
+				}
+				for _, sig := range screen.Signatures {
+					if sig.Row == 0 || sig.Column == 0 {
+						errs.add("%s: signature %q of screen %s has no position and cannot be exported", label, sig.Text, screen.Name)
+						continue
 					}
+					add(macro.Action{Kind: macro.WaitText, Text: sig.Text, Row: sig.Row, Column: sig.Column, Timeout: timeout})
+				}
+			case isAIDStep(step.Type) || step.Type == "PressTab":
+				key, ok := macro.NormalizeKey(strings.TrimPrefix(step.Type, "Press"))
+				if !ok {
+					errs.add("%s: unknown key", label)
+					continue
 				}
+				add(macro.Action{Kind: macro.Key, Key: key})
+			default:
+				errs.add("%s: unknown step type", label)
 			}
 		}
 	}
+	exportSteps("Setup", config.Setup)
+	exportSteps(section, steps)
+	exportSteps("Teardown", config.Teardown)
+	exportSteps("Finally", config.Finally)
+	if len(errs) > 0 {
+		return nil, nil, warnings, errs
+	}
+	return script, labels, warnings, nil
+}
 
-	steps = append(steps, Step{Type: "Disconnect"})
-	if connect3270.Verbose {
-		log.Printf("Added final Disconnect step")
+// writeConfiguration saves a configuration as YAML if path ends in .yaml or
+// .yml, and as JSON otherwise. Fields that are not set are left out.
+func writeConfiguration(path string, config *Configuration) error {
+	var node yaml.Node
+	if err := node.Encode(config); err != nil {
+		return err
 	}
-	if connect3270.Verbose {
-		log.Println("Workflow steps loaded:")
-		for index, step := range steps {
-			log.Printf("Step %d: Type: %s, Text: '%s', Coordinates: {Row: %d, Column: %d, Length: %d}",
-				index, step.Type, step.Text, step.Coordinates.Row, step.Coordinates.Column, step.Coordinates.Length)
+	var buf bytes.Buffer
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		encoder := yaml.NewEncoder(&buf)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(&node); err != nil {
+			return err
 		}
+	default:
+		// Encoding through the YAML node keeps the field order and the
+		// omitempty rules of the yaml tags.
+		writeJSONNode(&buf, &node, "")
+		buf.WriteString("\n")
 	}
-	return steps, nil
+	return ioutil.WriteFile(path, buf.Bytes(), 0644)
 }
 
-func runWorkflow(scriptPort int, config *Configuration) error {
-	startTime := time.Now()
-	atomic.AddInt64(&totalWorkflowsStarted, 1)
-	if connect3270.Verbose {
-		log.Printf("Starting workflow for scriptPort %d", scriptPort)
+// writeJSONNode writes a YAML node tree as indented JSON.
+func writeJSONNode(buf *bytes.Buffer, node *yaml.Node, indent string) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		writeJSONNode(buf, node.Content[0], indent)
+	case yaml.MappingNode:
+		buf.WriteString("{")
+		for i := 0; i < len(node.Content); i += 2 {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			fmt.Fprintf(buf, "\n%s  %s: ", indent, jsonString(node.Content[i].Value))
+			writeJSONNode(buf, node.Content[i+1], indent+"  ")
+		}
+		if len(node.Content) > 0 {
+			buf.WriteString("\n" + indent)
+		}
+		buf.WriteString("}")
+	case yaml.SequenceNode:
+		buf.WriteString("[")
+		for i, item := range node.Content {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n" + indent + "  ")
+			writeJSONNode(buf, item, indent+"  ")
+		}
+		if len(node.Content) > 0 {
+			buf.WriteString("\n" + indent)
+		}
+		buf.WriteString("]")
+	default:
+		switch node.Tag {
+		case "!!int", "!!float", "!!bool":
+			buf.WriteString(node.Value)
+		case "!!null":
+			buf.WriteString("null")
+		default:
+			buf.WriteString(jsonString(node.Value))
+		}
 	}
-	storeLog((fmt.Sprintf("Starting workflow for scriptPort %d", scriptPort)))
-	mutex.Lock()
-	activeWorkflows++
-	mutex.Unlock()
-	e := connect3270.NewEmulator(config.Host, config.Port, strconv.Itoa(scriptPort))
+}
+
+// jsonString quotes s as a JSON string without escaping HTML characters, which
+// are common in key names such as <Enter>.
+func jsonString(s string) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// readConfigurations decodes every workflow defined in filePath. Files ending
+// in .yaml or .yml are read as YAML; anything else is read as JSON, which may
+// contain // and /* */ comments. A file may hold several workflows, either as
+// separate YAML documents or as a list. Unknown fields are rejected and errors
+// report the line they were found on. JSON field names match whatever their
+// case, as they do with encoding/json and in API requests.
+func readConfigurations(filePath string) ([]Configuration, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	ext := strings.ToLower(filepath.Ext(filePath))
+	if ext != ".yaml" && ext != ".yml" {
+		data = normalizeJSON(data)
+		matchJSONKeys(data)
+	}
+	// The node decoder looks ahead at each document to see whether it holds
+	// one workflow or a list, and the strict decoder then decodes it.
+	nodes := yaml.NewDecoder(bytes.NewReader(data))
+	strict := yaml.NewDecoder(bytes.NewReader(data))
+	strict.KnownFields(true)
+	var configs []Configuration
+	for {
+		var node yaml.Node
+		if err := nodes.Decode(&node); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %v", filePath, err)
+		}
+		if len(node.Content) > 0 && node.Content[0].Kind == yaml.SequenceNode {
+			var list []Configuration
+			if err := strict.Decode(&list); err != nil {
+				return nil, fmt.Errorf("%s: %v", filePath, err)
+			}
+			configs = append(configs, list...)
+			continue
+		}
+		var config Configuration
+		if err := strict.Decode(&config); err != nil {
+			return nil, fmt.Errorf("%s: %v", filePath, err)
+		}
+		configs = append(configs, config)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("%s: no workflow defined", filePath)
+	}
+	return configs, nil
+}
+
+// selectConfiguration returns the workflow called name. An empty name selects
+// the only workflow, and is an error if there are several.
+func selectConfiguration(configs []Configuration, name string) (*Configuration, error) {
+	var names []string
+	for i := range configs {
+		if name != "" && configs[i].Name == name {
+			return &configs[i], nil
+		}
+		names = append(names, configs[i].Name)
+	}
+	if name == "" && len(configs) == 1 {
+		return &configs[0], nil
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%d workflows are defined, select one with -workflow: %s", len(configs), strings.Join(names, ", "))
+	}
+	return nil, fmt.Errorf("workflow %q not found, available workflows: %s", name, strings.Join(names, ", "))
+}
+
+// normalizeJSON blanks out // and /* */ comments so that JSON with comments
+// can be parsed, keeping line breaks so that error line numbers still match the
+// file. It also rewrites the JSON-only \/ escape, which YAML does not accept.
+func normalizeJSON(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			if c == '\\' && i+1 < len(data) {
+				if data[i+1] == '/' {
+					out = append(out, '/')
+				} else {
+					out = append(out, c, data[i+1])
+				}
+				i++
+				continue
+			}
+			if c == '"' {
+				inString = false
+			}
+			out = append(out, c)
+		case c == '"':
+			inString = true
+			out = append(out, c)
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				out = append(out, ' ')
+				i++
+			}
+			if i < len(data) {
+				out = append(out, '\n')
+			}
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			out = append(out, ' ', ' ')
+			i += 2
+			for i < len(data) && !(data[i] == '*' && i+1 < len(data) && data[i+1] == '/') {
+				if data[i] == '\n' {
+					out = append(out, '\n')
+				} else {
+					out = append(out, ' ')
+				}
+				i++
+			}
+			if i < len(data) {
+				out = append(out, ' ', ' ')
+				i++
+			}
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// matchJSONKeys rewrites in place the keys in data that only match a field of
+// Configuration when case is ignored, such as "host" for Host, so that the
+// strict decoder accepts them. Documents that cannot be parsed are left for
+// the decoder to report.
+func matchJSONKeys(data []byte) {
+	nodes := yaml.NewDecoder(bytes.NewReader(data))
+	configType := reflect.TypeOf(Configuration{})
+	for {
+		var node yaml.Node
+		if err := nodes.Decode(&node); err != nil {
+			return
+		}
+		for _, n := range node.Content {
+			if n.Kind == yaml.SequenceNode {
+				matchNodeKeys(data, n, reflect.SliceOf(configType))
+			} else {
+				matchNodeKeys(data, n, configType)
+			}
+		}
+	}
+}
+
+// matchNodeKeys rewrites the keys of node, which decodes into t, and of the
+// nodes inside it.
+func matchNodeKeys(data []byte, node *yaml.Node, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for _, n := range node.Content {
+			matchNodeKeys(data, n, t.Elem())
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		// Map keys, such as transaction names, are data and keep their case.
+		for i := 1; i < len(node.Content); i += 2 {
+			matchNodeKeys(data, node.Content[i], t.Elem())
+		}
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+			if f.PkgPath != "" || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			fields[name] = f.Type
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			fieldType, ok := fields[key.Value]
+			for name, typ := range fields {
+				if !ok && len(name) == len(key.Value) && strings.EqualFold(name, key.Value) && renameKey(data, key, name) {
+					fieldType, ok = typ, true
+				}
+			}
+			if ok {
+				matchNodeKeys(data, node.Content[i+1], fieldType)
+			}
+		}
+	}
+}
+
+// renameKey replaces the quoted key at the position of node in data with
+// name, which has the same length, and reports whether it could.
+func renameKey(data []byte, node *yaml.Node, name string) bool {
+	offset := 0
+	for line := 1; line < node.Line; line++ {
+		nl := bytes.IndexByte(data[offset:], '\n')
+		if nl < 0 {
+			return false
+		}
+		offset += nl + 1
+	}
+	// Column counts characters, not bytes.
+	for column := 1; column < node.Column && offset < len(data); column++ {
+		_, size := utf8.DecodeRune(data[offset:])
+		offset += size
+	}
+	end := offset + 1 + len(name)
+	if end >= len(data) || data[offset] != '"' || data[end] != '"' || string(data[offset+1:end]) != node.Value {
+		return false
+	}
+	copy(data[offset+1:end], name)
+	return true
+}
+
+func handleError(err error, message string) {
+	if err != nil {
+		log.Fatalf("%s: %v", message, err)
+	}
+}
+
+func loadInputFile(filePath string) ([]Step, error) {
+	if connect3270.Verbose {
+		log.Printf("Loading input file: %s", filePath)
+	}
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		log.Printf("Error reading input file %s: %v", filePath, err)
+		return nil, fmt.Errorf("error reading input file: %v", err)
+	}
+	if connect3270.Verbose {
+		log.Printf("Successfully read input file: %d bytes", len(data))
+	}
+	actions, err := macro.ParseHOD(filePath, data)
+	if err != nil {
+		return nil, err
+	}
+	steps := []Step{{Type: "Connect"}}
+	steps = append(steps, stepsFromActions(actions)...)
+	steps = append(steps, Step{Type: "Disconnect"})
+	if connect3270.Verbose {
+		log.Println("Workflow steps loaded:")
+		for index, step := range steps {
+			log.Printf("Step %d: Type: %s, Text: '%s', Coordinates: {Row: %d, Column: %d, Length: %d}",
+				index, step.Type, step.Text, step.Coordinates.Row, step.Coordinates.Column, step.Coordinates.Length)
+		}
+	}
+	return steps, nil
+}
+
+// stepsFromActions turns macro actions into workflow steps. A cursor position
+// followed by text becomes a FillString at that position; text without one is
+// typed wherever the cursor is.
+func stepsFromActions(actions []macro.Action) []Step {
+	var steps []Step
+	var cursor *macro.Action
+	flushCursor := func() {
+		if cursor != nil {
+			steps = append(steps, Step{Type: "MoveCursor", Coordinates: connect3270.Coordinates{Row: cursor.Row, Column: cursor.Column}})
+			cursor = nil
+		}
+	}
+	for i := range actions {
+		a := actions[i]
+		switch a.Kind {
+		case macro.Cursor:
+			flushCursor()
+			cursor = &actions[i]
+			continue
+		case macro.Text:
+			step := Step{Type: "FillString", Text: a.Text, Secret: a.Secret}
+			if cursor != nil {
+				step.Coordinates = connect3270.Coordinates{Row: cursor.Row, Column: cursor.Column}
+				cursor = nil
+			} else if a.Row > 0 {
+				step.Coordinates = connect3270.Coordinates{Row: a.Row, Column: a.Column}
+			}
+			steps = append(steps, step)
+			continue
+		}
+		flushCursor()
+		switch a.Kind {
+		case macro.Key:
+			steps = append(steps, Step{Type: "Press" + a.Key})
+		case macro.WaitText:
+			step := Step{
+				Type:        "CheckValue",
+				Coordinates: connect3270.Coordinates{Row: a.Row, Column: a.Column, Length: len(a.Text)},
+				Text:        a.Text,
+			}
+			// Poll once a second for as long as the macro was prepared to wait.
+			if a.Timeout > 0 {
+				step.Retries = int(math.Ceil(a.Timeout.Seconds()))
+				step.RetryDelay = 1
+			}
+			steps = append(steps, step)
+		case macro.WaitInputReady:
+			steps = append(steps, Step{Type: "WaitForInputReady", Timeout: a.Timeout.Seconds()})
+		case macro.Pause:
+			steps = append(steps, Step{Type: "Think", Think: &ThinkTime{Duration: a.Timeout.Seconds()}})
+		case macro.Capture:
+			steps = append(steps, Step{Type: "AsciiScreenGrab"})
+		}
+	}
+	flushCursor()
+	return steps
+}
+
+func runWorkflow(config *Configuration) error {
+	startTime := time.Now()
+	atomic.AddInt64(&totalWorkflowsStarted, 1)
+	e, id := newEmulator(config.Host, config.Port)
+	if connect3270.Verbose {
+		log.Printf("Starting workflow %d", id)
+	}
+	storeLog((fmt.Sprintf("Starting workflow %d", id)))
+	mutex.Lock()
+	activeWorkflows++
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		activeWorkflows--
+		mutex.Unlock()
+	}()
+	trackEmulator(e)
+	defer untrackEmulator(e)
 	tmpFile, err := ioutil.TempFile("", "workflowOutput_")
 	if err != nil {
 		log.Printf("Error creating temporary file: %v", err)
+		finishIteration(id, 1, startTime, err)
 		return err
 	}
 	tmpFileName := tmpFile.Name()
 	tmpFile.Close()
 	e.InitializeOutput(tmpFileName, runAPI)
-	workflowFailed := false
 	var steps []Step
 	if config.InputFilePath != "" {
 		steps, err = loadInputFile(config.InputFilePath)
 		if err != nil {
 			log.Printf("Error loading input file: %v", err)
+			finishIteration(id, 1, startTime, err)
 			return err
 		}
 	} else {
 		steps = config.Steps
 	}
-	for _, step := range steps {
-		if workflowFailed {
-			break
+	session, err := newWorkflowSession(e, tmpFileName, config)
+	if err != nil {
+		log.Printf("Error loading screen catalogue: %v", err)
+		finishIteration(id, 1, startTime, err)
+		return err
+	}
+	session.watch(id, config)
+	defer session.unwatch()
+	session.startTrace("workflow", config, id, 1)
+	workflowErr := session.runSteps("Steps", steps)
+	workflowFailed := workflowErr != nil
+	if workflowFailed {
+		log.Printf("Workflow %d failed at %v", id, workflowErr)
+		storeLog(fmt.Sprintf("Workflow %d failed at %v", id, workflowErr))
+		if se, ok := workflowErr.(*stepError); ok && session.catalogue != nil {
+			recordFailureScreen(se.Screen)
 		}
-		switch step.Type {
-		case "InitializeOutput":
-			err := e.InitializeOutput(tmpFileName, runAPI)
-			if err != nil {
-				return fmt.Errorf("error initializing output file: %v", err)
+		session.watchFailure(workflowErr)
+		session.runHandlerSteps("OnFailure", config.OnFailure)
+	} else {
+		session.setSessionState(sessionClosing)
+	}
+	session.runHandlerSteps("Finally", config.Finally)
+	session.ensureDisconnected()
+	session.endTrace(workflowErr)
+	recordWorkflowDuration(time.Since(startTime))
+	if workflowFailed {
+		finishIteration(id, 1, startTime, workflowErr)
+	} else {
+		if connect3270.Verbose {
+			log.Printf("Workflow %d completed successfully", id)
+			storeLog(fmt.Sprintf("Workflow %d completed successfully", id))
+		}
+		if err := saveOutput(tmpFileName, config); err != nil {
+			finishIteration(id, 1, startTime, err)
+			return err
+		}
+		finishIteration(id, 1, startTime, nil)
+	}
+	return nil
+}
+
+// saveOutput moves the output of a successful workflow to OutputFilePath, or
+// to a name unique to this process if that fails.
+func saveOutput(tmpFileName string, config *Configuration) error {
+	if config.OutputFilePath == "" {
+		return nil
+	}
+	_ = os.Remove(config.OutputFilePath)
+	if err := os.Rename(tmpFileName, config.OutputFilePath); err != nil {
+		pid := os.Getpid()
+		uniqueOutputPath := fmt.Sprintf("%s.%d", config.OutputFilePath, pid)
+		if err2 := os.Rename(tmpFileName, uniqueOutputPath); err2 != nil {
+			log.Printf("Error renaming temporary file to unique output file: %v", err2)
+		} else if verbose {
+			log.Printf("Renamed temporary file to unique output file: %s", uniqueOutputPath)
+		}
+		return err
+	}
+	return nil
+}
+
+// stepError records which step of a workflow failed, why, and on which
+// catalogued screen if it could be identified.
+type stepError struct {
+	List   string
+	Index  int
+	Step   Step
+	Err    error
+	Screen string
+}
+
+func (se *stepError) Error() string {
+	if se.Screen != "" {
+		return fmt.Sprintf("step %d (%s) on screen %s: %v", se.Index+1, se.Step.Type, se.Screen, se.Err)
+	}
+	return fmt.Sprintf("step %d (%s): %v", se.Index+1, se.Step.Type, se.Err)
+}
+
+func (se *stepError) Unwrap() error {
+	return se.Err
+}
+
+// workflowSession tracks the emulator state of a single workflow run so that
+// failure handlers and the final teardown know whether a disconnect is needed.
+type workflowSession struct {
+	emulator     *connect3270.Emulator
+	outputFile   string
+	connected    bool
+	lost         bool                 // A step timed out and its emulator was terminated, ending the host session
+	transactions map[string]time.Time // Start times of open transactions
+	catalogue    *screens.Catalogue   // Nil if the workflow has no screen catalogue
+
+	spanMutex sync.Mutex
+	span      *tracing.Span       // Trace of the running iteration, nil if not traced
+	stepSpan  *tracing.Span       // Span of the running step, nil if not traced
+	script    []tracing.Attribute // Where the emulator took script commands once connected
+
+	live *liveSession // The session as the dashboard lists it, nil if it is not listed
+}
+
+func newWorkflowSession(e *connect3270.Emulator, outputFile string, config *Configuration) (*workflowSession, error) {
+	s := &workflowSession{emulator: e, outputFile: outputFile}
+	if tracer != nil {
+		e.CommandHook = s.traceCommand
+	}
+	if config.ScreenCatalogue != "" {
+		catalogue, err := loadScreenCatalogue(config.ScreenCatalogue)
+		if err != nil {
+			return nil, err
+		}
+		s.catalogue = catalogue
+	}
+	return s, nil
+}
+
+var (
+	screenCatalogues      = map[string]*screens.Catalogue{}
+	screenCataloguesMutex sync.Mutex
+)
+
+// loadScreenCatalogue loads a screen catalogue once and caches it for every
+// later workflow that uses the same file.
+func loadScreenCatalogue(path string) (*screens.Catalogue, error) {
+	screenCataloguesMutex.Lock()
+	defer screenCataloguesMutex.Unlock()
+	if c, ok := screenCatalogues[path]; ok {
+		return c, nil
+	}
+	c, err := screens.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	screenCatalogues[path] = c
+	return c, nil
+}
+
+// identifyScreen returns the catalogue name of the current screen, or "" if
+// there is no catalogue or the screen is not in it.
+func (s *workflowSession) identifyScreen() string {
+	if s.catalogue == nil || !s.connected {
+		return ""
+	}
+	name, err := s.catalogue.IdentifyCurrent(s.emulator)
+	if err != nil {
+		if connect3270.Verbose {
+			log.Printf("Error identifying screen: %v", err)
+		}
+		return ""
+	}
+	return name
+}
+
+// waitForScreenTimeout is how long WaitForScreen waits when the step has no
+// Timeout of its own.
+const waitForScreenTimeout = 30 * time.Second
+
+// inputReadyTimeout is how long WaitForInputReady waits when the step has no
+// Timeout of its own.
+const inputReadyTimeout = 30 * time.Second
+
+// expectScreen checks that the current screen is step.Screen. WaitForScreen
+// steps poll until the screen appears or the step times out.
+func (s *workflowSession) expectScreen(step Step) error {
+	if s.catalogue == nil {
+		return fmt.Errorf("no ScreenCatalogue is configured")
+	}
+	deadline := time.Now().Add(waitForScreenTimeout)
+	if step.Timeout > 0 {
+		deadline = time.Now().Add(time.Duration(step.Timeout * float64(time.Second)))
+	}
+	for {
+		name, err := s.catalogue.IdentifyCurrent(s.emulator)
+		if err != nil {
+			return err
+		}
+		if name == step.Screen {
+			return nil
+		}
+		if step.Type == "ExpectScreen" || time.Now().After(deadline) {
+			if name == "" {
+				name = "an unknown screen"
 			}
-		case "Connect":
-			if err := e.Connect(); err != nil {
-				log.Printf("Error connecting to terminal: %v", err)
-				workflowFailed = true
+			return fmt.Errorf("expected screen %s but found %s", step.Screen, name)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// runSteps executes steps in order, honouring each step's retry and
+// ContinueOnError settings. It returns a *stepError for the first step that
+// failed without ContinueOnError.
+func (s *workflowSession) runSteps(list string, steps []Step) error {
+	for i, step := range steps {
+		if aborting() {
+			return &stepError{List: list, Index: i, Step: step, Err: errRunAborted}
+		}
+		if err := s.runStep(list, i, step); err != nil {
+			if step.ContinueOnError {
+				log.Printf("Step %d (%s) failed, continuing: %v", i+1, step.Type, err)
+				storeLog(fmt.Sprintf("Step %d (%s) failed, continuing: %v", i+1, step.Type, err))
+				continue
 			}
-			e.WaitForField(30)
-		case "CheckValue":
-			v, err := e.GetValue(step.Coordinates.Row, step.Coordinates.Column, step.Coordinates.Length)
-			if err != nil {
-				log.Printf("Error getting value: %v", err)
-				workflowFailed = true
+			return &stepError{List: list, Index: i, Step: step, Err: err, Screen: s.identifyScreen()}
+		}
+	}
+	return nil
+}
+
+// runHandlerSteps executes OnFailure or Finally steps. Every step is attempted
+// even if an earlier one fails, since these are used to release host sessions.
+func (s *workflowSession) runHandlerSteps(label string, steps []Step) {
+	if aborting() {
+		// The emulator has been terminated, which also ended the host session.
+		return
+	}
+	for i, step := range steps {
+		if err := s.runStep(label, i, step); errors.Is(err, errSessionLost) {
+			log.Printf("%s step %d (%s) skipped: %v", label, i+1, step.Type, err)
+			storeLog(fmt.Sprintf("%s step %d (%s) skipped: %v", label, i+1, step.Type, err))
+		} else if err != nil {
+			log.Printf("%s step %d (%s) failed: %v", label, i+1, step.Type, err)
+			storeLog(fmt.Sprintf("%s step %d (%s) failed: %v", label, i+1, step.Type, err))
+		}
+	}
+}
+
+// ensureDisconnected closes the emulator if the workflow connected and no step
+// has disconnected it yet.
+func (s *workflowSession) ensureDisconnected() {
+	if !s.connected || aborting() {
+		return
+	}
+	if err := s.emulator.Disconnect(); err != nil {
+		log.Printf("Error disconnecting: %v", err)
+	}
+	s.connected = false
+}
+
+// runStep executes the step at index in list, retrying it up to step.Retries
+// times with step.RetryDelay seconds between attempts, and records the result.
+func (s *workflowSession) runStep(list string, index int, step Step) error {
+	started := time.Now()
+	s.watchStep(list, index, step)
+	s.startStepSpan(list, index, step)
+	attempts := step.Retries + 1
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = s.runStepOnce(step)
+		if err == nil {
+			recordStep(list, index, step, time.Since(started), attempt, nil)
+			s.endStepSpan(step, attempt, nil)
+			return nil
+		}
+		if attempt < attempts {
+			if s.lost && needsSession(step.Type) {
+				// The step timed out and took the host session with it, so
+				// another attempt cannot succeed.
+				attempts = attempt
 				break
 			}
-			v = strings.TrimSpace(v)
 			if connect3270.Verbose {
-				log.Println("Retrieved value: " + v)
+				log.Printf("Step %s failed (attempt %d/%d): %v", step.Type, attempt, attempts, err)
 			}
-			if v != step.Text {
-				log.Printf("CheckValue failed. Expected: %s, Found: %s", step.Text, v)
-				workflowFailed = true
-			}
-		case "FillString":
-			if err := e.FillString(step.Coordinates.Row, step.Coordinates.Column, step.Text); err != nil {
-				log.Printf("Error setting text: %v", err)
-				workflowFailed = true
-			}
-		case "AsciiScreenGrab":
-			if err := e.AsciiScreenGrab(tmpFileName, runAPI); err != nil {
-				log.Printf("Error in AsciiScreenGrab: %v", err)
-				workflowFailed = true
-			}
-		case "PressEnter":
-			if err := e.Press(connect3270.Enter); err != nil {
-				log.Printf("Error pressing Enter: %v", err)
-				workflowFailed = true
-			}
-		case "PressTab":
-			if err := e.Press(connect3270.Tab); err != nil {
-				log.Printf("Error pressing Tab: %v", err)
-				workflowFailed = true
-			}
-		case "Disconnect":
-			if err := e.Disconnect(); err != nil {
-				log.Printf("Error disconnecting: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF1":
-			if err := e.Press(connect3270.F1); err != nil {
-				log.Printf("Error pressing PF1: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF2":
-			if err := e.Press(connect3270.F2); err != nil {
-				log.Printf("Error pressing PF2: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF3":
-			if err := e.Press(connect3270.F3); err != nil {
-				log.Printf("Error pressing PF3: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF4":
-			if err := e.Press(connect3270.F4); err != nil {
-				log.Printf("Error pressing PF4: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF5":
-			if err := e.Press(connect3270.F5); err != nil {
-				log.Printf("Error pressing PF5: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF6":
-			if err := e.Press(connect3270.F6); err != nil {
-				log.Printf("Error pressing PF6: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF7":
-			if err := e.Press(connect3270.F7); err != nil {
-				log.Printf("Error pressing PF7: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF8":
-			if err := e.Press(connect3270.F8); err != nil {
-				log.Printf("Error pressing PF8: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF9":
-			if err := e.Press(connect3270.F9); err != nil {
-				log.Printf("Error pressing PF9: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF10":
-			if err := e.Press(connect3270.F10); err != nil {
-				log.Printf("Error pressing PF10: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF11":
-			if err := e.Press(connect3270.F11); err != nil {
-				log.Printf("Error pressing PF11: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF12":
-			if err := e.Press(connect3270.F12); err != nil {
-				log.Printf("Error pressing PF12: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF13":
-			if err := e.Press(connect3270.F13); err != nil {
-				log.Printf("Error pressing PF13: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF14":
-			if err := e.Press(connect3270.F14); err != nil {
-				log.Printf("Error pressing PF14: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF15":
-			if err := e.Press(connect3270.F15); err != nil {
-				log.Printf("Error pressing PF15: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF16":
-			if err := e.Press(connect3270.F16); err != nil {
-				log.Printf("Error pressing PF16: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF17":
-			if err := e.Press(connect3270.F17); err != nil {
-				log.Printf("Error pressing PF17: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF18":
-			if err := e.Press(connect3270.F18); err != nil {
-				log.Printf("Error pressing PF18: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF19":
-			if err := e.Press(connect3270.F19); err != nil {
-				log.Printf("Error pressing PF19: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF20":
-			if err := e.Press(connect3270.F20); err != nil {
-				log.Printf("Error pressing PF20: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF21":
-			if err := e.Press(connect3270.F21); err != nil {
-				log.Printf("Error pressing PF21: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF22":
-			if err := e.Press(connect3270.F22); err != nil {
-				log.Printf("Error pressing PF22: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF23":
-			if err := e.Press(connect3270.F23); err != nil {
-				log.Printf("Error pressing PF23: %v", err)
-				workflowFailed = true
-			}
-		case "PressPF24":
-			if err := e.Press(connect3270.F24); err != nil {
-				log.Printf("Error pressing PF24: %v", err)
-				workflowFailed = true
-			}
-		default:
-			log.Printf("Unknown step type: %s", step.Type)
+			time.Sleep(time.Duration(step.RetryDelay * float64(time.Second)))
 		}
 	}
-	mutex.Lock()
-	activeWorkflows--
-	mutex.Unlock()
-	duration := time.Since(startTime).Seconds()
-	timingsMutex.Lock()
-	workflowDurations = append(workflowDurations, duration)
-	timingsMutex.Unlock()
-	if workflowFailed {
-		log.Printf("Workflow for scriptPort %d failed", scriptPort)
-		storeLog(fmt.Sprintf("Workflow for scriptPort %d failed", scriptPort))
-		atomic.AddInt64(&totalWorkflowsFailed, 1)
+	recordStep(list, index, step, time.Since(started), attempts, err)
+	s.endStepSpan(step, attempts, err)
+	return err
+}
+
+// runStepOnce executes a step, enforcing step.Timeout if one is set.
+func (s *workflowSession) runStepOnce(step Step) error {
+	if s.lost && needsSession(step.Type) {
+		return errSessionLost
+	}
+	switch step.Type {
+	case "Connect":
+		s.connected = true
+		s.lost = false
+	case "BeginTransaction":
+		if s.transactions == nil {
+			s.transactions = map[string]time.Time{}
+		}
+		s.transactions[step.Transaction] = time.Now()
+		return nil
+	case "EndTransaction":
+		started, ok := s.transactions[step.Transaction]
+		if !ok {
+			return fmt.Errorf("transaction %s was not started", step.Transaction)
+		}
+		delete(s.transactions, step.Transaction)
+		recordTransaction(step.Transaction, time.Since(started))
+		return nil
+	}
+	var err error
+	if step.Timeout <= 0 || step.Type == "WaitForInputReady" || step.Type == "WaitForScreen" {
+		// Wait steps give up after Timeout themselves.
+		err = s.executeTimedStep(step)
 	} else {
-		if connect3270.Verbose {
-			log.Printf("Workflow for scriptPort %d completed successfully", scriptPort)
-			storeLog(fmt.Sprintf("Workflow for scriptPort %d completed successfully", scriptPort))
-		}
-		if config.OutputFilePath != "" {
-			_ = os.Remove(config.OutputFilePath)
-			if err := os.Rename(tmpFileName, config.OutputFilePath); err != nil {
-				pid := os.Getpid()
-				uniqueOutputPath := fmt.Sprintf("%s.%d", config.OutputFilePath, pid)
-				if err2 := os.Rename(tmpFileName, uniqueOutputPath); err2 != nil {
-					log.Printf("Error renaming temporary file to unique output file: %v", err2)
-				} else if verbose {
-					log.Printf("Renamed temporary file to unique output file: %s", uniqueOutputPath)
-				}
-				return err
+		timeout := time.Duration(step.Timeout * float64(time.Second))
+		done := make(chan error, 1)
+		go func() {
+			done <- s.executeTimedStep(step)
+		}()
+		select {
+		case err = <-done:
+		case <-time.After(timeout):
+			// The step's command is still running. Terminate the emulator
+			// so that it returns, rather than leave it running alongside
+			// the retry or the failure handlers; the host session goes
+			// with it.
+			if err := s.emulator.Terminate(); err != nil {
+				log.Printf("Error terminating emulator on %s: %v", s.emulator.Where(), err)
 			}
+			<-done
+			s.connected = false
+			s.lost = true
+			reviveEmulator(s.emulator)
+			err = fmt.Errorf("timed out after %v", timeout)
 		}
-		atomic.AddInt64(&totalWorkflowsCompleted, 1)
 	}
+	if step.Type == "Disconnect" && err == nil {
+		s.connected = false
+	}
+	return err
+}
+
+// errSessionLost is returned for steps that need the host session once a
+// timeout has ended it, until a Connect step starts a new one.
+var errSessionLost = errors.New("the session ended when a step timed out")
+
+// needsSession reports whether steps of stepType act on the host session.
+func needsSession(stepType string) bool {
+	switch stepType {
+	case "Connect", "Think", "BeginTransaction", "EndTransaction", "InitializeOutput":
+		return false
+	}
+	return true
+}
+
+// executeTimedStep executes a step and, for key presses that name a
+// Transaction, records the time from the key press until the keyboard unlocks.
+func (s *workflowSession) executeTimedStep(step Step) error {
+	if step.Type == "ExpectScreen" || step.Type == "WaitForScreen" {
+		return s.expectScreen(step)
+	}
+	if step.Transaction == "" || !isAIDStep(step.Type) {
+		return executeStep(s.emulator, step, s.outputFile)
+	}
+	started := time.Now()
+	if err := executeStep(s.emulator, step, s.outputFile); err != nil {
+		return err
+	}
+	if err := s.emulator.WaitForUnlock(transactionUnlockTimeout); err != nil {
+		return err
+	}
+	recordTransaction(step.Transaction, time.Since(started))
 	return nil
 }
 
+// transactionUnlockTimeout bounds how long a timed key press waits for the
+// host to unlock the keyboard.
+const transactionUnlockTimeout = 60 * time.Second
+
+// isAIDStep reports whether stepType sends an attention key to the host.
+func isAIDStep(stepType string) bool {
+	return stepType == "PressEnter" || stepType == "PressClear" || isPFKeyStep(stepType)
+}
+
 func runAPIWorkflow() {
 	if connect3270.Verbose {
 		log.Println("Starting API server mode")
@@ -627,6 +1840,14 @@ func runAPIWorkflow() {
 			sendErrorResponse(c, http.StatusBadRequest, "Invalid request payload", err)
 			return
 		}
+		// The request's secrets are only masked while it runs, so that they
+		// do not pile up in the server.
+		var scope secrets.Scope
+		defer scope.Release()
+		if err := resolveConfiguration(&workflowConfig, &scope); err != nil {
+			sendErrorResponse(c, http.StatusBadRequest, "Failed to resolve configuration", err)
+			return
+		}
 		tmpFile, err := ioutil.TempFile("", "workflowOutput_")
 		if err != nil {
 			log.Printf("Error creating temporary file: %v", err)
@@ -635,38 +1856,79 @@ func runAPIWorkflow() {
 		}
 		defer tmpFile.Close()
 		tmpFileName := tmpFile.Name()
-		scriptPort := getNextAvailablePort()
-		e := connect3270.NewEmulator(workflowConfig.Host, workflowConfig.Port, strconv.Itoa(scriptPort))
+		// The output is written to the temporary file and returned in the
+		// response rather than to OutputFilePath.
+		workflowConfig.OutputFilePath = tmpFileName
+		if err := validateConfiguration(&workflowConfig); err != nil {
+			sendErrorResponse(c, http.StatusBadRequest, "Invalid configuration", err)
+			return
+		}
+		e, id := newEmulator(workflowConfig.Host, workflowConfig.Port)
+		trackEmulator(e)
+		defer untrackEmulator(e)
 		err = e.InitializeOutput(tmpFileName, true)
 		if err != nil {
 			sendErrorResponse(c, http.StatusInternalServerError, "Failed to initialize output file", err)
 			return
 		}
-		for _, step := range workflowConfig.Steps {
-			if err := executeStep(e, step, tmpFileName); err != nil {
-				sendErrorResponse(c, http.StatusInternalServerError, fmt.Sprintf("Workflow step '%s' failed", step.Type), err)
-				e.Disconnect()
-				return
+		session, err := newWorkflowSession(e, tmpFileName, &workflowConfig)
+		if err != nil {
+			sendErrorResponse(c, http.StatusBadRequest, "Failed to load screen catalogue", err)
+			return
+		}
+		session.startTrace("workflow", &workflowConfig, id, 1)
+		if err := session.runSteps("Steps", workflowConfig.Steps); err != nil {
+			session.runHandlerSteps("OnFailure", workflowConfig.OnFailure)
+			session.runHandlerSteps("Finally", workflowConfig.Finally)
+			session.ensureDisconnected()
+			session.endTrace(err)
+			message := "Workflow failed"
+			if se, ok := err.(*stepError); ok {
+				message = fmt.Sprintf("Workflow step '%s' failed", se.Step.Type)
 			}
+			sendErrorResponse(c, http.StatusInternalServerError, message, err)
+			return
 		}
+		session.runHandlerSteps("Finally", workflowConfig.Finally)
 		outputContents, err := e.ReadOutputFile(tmpFileName)
 		if err != nil {
+			session.endTrace(err)
 			sendErrorResponse(c, http.StatusInternalServerError, "Failed to read output file", err)
 			return
 		}
 		e.Disconnect()
+		session.endTrace(nil)
 		c.JSON(http.StatusOK, gin.H{
 			"returnCode": http.StatusOK,
 			"status":     "okay",
 			"message":    "Workflow executed successfully",
-			"output":     outputContents,
+			"output":     secrets.Redact(outputContents),
 		})
 	})
+	r.GET("/metrics", gin.WrapF(metricsHandler(currentMetrics)))
 	apiAddr := fmt.Sprintf(":%d", apiPort)
 	log.Printf("API server is running on %s", apiAddr)
-	if err := r.Run(apiAddr); err != nil {
+	server := &http.Server{Addr: apiAddr, Handler: r}
+	// Stop taking requests on a signal and give the running ones until the
+	// grace period ends, when their emulators are terminated.
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-stopRun
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-abortRun
+			cancel()
+		}()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("API server stopped with requests still running: %v", err)
+		}
+	}()
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Failed to start API server: %v", err)
 	}
+	<-shutdownDone
 }
 
 func executeStep(e *connect3270.Emulator, step Step, tmpFileName string) error {
@@ -674,21 +1936,55 @@ func executeStep(e *connect3270.Emulator, step Step, tmpFileName string) error {
 	case "InitializeOutput":
 		return e.InitializeOutput(tmpFileName, runAPI)
 	case "Connect":
-		return e.Connect()
+		if err := e.Connect(); err != nil {
+			return err
+		}
+		e.WaitForField(30)
+		return nil
 	case "CheckValue":
-		_, err := e.GetValue(step.Coordinates.Row, step.Coordinates.Column, step.Coordinates.Length)
-		return err
+		v, err := e.GetValue(step.Coordinates.Row, step.Coordinates.Column, step.Coordinates.Length)
+		if err != nil {
+			return err
+		}
+		v = strings.TrimSpace(v)
+		if connect3270.Verbose {
+			log.Println("Retrieved value: " + v)
+		}
+		if v != step.Text {
+			return fmt.Errorf("CheckValue failed. Expected: %s, Found: %s", step.Text, v)
+		}
+		return nil
 	case "FillString":
 		if step.Coordinates.Row == 0 && step.Coordinates.Column == 0 {
 			return e.SetString(step.Text)
 		}
 		return e.FillString(step.Coordinates.Row, step.Coordinates.Column, step.Text)
+	case "MoveCursor":
+		return e.MoveCursor(step.Coordinates.Row, step.Coordinates.Column)
+	case "WaitForInputReady":
+		timeout := inputReadyTimeout
+		if step.Timeout > 0 {
+			timeout = time.Duration(step.Timeout * float64(time.Second))
+		}
+		return e.WaitForField(timeout)
 	case "AsciiScreenGrab":
 		return e.AsciiScreenGrab(tmpFileName, runAPI)
 	case "PressEnter":
 		return e.Press(connect3270.Enter)
 	case "PressTab":
 		return e.Press(connect3270.Tab)
+	case "PressClear":
+		return e.Press(connect3270.Clear)
+	case "Think":
+		if step.Think == nil {
+			return fmt.Errorf("Think is missing")
+		}
+		pause := step.Think.Sample()
+		if connect3270.Verbose {
+			log.Printf("Thinking for %v", pause)
+		}
+		time.Sleep(pause)
+		return nil
 	case "Disconnect":
 		return e.Disconnect()
 	case "PressPF1":
@@ -752,7 +2048,7 @@ func sendErrorResponse(c *gin.Context, statusCode int, message string, err error
 		"returnCode": statusCode,
 		"status":     "error",
 		"message":    message,
-		"error":      err.Error(),
+		"error":      secrets.Redact(err.Error()),
 	})
 }
 
@@ -770,17 +2066,48 @@ Version: ` + version)
 
 func main() {
 	flag.Parse()
+	if printSchema {
+		printSchemaAndExit()
+	}
+	if exportFormat != "" {
+		os.Exit(exportWorkflow(configFile, exportFormat, exportOutput))
+	}
 	printBanner()
-	mutex.Lock()
-	lastUsedPort = startPort
-	mutex.Unlock()
 	if *showVersion {
 		printVersionAndExit()
 	}
 	if showHelp {
 		printHelpAndExit()
 	}
+	if validateOnly {
+		os.Exit(validateConfigurationFile(configFile))
+	}
+	if convertFile != "" {
+		os.Exit(convertMacroFile(convertFile, convertFormat, convertOutput))
+	}
+	if recordOutput != "" {
+		setGlobalSettings()
+		os.Exit(recordWorkflow(recordHost, recordOutput))
+	}
 	setGlobalSettings()
+	if err := startTracing(); err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	if agentMode || agentList != "" {
+		if err := resolveAgentToken(); err != nil {
+			log.Errorf("-agentToken: %v", err)
+			os.Exit(1)
+		}
+		handleSignals()
+		go monitorSystemUsage()
+		if agentMode {
+			code := runAgent()
+			stopTracing()
+			os.Exit(code)
+		}
+		os.Exit(runController(configFile))
+	}
 	if concurrent > 1 || runtimeDuration > 0 {
 		go runDashboard()
 	}
@@ -797,20 +2124,140 @@ func main() {
 			log.Fatalf("Invalid runApp value: %s. Please enter a valid app number.", runApp)
 		}
 	}
-	config := loadConfiguration(configFile)
+	config, err := loadConfiguration(configFile)
+	if err != nil {
+		log.Errorf("%v", err)
+		os.Exit(1)
+	}
+	handleSignals()
 	if runAPI {
 		runAPIWorkflow()
+		stopTracing()
+		os.Exit(exitCode())
 	} else {
-		if concurrent > 1 {
+		concurrentMode := concurrent > 1 || config.ArrivalRate > 0 || len(config.Stages) > 0 || iterationMode(config)
+		if config.KeepSession && config.Iterations == 0 && config.IterationsPerVU == 0 && runtimeDuration <= 0 {
+			log.Errorf("KeepSession needs Iterations, IterationsPerVU or -runtime to say when the sessions end")
+			os.Exit(1)
+		}
+		if config.ArrivalRate > 0 && runtimeDuration <= 0 {
+			log.Errorf("ArrivalRate needs -runtime to say how long to keep starting iterations")
+			os.Exit(1)
+		}
+		if len(config.Stages) > 0 && runtimeDuration > 0 {
+			log.Printf("Stages set the length of the run, so -runtime is ignored")
+		}
+		if concurrentMode && !(concurrent > 1 || runtimeDuration > 0) {
+			go runDashboard()
+		}
+		if err := openResults(); err != nil {
+			log.Errorf("-results: %v", err)
+			os.Exit(1)
+		}
+		if config.Thresholds != nil && config.Thresholds.AbortOnBreach {
+			go watchThresholds(config.Thresholds, currentMetrics)
+		}
+		if concurrentMode {
 			runConcurrentWorkflows(config)
+			updateMetricsFile()
+			logFailureBreakdown(currentMetrics())
 		} else {
-			runWorkflow(7000, config)
+			runWorkflow(config)
 		}
-		if concurrent > 1 && dashboardStarted {
+		var checks []thresholdCheck
+		if config.Thresholds != nil {
+			checks = checkThresholds(config.Thresholds, currentMetrics())
+		}
+		code := exitCode()
+		writeResults(config, currentMetrics(), checks, code)
+		stopTracing()
+		finishRun(code)
+		if stopping() {
+			os.Exit(code)
+		}
+		if concurrentMode && dashboardStarted {
 			log.Printf("All workflows completed but the dashboard is still running on port %d. Press Ctrl+C to exit.", dashboardPort)
 			storeLog(fmt.Sprintf("All workflows completed but the dashboard is still running on port %d. Press Ctrl+C to exit.", dashboardPort))
-			select {}
+			<-stopRun
+		}
+		os.Exit(code)
+	}
+}
+
+func printSchemaAndExit() {
+	data, err := json.MarshalIndent(configurationSchema(), "", "  ")
+	if err != nil {
+		log.Fatalf("Error generating schema: %v", err)
+	}
+	fmt.Println(string(data))
+	os.Exit(0)
+}
+
+// configurationSchema builds a JSON Schema for Configuration from its Go
+// definition so that editors can validate and auto-complete workflow files.
+func configurationSchema() map[string]interface{} {
+	schema := schemaForType(reflect.TypeOf(Configuration{}))
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["$id"] = "https://3270.io/workflow.schema.json"
+	schema["title"] = "3270Connect workflow"
+	schema["required"] = []string{"Host", "Port", "OutputFilePath"}
+
+	properties := schema["properties"].(map[string]interface{})
+	step := properties["Steps"].(map[string]interface{})["items"].(map[string]interface{})
+	step["required"] = []string{"Type"}
+	stepProperties := step["properties"].(map[string]interface{})
+	stepProperties["Type"].(map[string]interface{})["enum"] = stepTypes
+	coordinates := stepProperties["Coordinates"].(map[string]interface{})["properties"].(map[string]interface{})
+	coordinates["Row"].(map[string]interface{})["minimum"] = 1
+	coordinates["Row"].(map[string]interface{})["maximum"] = connect3270.ScreenRows
+	coordinates["Column"].(map[string]interface{})["minimum"] = 1
+	coordinates["Column"].(map[string]interface{})["maximum"] = connect3270.ScreenColumns
+	coordinates["Length"].(map[string]interface{})["minimum"] = 0
+	think := stepProperties["Think"].(map[string]interface{})["properties"].(map[string]interface{})
+	think["Distribution"].(map[string]interface{})["enum"] = []string{"fixed", "uniform", "normal", "exponential"}
+	properties["ArrivalRateUnit"].(map[string]interface{})["enum"] = []string{"second", "minute"}
+	stage := properties["Stages"].(map[string]interface{})["items"].(map[string]interface{})["properties"].(map[string]interface{})
+	stage["Interpolation"].(map[string]interface{})["enum"] = []string{"linear", "step"}
+
+	// OnFailure, Finally, Setup and Teardown hold the same kind of steps as Steps.
+	properties["OnFailure"] = properties["Steps"]
+	properties["Finally"] = properties["Steps"]
+	properties["Setup"] = properties["Steps"]
+	properties["Teardown"] = properties["Steps"]
+	return schema
+}
+
+// schemaForType returns the JSON Schema for a Go type, using the same field
+// names as the configuration decoder.
+func schemaForType(t reflect.Type) map[string]interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return schemaForType(t.Elem())
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number", "minimum": 0}
+	case reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": schemaForType(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaForType(t.Elem())}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "" {
+				name = field.Name
+			}
+			properties[name] = schemaForType(field.Type)
 		}
+		return map[string]interface{}{"type": "object", "properties": properties, "additionalProperties": false}
+	default:
+		return map[string]interface{}{}
 	}
 }
 
@@ -828,17 +2275,212 @@ func printHelpAndExit() {
 func setGlobalSettings() {
 	connect3270.Headless = headless
 	connect3270.Verbose = verbose
+	connect3270.Redact = secrets.Redact
+	if err := connect3270.CheckTransport(scriptTransport); err != nil {
+		log.Fatalf("-scriptTransport: %v", err)
+	}
+	connect3270.Transport = scriptTransport
+	if endPort == 0 {
+		endPort = min(startPort+9999, 65535)
+	}
+	if startPort < 1 || endPort > 65535 || endPort < startPort {
+		log.Fatalf("-startPort %d to -endPort %d is not a range of ports", startPort, endPort)
+	}
+	scriptPorts = connect3270.NewPortAllocator(startPort, endPort)
+}
+
+// scriptPorts leases script ports from -startPort to -endPort to emulators.
+var scriptPorts *connect3270.PortAllocator
+
+// workflowCount numbers workflows for logging.
+var workflowCount int64
+
+// newEmulator returns an emulator for host and port that is leased a script
+// port when it starts, and the number that identifies its workflow in logs.
+func newEmulator(host string, port int) (*connect3270.Emulator, int64) {
+	e := connect3270.NewEmulator(host, port, "")
+	e.Ports = scriptPorts
+	return e, atomic.AddInt64(&workflowCount, 1)
+}
+
+// A run stops on the first SIGINT or SIGTERM, or when AbortOnBreach finds a
+// broken threshold: no new iterations start and the running ones have
+// -shutdownGrace seconds to finish. After that, or on a signal, the run is
+// aborted: every emulator still running is terminated and its workflow
+// fails.
+var (
+	stopRun        = make(chan struct{})
+	stopRunOnce    sync.Once
+	abortRun       = make(chan struct{})
+	abortRunOnce   sync.Once
+	stopSignal     os.Signal // Signal that stopped the run, if one did, set before stopRun is closed
+	emulators      = map[*connect3270.Emulator]bool{}
+	emulatorsMutex sync.Mutex
+)
+
+// forceExitDelay is how long an aborted run has to finish before the
+// process exits without waiting for it.
+const forceExitDelay = 10 * time.Second
+
+var errRunAborted = errors.New("the run was aborted")
+
+// handleSignals stops the run on SIGINT or SIGTERM and aborts it on a
+// second signal.
+func handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			switch {
+			case !stopping():
+				requestStop(fmt.Sprintf("Received %v", sig), sig)
+			case !aborting():
+				abortWorkflows()
+			default:
+				forceExit()
+			}
+		}
+	}()
+}
+
+// requestStop stops new workflows from starting and aborts the running ones
+// if they have not finished after the grace period. sig is the signal that
+// asked for it, if any.
+func requestStop(reason string, sig os.Signal) {
+	stopRunOnce.Do(func() {
+		stopSignal = sig
+		close(stopRun)
+		msg := fmt.Sprintf("%s: no new workflows will start. Waiting up to %ds for %d running workflows to finish; press Ctrl+C to stop them now.",
+			reason, shutdownGrace, getActiveWorkflows())
+		log.Print(msg)
+		storeLog(msg)
+		go func() {
+			select {
+			case <-abortRun:
+			case <-time.After(time.Duration(shutdownGrace) * time.Second):
+				abortWorkflows()
+			}
+			time.Sleep(forceExitDelay)
+			forceExit()
+		}()
+	})
+}
+
+// forceExit ends the process without waiting for workflows that did not stop
+// after being aborted.
+func forceExit() {
+	log.Printf("Workflows did not stop after being aborted, exiting")
+	updateMetricsFile()
+	os.Exit(exitCode())
+}
+
+// abortWorkflows terminates every running emulator.
+func abortWorkflows() {
+	abortRunOnce.Do(func() { close(abortRun) })
+	emulatorsMutex.Lock()
+	running := make([]*connect3270.Emulator, 0, len(emulators))
+	for e := range emulators {
+		running = append(running, e)
+	}
+	emulatorsMutex.Unlock()
+	msg := fmt.Sprintf("Aborting %d running workflows", len(running))
+	log.Print(msg)
+	storeLog(msg)
+	for _, e := range running {
+		if err := e.Terminate(); err != nil {
+			log.Printf("Error terminating emulator on %s: %v", e.Where(), err)
+		}
+	}
+}
+
+// stopping reports whether the run has been asked to stop.
+func stopping() bool {
+	select {
+	case <-stopRun:
+		return true
+	default:
+		return false
+	}
+}
+
+// aborting reports whether running workflows are being abandoned.
+func aborting() bool {
+	select {
+	case <-abortRun:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleepUnlessStopped waits for d, or until the run is asked to stop.
+func sleepUnlessStopped(d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-stopRun:
+	}
+}
+
+// exitCode returns the process exit code: for a run stopped by a signal,
+// 128 plus the signal number as shells report it, exitThresholdsFailed if a
+// threshold was broken, and otherwise 0.
+func exitCode() int {
+	if stopping() {
+		if sig, ok := stopSignal.(syscall.Signal); ok {
+			return 128 + int(sig)
+		}
+	}
+	if atomic.LoadInt32(&thresholdsFailed) != 0 {
+		return exitThresholdsFailed
+	}
+	return 0
+}
+
+func trackEmulator(e *connect3270.Emulator) {
+	emulatorsMutex.Lock()
+	emulators[e] = true
+	emulatorsMutex.Unlock()
+	if aborting() {
+		e.Terminate()
+	}
+}
+
+// reviveEmulator lets e start a new 3270 process once Terminate has cut a
+// step short, unless the run is aborting.
+func reviveEmulator(e *connect3270.Emulator) {
+	e.Revive()
+	if aborting() {
+		e.Terminate()
+	}
+}
+
+func untrackEmulator(e *connect3270.Emulator) {
+	emulatorsMutex.Lock()
+	delete(emulators, e)
+	emulatorsMutex.Unlock()
 }
 
 func runConcurrentWorkflows(config *Configuration) {
+	if config.ArrivalRate > 0 || newLoadProfile(config).rate {
+		runArrivalRateWorkflows(config)
+		return
+	}
+	if len(config.Stages) > 0 {
+		runStagedWorkflows(config)
+		return
+	}
+	if iterationMode(config) {
+		runIterationWorkflows(config)
+		return
+	}
 	overallStart := time.Now()
 	semaphore := make(chan struct{}, concurrent)
 	var wg sync.WaitGroup
-	for time.Since(overallStart) < time.Duration(runtimeDuration)*time.Second {
-		for time.Since(overallStart) < time.Duration(runtimeDuration)*time.Second {
+	for !stopping() && time.Since(overallStart) < time.Duration(runtimeDuration)*time.Second {
+		for !stopping() && time.Since(overallStart) < time.Duration(runtimeDuration)*time.Second {
 			freeSlots := concurrent - len(semaphore)
 			if freeSlots <= 0 {
-				time.Sleep(time.Duration(config.RampUpDelay * float64(time.Second)))
+				sleepUnlessStopped(time.Duration(config.RampUpDelay * float64(time.Second)))
 				break
 			}
 			batchSize := min(freeSlots, config.RampUpBatchSize)
@@ -846,16 +2488,17 @@ func runConcurrentWorkflows(config *Configuration) {
 				batchSize, len(semaphore), len(semaphore)+batchSize)
 			storeLog(fmt.Sprintf("Increasing batch by %d, current size is %d, new total target is %d",
 				batchSize, len(semaphore), len(semaphore)+batchSize))
-			for i := 0; i < batchSize; i++ {
+			for i := 0; i < batchSize && !stopping(); i++ {
 				semaphore <- struct{}{}
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					portToUse := getNextAvailablePort()
-					err := runWorkflow(portToUse, config)
+					iterationStart := time.Now()
+					err := runWorkflow(config)
 					if err != nil && connect3270.Verbose {
-						log.Printf("Workflow on port %d error: %v", portToUse, err)
+						log.Printf("Workflow error: %v", err)
 					}
+					waitForPacing(config, iterationStart, overallStart.Add(time.Duration(runtimeDuration)*time.Second))
 					<-semaphore
 				}()
 			}
@@ -865,7 +2508,7 @@ func runConcurrentWorkflows(config *Configuration) {
 				len(semaphore), cpuPercent[0], memStats.UsedPercent)
 			storeLog(fmt.Sprintf("Currently active workflows: %d, CPU usage: %.2f%%, memory usage: %.2f%%",
 				len(semaphore), cpuPercent[0], memStats.UsedPercent))
-			time.Sleep(time.Duration(config.RampUpDelay * float64(time.Second)))
+			sleepUnlessStopped(time.Duration(config.RampUpDelay * float64(time.Second)))
 		}
 		cpuPercent, _ := cpu.Percent(0, false)
 		memStats, _ := mem.VirtualMemory()
@@ -873,47 +2516,463 @@ func runConcurrentWorkflows(config *Configuration) {
 			len(semaphore), cpuPercent[0], memStats.UsedPercent)
 		storeLog(fmt.Sprintf("Currently active workflows: %d, CPU usage: %.2f%%, memory usage: %.2f%%",
 			len(semaphore), cpuPercent[0], memStats.UsedPercent))
-		time.Sleep(time.Duration(config.RampUpDelay * float64(time.Second)))
+		sleepUnlessStopped(time.Duration(config.RampUpDelay * float64(time.Second)))
 	}
 	wg.Wait()
 	log.Println("All workflows completed after runtimeDuration ended.")
 	storeLog("All workflows completed after runtimeDuration ended.")
 }
 
-func getActiveWorkflows() int {
-	if connect3270.Verbose {
-		log.Println("Starting getActiveWorkflows")
+// arrivalRateUnits gives the length of each ArrivalRateUnit.
+var arrivalRateUnits = map[string]time.Duration{"": time.Second, "second": time.Second, "minute": time.Minute}
+
+// stageTick is how often staged runs and arrival-rate runs check whether to
+// start iterations.
+const stageTick = 10 * time.Millisecond
+
+// loadProfile is the target concurrency or arrival rate over a run.
+type loadProfile struct {
+	stages []Stage
+	rate   bool    // Stages give arrival rates rather than concurrency
+	unit   float64 // Seconds per ArrivalRateUnit
+	per    string  // ArrivalRateUnit, for logging
+}
+
+// newLoadProfile returns the profile described by config: its Stages, or a
+// constant ArrivalRate for -runtime seconds.
+func newLoadProfile(config *Configuration) loadProfile {
+	p := loadProfile{stages: config.Stages, unit: arrivalRateUnits[strings.ToLower(config.ArrivalRateUnit)].Seconds(), per: strings.ToLower(config.ArrivalRateUnit)}
+	if p.per == "" {
+		p.per = "second"
 	}
-	mutex.Lock()
-	defer mutex.Unlock()
-	return activeWorkflows
+	if len(p.stages) == 0 {
+		p.stages = []Stage{{Duration: float64(runtimeDuration), Rate: config.ArrivalRate, Interpolation: "step"}}
+	}
+	for _, stage := range p.stages {
+		p.rate = p.rate || stage.Rate > 0
+	}
+	return p
+}
+
+func (p loadProfile) duration() time.Duration {
+	var total float64
+	for _, stage := range p.stages {
+		total += stage.Duration
+	}
+	return time.Duration(total * float64(time.Second))
+}
+
+func (p loadProfile) value(stage Stage) float64 {
+	if p.rate {
+		return stage.Rate / p.unit
+	}
+	return float64(stage.Target)
+}
+
+// at returns the stage running after elapsed seconds, how far into it the run
+// is, and the target the stage starts from.
+func (p loadProfile) at(elapsed float64) (int, float64, float64) {
+	from := 0.0
+	for i, stage := range p.stages {
+		if elapsed < stage.Duration || i == len(p.stages)-1 {
+			return i, math.Min(elapsed, stage.Duration), from
+		}
+		elapsed -= stage.Duration
+		from = p.value(stage)
+	}
+	return -1, 0, 0
+}
+
+// target returns the concurrency, or the arrivals per second, after elapsed
+// seconds. Linear stages move evenly from the previous stage's target to
+// their own; step stages switch to theirs at once.
+func (p loadProfile) target(elapsed float64) float64 {
+	i, into, from := p.at(elapsed)
+	stage := p.stages[i]
+	to := p.value(stage)
+	if strings.ToLower(stage.Interpolation) == "step" || stage.Duration == 0 {
+		return to
+	}
+	return from + (to-from)*into/stage.Duration
+}
+
+// arrivals returns how many iterations are due in the first elapsed seconds.
+func (p loadProfile) arrivals(elapsed float64) float64 {
+	total, from := 0.0, 0.0
+	for _, stage := range p.stages {
+		into := math.Min(elapsed, stage.Duration)
+		to := p.value(stage)
+		if strings.ToLower(stage.Interpolation) == "step" || stage.Duration == 0 {
+			total += to * into
+		} else {
+			total += from*into + (to-from)*into*into/(2*stage.Duration)
+		}
+		elapsed -= into
+		from = to
+		if elapsed <= 0 {
+			break
+		}
+	}
+	return total
+}
+
+// logStage reports each stage as the run enters it.
+func (p loadProfile) logStage(i int) {
+	stage := p.stages[i]
+	var target string
+	if p.rate {
+		target = fmt.Sprintf("%g iterations per %s", stage.Rate, p.per)
+	} else {
+		target = fmt.Sprintf("%d concurrent workflows", stage.Target)
+	}
+	how := "ramping to"
+	if strings.ToLower(stage.Interpolation) == "step" {
+		how = "holding"
+	}
+	msg := fmt.Sprintf("Stage %d of %d: %s %s for %gs", i+1, len(p.stages), how, target, stage.Duration)
+	log.Print(msg)
+	storeLog(msg)
+}
+
+// startIteration runs one iteration of config in its own goroutine, holding a
+// slot in semaphore while it runs.
+func startIteration(config *Configuration, semaphore chan struct{}, wg *sync.WaitGroup, end time.Time) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		iterationStart := time.Now()
+		if err := runWorkflow(config); err != nil && connect3270.Verbose {
+			log.Printf("Workflow error: %v", err)
+		}
+		waitForPacing(config, iterationStart, end)
+		<-semaphore
+	}()
+}
+
+// logActivity reports the number of running workflows and host load.
+func logActivity(active int) {
+	cpuPercent, _ := cpu.Percent(0, false)
+	memStats, _ := mem.VirtualMemory()
+	msg := fmt.Sprintf("Currently active workflows: %d, dropped iterations: %d, CPU usage: %.2f%%, memory usage: %.2f%%",
+		active, atomic.LoadInt64(&totalIterationsDropped), cpuPercent[0], memStats.UsedPercent)
+	log.Print(msg)
+	storeLog(msg)
+}
+
+// runStagedWorkflows keeps the number of running workflows at the target of
+// config.Stages. When the target falls, workflows are not interrupted;
+// finished ones are simply not replaced.
+func runStagedWorkflows(config *Configuration) {
+	profile := newLoadProfile(config)
+	maxTarget := 0
+	for _, stage := range profile.stages {
+		if stage.Target > maxTarget {
+			maxTarget = stage.Target
+		}
+	}
+	overallStart := time.Now()
+	end := overallStart.Add(profile.duration())
+	semaphore := make(chan struct{}, maxTarget+1)
+	var wg sync.WaitGroup
+	stage, lastReport := -1, overallStart
+	for now := overallStart; now.Before(end) && !stopping(); now = time.Now() {
+		elapsed := now.Sub(overallStart).Seconds()
+		if i, _, _ := profile.at(elapsed); i != stage {
+			stage = i
+			profile.logStage(i)
+		}
+		for target := int(profile.target(elapsed)); len(semaphore) < target; {
+			semaphore <- struct{}{}
+			startIteration(config, semaphore, &wg, end)
+		}
+		if time.Since(lastReport) >= time.Second {
+			lastReport = time.Now()
+			logActivity(len(semaphore))
+		}
+		time.Sleep(stageTick)
+	}
+	wg.Wait()
+	log.Println("All workflows completed after the last stage ended.")
+	storeLog("All workflows completed after the last stage ended.")
+}
+
+// runArrivalRateWorkflows starts iterations at config.ArrivalRate for
+// -runtime seconds, or at the rates of config.Stages, however long each one
+// takes, which is how load is specified in transactions per second. An
+// arrival that finds MaxInFlight iterations running is dropped and counted
+// rather than queued, so that a slow host does not build up a backlog that
+// would distort the rate.
+func runArrivalRateWorkflows(config *Configuration) {
+	profile := newLoadProfile(config)
+	maxInFlight := config.MaxInFlight
+	if maxInFlight == 0 {
+		maxInFlight = concurrent
+	}
+	log.Printf("Starting iterations for %v, at most %d at once", profile.duration(), maxInFlight)
+	storeLog(fmt.Sprintf("Starting iterations for %v, at most %d at once", profile.duration(), maxInFlight))
+
+	overallStart := time.Now()
+	end := overallStart.Add(profile.duration())
+	semaphore := make(chan struct{}, maxInFlight)
+	var wg sync.WaitGroup
+	started, stage, lastReport := 0, -1, overallStart
+	for now := overallStart; now.Before(end) && !stopping(); now = time.Now() {
+		elapsed := now.Sub(overallStart).Seconds()
+		if i, _, _ := profile.at(elapsed); i != stage {
+			stage = i
+			profile.logStage(i)
+		}
+		// Iterations are due at fixed points from the start, so a late
+		// wake-up starts every iteration that is due rather than shifting
+		// the schedule.
+		for due := int(profile.arrivals(elapsed) + 1e-9); started < due; started++ {
+			select {
+			case semaphore <- struct{}{}:
+				startIteration(config, semaphore, &wg, end)
+			default:
+				dropped := atomic.AddInt64(&totalIterationsDropped, 1)
+				if connect3270.Verbose {
+					log.Printf("Dropped an iteration because %d are already running (%d dropped so far)", maxInFlight, dropped)
+				}
+			}
+		}
+		if time.Since(lastReport) >= time.Second {
+			lastReport = time.Now()
+			logActivity(len(semaphore))
+		}
+		time.Sleep(stageTick)
+	}
+	wg.Wait()
+	log.Printf("All workflows completed after the last arrival, %d iterations were dropped.", atomic.LoadInt64(&totalIterationsDropped))
+	storeLog(fmt.Sprintf("All workflows completed after the last arrival, %d iterations were dropped.", atomic.LoadInt64(&totalIterationsDropped)))
 }
 
-func getNextAvailablePort() int {
+// iterationMode reports whether config limits the iterations of the
+// -concurrent workflows or keeps their sessions open, which runs each
+// workflow as a virtual user (VU) that loops its iterations.
+func iterationMode(config *Configuration) bool {
+	return config.Iterations > 0 || config.IterationsPerVU > 0 || config.KeepSession
+}
+
+// runIterationWorkflows runs -concurrent VUs, started in batches of
+// RampUpBatchSize every RampUpDelay seconds. Each one loops its iterations
+// until Iterations have been run between them, it has run IterationsPerVU,
+// or -runtime ends, whichever comes first.
+func runIterationWorkflows(config *Configuration) {
+	overallStart := time.Now()
+	end := overallStart.Add(time.Duration(runtimeDuration) * time.Second)
+	if runtimeDuration <= 0 {
+		end = overallStart.Add(100 * 365 * 24 * time.Hour)
+	}
+	remaining := int64(config.Iterations)
+	// next claims another iteration for a VU that has run done iterations.
+	next := func(done int) bool {
+		if stopping() || !time.Now().Before(end) {
+			return false
+		}
+		if config.IterationsPerVU > 0 && done >= config.IterationsPerVU {
+			return false
+		}
+		return config.Iterations == 0 || atomic.AddInt64(&remaining, -1) >= 0
+	}
+
+	var wg sync.WaitGroup
+	finished := make(chan struct{})
+	for started := 0; started < concurrent && !stopping(); {
+		batchSize := min(concurrent-started, config.RampUpBatchSize)
+		log.Printf("Starting %d virtual users, %d of %d running", batchSize, started+batchSize, concurrent)
+		storeLog(fmt.Sprintf("Starting %d virtual users, %d of %d running", batchSize, started+batchSize, concurrent))
+		for i := 0; i < batchSize; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if config.KeepSession {
+					runSessionWorkflow(config, next, end)
+					return
+				}
+				for done := 0; next(done); done++ {
+					iterationStart := time.Now()
+					if err := runWorkflow(config); err != nil && connect3270.Verbose {
+						log.Printf("Workflow error: %v", err)
+					}
+					waitForPacing(config, iterationStart, end)
+				}
+			}()
+		}
+		started += batchSize
+		if started < concurrent {
+			sleepUnlessStopped(time.Duration(config.RampUpDelay * float64(time.Second)))
+		}
+	}
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	for waiting := true; waiting; {
+		select {
+		case <-finished:
+			waiting = false
+		case <-time.After(5 * time.Second):
+			logActivity(getActiveWorkflows())
+		}
+	}
+	msg := fmt.Sprintf("All virtual users finished after %d iterations.", atomic.LoadInt64(&totalWorkflowsStarted))
+	log.Print(msg)
+	storeLog(msg)
+}
+
+// runSessionWorkflow runs a VU that keeps one session open: Setup once, Steps
+// for every iteration next allows, then Teardown and Finally. Each iteration
+// is counted and timed as a workflow. A failed iteration runs OnFailure and
+// closes the session, and the next iteration opens a new one. A failed Setup
+// counts as a failed iteration.
+func runSessionWorkflow(config *Configuration, next func(done int) bool, end time.Time) {
+	steps := config.Steps
+	if config.InputFilePath != "" {
+		var err error
+		if steps, err = loadInputFile(config.InputFilePath); err != nil {
+			log.Printf("Error loading input file: %v", err)
+			return
+		}
+	}
 	mutex.Lock()
-	defer mutex.Unlock()
-	for {
-		lastUsedPort++
-		if isPortAvailable(lastUsedPort) {
-			return lastUsedPort
+	activeWorkflows++
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		activeWorkflows--
+		mutex.Unlock()
+	}()
+
+	done := 0
+	for claimed := next(done); claimed; {
+		e, id := newEmulator(config.Host, config.Port)
+		trackEmulator(e)
+		tmpFile, err := ioutil.TempFile("", "workflowOutput_")
+		if err != nil {
+			log.Printf("Error creating temporary file: %v", err)
+			untrackEmulator(e)
+			return
+		}
+		tmpFileName := tmpFile.Name()
+		tmpFile.Close()
+		e.InitializeOutput(tmpFileName, runAPI)
+		session, err := newWorkflowSession(e, tmpFileName, config)
+		if err != nil {
+			log.Printf("Error loading screen catalogue: %v", err)
+			untrackEmulator(e)
+			return
+		}
+		storeLog(fmt.Sprintf("Opening session %d", id))
+		session.watch(id, config)
+
+		sessionStart, iterations := time.Now(), 0
+		session.startTrace("setup", config, id, iterations+1)
+		lastErr := session.runSteps("Setup", config.Setup)
+		if lastErr == nil {
+			session.endTrace(nil)
+		} else {
+			atomic.AddInt64(&totalWorkflowsStarted, 1)
+			session.iterationFailed(id, iterations+1, sessionStart, "Setup", lastErr, config)
+			session.endTrace(lastErr)
+			done++
+			waitForPacing(config, sessionStart, end)
+			if config.Pacing <= 0 {
+				// Do not reconnect at once to a host that refuses sessions.
+				sleepUnlessStopped(time.Duration(config.RampUpDelay * float64(time.Second)))
+			}
+			claimed = next(done)
+		}
+		for claimed && lastErr == nil {
+			iterationStart := time.Now()
+			lastErr = session.runIteration(id, iterations+1, steps, config)
+			done++
+			iterations++
+			waitForPacing(config, iterationStart, end)
+			claimed = next(done)
+		}
+
+		session.startTrace("teardown", config, id, iterations)
+		session.setSessionState(sessionClosing)
+		if lastErr == nil {
+			session.runHandlerSteps("Teardown", config.Teardown)
+		}
+		session.runHandlerSteps("Finally", config.Finally)
+		session.ensureDisconnected()
+		session.endTrace(nil)
+		session.unwatch()
+		untrackEmulator(e)
+		if lastErr == nil {
+			if err := saveOutput(tmpFileName, config); err != nil {
+				log.Printf("Error saving output: %v", err)
+			}
 		}
+		storeLog(fmt.Sprintf("Closed session %d after %d iterations", id, iterations))
+	}
+}
+
+// runIteration runs one iteration of a KeepSession workflow on the open
+// session and records it as a workflow.
+func (s *workflowSession) runIteration(id int64, iteration int, steps []Step, config *Configuration) error {
+	startTime := time.Now()
+	atomic.AddInt64(&totalWorkflowsStarted, 1)
+	s.beginIteration(iteration)
+	s.startTrace("workflow", config, id, iteration)
+	err := s.runSteps("Steps", steps)
+	recordWorkflowDuration(time.Since(startTime))
+	if err != nil {
+		s.iterationFailed(id, iteration, startTime, "Iteration", err, config)
+		s.endTrace(err)
+		return err
+	}
+	s.endTrace(nil)
+	s.setSessionState(sessionWaiting)
+	finishIteration(id, iteration, startTime, nil)
+	return nil
+}
+
+// iterationFailed records a failed KeepSession iteration and runs OnFailure.
+func (s *workflowSession) iterationFailed(id int64, iteration int, start time.Time, what string, err error, config *Configuration) {
+	log.Printf("%s of session %d failed at %v", what, id, err)
+	storeLog(fmt.Sprintf("%s of session %d failed at %v", what, id, err))
+	if se, ok := err.(*stepError); ok && s.catalogue != nil {
+		recordFailureScreen(se.Screen)
+	}
+	s.watchFailure(err)
+	s.runHandlerSteps("OnFailure", config.OnFailure)
+	finishIteration(id, iteration, start, err)
+}
+
+// waitForPacing holds a concurrency slot until config.Pacing seconds have
+// passed since the iteration started, so that iterations start at a steady
+// rate regardless of how long each one took.
+func waitForPacing(config *Configuration, iterationStart, end time.Time) {
+	if config.Pacing <= 0 {
+		return
+	}
+	interval := time.Duration(config.Pacing * float64(time.Second))
+	remaining := interval - time.Since(iterationStart)
+	if remaining <= 0 {
 		if connect3270.Verbose {
-			log.Printf("Port %d is in use, trying next port", lastUsedPort)
+			log.Printf("Iteration took %v, longer than the pacing interval of %v", time.Since(iterationStart), interval)
 		}
+		return
+	}
+	if untilEnd := time.Until(end); untilEnd < remaining {
+		remaining = untilEnd
+	}
+	if remaining > 0 {
+		sleepUnlessStopped(remaining)
 	}
 }
 
-func isPortAvailable(port int) bool {
-	addr := ":" + strconv.Itoa(port)
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		if connect3270.Verbose {
-			log.Printf("Port %d is in use, trying next port", port)
-		}
-		return false
+func getActiveWorkflows() int {
+	if connect3270.Verbose {
+		log.Println("Starting getActiveWorkflows")
 	}
-	ln.Close()
-	return true
+	mutex.Lock()
+	defer mutex.Unlock()
+	return activeWorkflows
 }
 
 func min(a, b int) int {
@@ -923,35 +2982,330 @@ func min(a, b int) int {
 	return b
 }
 
+// validationErrors collects every problem found in a configuration so that
+// they can be reported together.
+type validationErrors []string
+
+func (v validationErrors) Error() string {
+	return fmt.Sprintf("%d problem(s) found:\n  %s", len(v), strings.Join(v, "\n  "))
+}
+
+func (v *validationErrors) add(format string, args ...interface{}) {
+	*v = append(*v, fmt.Sprintf(format, args...))
+}
+
+// validateConfiguration checks the whole configuration and returns a
+// validationErrors listing every problem found, or nil.
 func validateConfiguration(config *Configuration) error {
 	if connect3270.Verbose {
 		log.Println("Starting validateConfiguration")
 	}
+	var errs validationErrors
 	if config.Host == "" {
-		return fmt.Errorf("host is empty")
+		errs.add("Host is empty")
 	}
-	if config.Port <= 0 {
-		return fmt.Errorf("port is invalid")
+	if config.Port <= 0 || config.Port > 65535 {
+		errs.add("Port %d is not between 1 and 65535", config.Port)
 	}
 	if config.OutputFilePath == "" {
-		return fmt.Errorf("output file path is empty")
+		errs.add("OutputFilePath is empty")
+	}
+	if config.RampUpBatchSize < 0 {
+		errs.add("RampUpBatchSize must not be negative")
+	}
+	if config.RampUpDelay < 0 {
+		errs.add("RampUpDelay must not be negative")
+	}
+	if config.Pacing < 0 {
+		errs.add("Pacing must not be negative")
+	}
+	if config.ArrivalRate < 0 {
+		errs.add("ArrivalRate must not be negative")
+	}
+	if _, ok := arrivalRateUnits[strings.ToLower(config.ArrivalRateUnit)]; !ok {
+		errs.add("ArrivalRateUnit %q is not one of second, minute", config.ArrivalRateUnit)
+	}
+	if config.MaxInFlight < 0 {
+		errs.add("MaxInFlight must not be negative")
+	}
+	if config.ArrivalRate > 0 && config.Pacing > 0 {
+		errs.add("Pacing cannot be used with ArrivalRate, which sets when iterations start")
+	}
+	validateStages(&errs, config)
+	validateIterations(&errs, config)
+	validateThresholds(&errs, config)
+	if config.InputFilePath != "" {
+		if _, err := os.Stat(config.InputFilePath); err != nil {
+			errs.add("InputFilePath: %v", err)
+		} else if steps, err := loadInputFile(config.InputFilePath); err != nil {
+			if list, ok := err.(macro.ErrorList); ok {
+				for _, e := range list {
+					errs.add("InputFilePath: %v", e)
+				}
+			} else {
+				errs.add("InputFilePath: %v", err)
+			}
+		} else {
+			validateSteps(&errs, config.InputFilePath, steps)
+		}
+		if len(config.Steps) > 0 {
+			errs.add("InputFilePath and Steps cannot both be set")
+		}
+	} else if len(config.Steps) == 0 {
+		errs.add("no Steps are defined")
+	}
+	validateSteps(&errs, "Setup", config.Setup)
+	validateSteps(&errs, "Steps", config.Steps)
+	validateSteps(&errs, "Teardown", config.Teardown)
+	validateSteps(&errs, "OnFailure", config.OnFailure)
+	validateSteps(&errs, "Finally", config.Finally)
+	validateScreenSteps(&errs, config)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateIterations checks the iteration limits and KeepSession, which
+// apply to the -concurrent workflows and so cannot be used with arrival
+// rates or stages.
+func validateIterations(errs *validationErrors, config *Configuration) {
+	if config.Iterations < 0 {
+		errs.add("Iterations must not be negative")
+	}
+	if config.IterationsPerVU < 0 {
+		errs.add("IterationsPerVU must not be negative")
+	}
+	for _, setting := range []struct {
+		name string
+		set  bool
+	}{{"Iterations", config.Iterations > 0}, {"IterationsPerVU", config.IterationsPerVU > 0}, {"KeepSession", config.KeepSession}} {
+		if setting.set && config.ArrivalRate > 0 {
+			errs.add("%s cannot be used with ArrivalRate", setting.name)
+		}
+		if setting.set && len(config.Stages) > 0 {
+			errs.add("%s cannot be used with Stages", setting.name)
+		}
+	}
+	if !config.KeepSession && (len(config.Setup) > 0 || len(config.Teardown) > 0) {
+		errs.add("Setup and Teardown are only used with KeepSession")
+	}
+}
+
+// validateStages checks that every stage has a duration and that the stages
+// all give either concurrency or arrival rates.
+func validateStages(errs *validationErrors, config *Configuration) {
+	targets, rates := 0, 0
+	for i, stage := range config.Stages {
+		where := fmt.Sprintf("Stages[%d]", i)
+		if stage.Duration <= 0 {
+			errs.add("%s: Duration must be greater than 0", where)
+		}
+		if stage.Target < 0 {
+			errs.add("%s: Target must not be negative", where)
+		}
+		if stage.Rate < 0 {
+			errs.add("%s: Rate must not be negative", where)
+		}
+		if stage.Target > 0 {
+			targets++
+		}
+		if stage.Rate > 0 {
+			rates++
+		}
+		switch strings.ToLower(stage.Interpolation) {
+		case "", "linear", "step":
+		default:
+			errs.add("%s: Interpolation %q is not one of linear, step", where, stage.Interpolation)
+		}
+	}
+	if targets > 0 && rates > 0 {
+		errs.add("Stages cannot mix Target and Rate")
+	}
+	if len(config.Stages) > 0 && targets == 0 && rates == 0 {
+		errs.add("Stages never start a workflow; set Target or Rate")
+	}
+	if len(config.Stages) > 0 && config.ArrivalRate > 0 {
+		errs.add("ArrivalRate cannot be used with Stages; give each stage a Rate instead")
+	}
+	if rates > 0 && config.Pacing > 0 {
+		errs.add("Pacing cannot be used with Stages that give a Rate, which sets when iterations start")
+	}
+}
+
+// validateThresholds checks the threshold values and that every
+// transaction given a threshold is timed by the workflow.
+func validateThresholds(errs *validationErrors, config *Configuration) {
+	t := config.Thresholds
+	if t == nil {
+		return
+	}
+	if t.MaxErrorRate != nil && (*t.MaxErrorRate < 0 || *t.MaxErrorRate > 100) {
+		errs.add("Thresholds.MaxErrorRate %g is not between 0 and 100", *t.MaxErrorRate)
 	}
-	for _, step := range config.Steps {
+	if t.MaxP95Duration < 0 {
+		errs.add("Thresholds.MaxP95Duration must not be negative")
+	}
+	if t.MinCompleted < 0 {
+		errs.add("Thresholds.MinCompleted must not be negative")
+	}
+	if t.AbortMinWorkflows < 0 {
+		errs.add("Thresholds.AbortMinWorkflows must not be negative")
+	}
+	timed := map[string]bool{}
+	for _, steps := range [][]Step{config.Setup, config.Steps, config.Teardown, config.OnFailure, config.Finally} {
+		for _, step := range steps {
+			if step.Transaction != "" {
+				timed[step.Transaction] = true
+			}
+		}
+	}
+	names := make([]string, 0, len(t.MaxTransactionP95))
+	for name := range t.MaxTransactionP95 {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if t.MaxTransactionP95[name] < 0 {
+			errs.add("Thresholds.MaxTransactionP95.%s must not be negative", name)
+		}
+		if !timed[name] && config.InputFilePath == "" {
+			errs.add("Thresholds.MaxTransactionP95.%s: no step times transaction %s", name, name)
+		}
+	}
+}
+
+// stepTypes lists every step type a workflow can use.
+var stepTypes = func() []string {
+	types := []string{"InitializeOutput", "Connect", "Disconnect", "CheckValue", "FillString", "MoveCursor", "AsciiScreenGrab",
+		"PressEnter", "PressTab", "PressClear", "WaitForInputReady", "Think", "BeginTransaction", "EndTransaction", "ExpectScreen", "WaitForScreen"}
+	for i := 1; i <= 24; i++ {
+		types = append(types, fmt.Sprintf("PressPF%d", i))
+	}
+	return types
+}()
+
+func validateSteps(errs *validationErrors, section string, steps []Step) {
+	openTransactions := map[string]bool{}
+	for i, step := range steps {
+		where := fmt.Sprintf("%s[%d] (%s)", section, i+1, step.Type)
 		switch step.Type {
-		case "Connect", "AsciiScreenGrab", "PressEnter", "Disconnect":
-			continue
-		case "CheckValue", "FillString":
-			if step.Coordinates.Row == 0 || step.Coordinates.Column == 0 {
-				return fmt.Errorf("coordinates are incomplete in a %s step", step.Type)
+		case "Connect", "AsciiScreenGrab", "PressEnter", "PressTab", "PressClear", "Disconnect", "InitializeOutput", "WaitForInputReady":
+		case "MoveCursor":
+			validateCoordinates(errs, where, step.Coordinates, false)
+		case "BeginTransaction":
+			if step.Transaction == "" {
+				errs.add("%s: Transaction name is empty", where)
+			} else if openTransactions[step.Transaction] {
+				errs.add("%s: transaction %s is already open", where, step.Transaction)
+			}
+			openTransactions[step.Transaction] = true
+		case "EndTransaction":
+			if step.Transaction == "" {
+				errs.add("%s: Transaction name is empty", where)
+			} else if !openTransactions[step.Transaction] {
+				errs.add("%s: transaction %s was not started", where, step.Transaction)
+			}
+			delete(openTransactions, step.Transaction)
+		case "ExpectScreen", "WaitForScreen":
+			if step.Screen == "" {
+				errs.add("%s: Screen is empty", where)
+			}
+		case "Think":
+			if step.Think == nil {
+				errs.add("%s: Think is missing", where)
+			} else if err := step.Think.validate(); err != nil {
+				errs.add("%s: %v", where, err)
+			}
+		case "CheckValue":
+			validateCoordinates(errs, where, step.Coordinates, true)
+			if step.Text == "" {
+				errs.add("%s: Text is empty", where)
+			}
+		case "FillString":
+			// FillString without coordinates types at the current cursor position.
+			if step.Coordinates.Row != 0 || step.Coordinates.Column != 0 {
+				validateCoordinates(errs, where, step.Coordinates, false)
 			}
 			if step.Text == "" {
-				return fmt.Errorf("text is empty in a %s step", step.Type)
+				errs.add("%s: Text is empty", where)
 			}
 		default:
-			return fmt.Errorf("unknown step type: %s", step.Type)
+			if step.Type == "" {
+				errs.add("%s: Type is empty", where)
+			} else if !isPFKeyStep(step.Type) {
+				errs.add("%s: unknown step type", where)
+			}
+		}
+		if step.Think != nil && step.Type != "Think" {
+			errs.add("%s: Think is only used by Think steps", where)
+		}
+		if step.Transaction != "" && !isAIDStep(step.Type) && step.Type != "BeginTransaction" && step.Type != "EndTransaction" {
+			errs.add("%s: a Transaction can only be timed on a key press", where)
+		}
+		if step.Timeout < 0 || step.Retries < 0 || step.RetryDelay < 0 {
+			errs.add("%s: Timeout, Retries and RetryDelay must not be negative", where)
 		}
 	}
-	return nil
+	for name := range openTransactions {
+		errs.add("%s: transaction %s is never ended", section, name)
+	}
+}
+
+// validateScreenSteps checks that the screen catalogue loads and defines every
+// screen that ExpectScreen and WaitForScreen steps refer to.
+func validateScreenSteps(errs *validationErrors, config *Configuration) {
+	var catalogue *screens.Catalogue
+	if config.ScreenCatalogue != "" {
+		var err error
+		if catalogue, err = loadScreenCatalogue(config.ScreenCatalogue); err != nil {
+			errs.add("ScreenCatalogue: %v", err)
+			return
+		}
+	}
+	sections := map[string][]Step{"Setup": config.Setup, "Steps": config.Steps, "Teardown": config.Teardown, "OnFailure": config.OnFailure, "Finally": config.Finally}
+	for _, section := range stepLists {
+		for i, step := range sections[section] {
+			if step.Screen == "" {
+				continue
+			}
+			where := fmt.Sprintf("%s[%d] (%s)", section, i+1, step.Type)
+			if step.Type != "ExpectScreen" && step.Type != "WaitForScreen" {
+				errs.add("%s: Screen is only used by ExpectScreen and WaitForScreen steps", where)
+			} else if catalogue == nil {
+				errs.add("%s: a ScreenCatalogue is needed to identify screens", where)
+			} else if !catalogue.Has(step.Screen) {
+				errs.add("%s: screen %s is not in %s", where, step.Screen, config.ScreenCatalogue)
+			}
+		}
+	}
+}
+
+// validateCoordinates checks that coordinates, and the text they span, fit on
+// the emulated terminal's screen.
+func validateCoordinates(errs *validationErrors, where string, c connect3270.Coordinates, needLength bool) {
+	if c.Row < 1 || c.Row > connect3270.ScreenRows {
+		errs.add("%s: Row %d is not between 1 and %d", where, c.Row, connect3270.ScreenRows)
+	}
+	if c.Column < 1 || c.Column > connect3270.ScreenColumns {
+		errs.add("%s: Column %d is not between 1 and %d", where, c.Column, connect3270.ScreenColumns)
+	}
+	if c.Length < 0 || (needLength && c.Length == 0) {
+		errs.add("%s: Length must be at least 1", where)
+	}
+	offset := (c.Row-1)*connect3270.ScreenColumns + c.Column - 1
+	if c.Length > 0 && offset+c.Length > connect3270.ScreenRows*connect3270.ScreenColumns {
+		errs.add("%s: Length %d runs past the end of the screen", where, c.Length)
+	}
+}
+
+// isPFKeyStep reports whether stepType is one of PressPF1 to PressPF24.
+func isPFKeyStep(stepType string) bool {
+	if !strings.HasPrefix(stepType, "PressPF") {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(stepType, "PressPF"))
+	return err == nil && n >= 1 && n <= 24
 }
 
 // runDashboard launches the dashboard server. It now serves two charts:
@@ -974,14 +3328,7 @@ func runDashboard() {
 	}
 	dashboardStarted = true
 	{
-		dashboardDir, err := os.UserConfigDir()
-		if err != nil {
-			log.Printf("Error fetching user config directory: %v", err)
-			dashboardDir = filepath.Join(".", "dashboard")
-		} else {
-			dashboardDir = filepath.Join(dashboardDir, "3270Connect", "dashboard")
-		}
-		files, err := filepath.Glob(filepath.Join(dashboardDir, "metrics_*.json"))
+		files, err := filepath.Glob(filepath.Join(metricsDir(), "metrics_*.json"))
 		if err != nil {
 			log.Printf("Error listing old metrics files: %v", err)
 		} else {
@@ -1009,104 +3356,22 @@ func runDashboard() {
 
 	setupConsoleHandler()
 	setupTerminalConsoleHandler()
+	http.HandleFunc("/metrics", metricsHandler(aggregateMetrics))
+	http.HandleFunc("/events", eventsHandler)
+	http.HandleFunc("/screen", screenHandler)
 	http.HandleFunc("/dashboard", func(w http.ResponseWriter, r *http.Request) {
-		dashboardDir, err := os.UserConfigDir()
-		if err != nil {
-			log.Printf("Error fetching user config directory: %v", err)
-			dashboardDir = filepath.Join(".", "dashboard")
-		} else {
-			dashboardDir = filepath.Join(dashboardDir, "3270Connect", "dashboard")
-		}
-		files, err := filepath.Glob(filepath.Join(dashboardDir, "metrics_*.json"))
-		if err != nil {
-			log.Printf("Error listing metrics files: %v", err)
-			files = []string{}
-		}
-		var metricsList []Metrics
-		var totalStarted, totalCompleted, totalFailed, active int
-		for _, f := range files {
-			data, err := ioutil.ReadFile(f)
-			if err != nil {
-				log.Printf("Error reading file %s: %v", f, err)
-				continue
-			}
-			var m Metrics
-			if err := json.Unmarshal(data, &m); err != nil {
-				log.Printf("Error unmarshaling file %s: %v", f, err)
-				continue
-			}
-			metricsList = append(metricsList, m)
-			totalStarted += int(m.TotalWorkflowsStarted)
-			totalCompleted += int(m.TotalWorkflowsCompleted)
-			totalFailed += int(m.TotalWorkflowsFailed)
-			active += m.ActiveWorkflows
-		}
-		// To display host CPU and Memory, choose the metrics file with the smallest PID.
-		var hostMetrics *Metrics
-		if len(metricsList) > 0 {
-			hostMetrics = &metricsList[0]
-			for i := 1; i < len(metricsList); i++ {
-				if metricsList[i].PID < hostMetrics.PID {
-					hostMetrics = &metricsList[i]
-				}
-			}
-		}
-		metricsJSON, _ := json.Marshal(metricsList)
-		// Escape any literal "%" in the JSON so that they are not mistaken for format specifiers.
-		autoRefresh := r.URL.Query().Get("autoRefresh")
-		refreshPeriod := r.URL.Query().Get("refreshPeriod")
-		if refreshPeriod == "" {
-			refreshPeriod = "5"
-		}
-		checked := ""
-		if autoRefresh == "true" {
-			checked = "checked"
-		}
-		sel1, sel5, sel10, sel15, sel30 := "", "", "", "", ""
-		switch refreshPeriod {
-		case "1":
-			sel1 = "selected"
-		case "5":
-			sel5 = "selected"
-		case "10":
-			sel10 = "selected"
-		case "15":
-			sel15 = "selected"
-		case "30":
-			sel30 = "selected"
-		}
-		agg := aggregateMetrics()
 		data := struct {
-			ActiveWorkflows                 int
-			TotalWorkflowsStarted           int64
-			TotalWorkflowsCompleted         int64
-			TotalWorkflowsFailed            int64
-			Checked                         string
-			Sel1, Sel5, Sel10, Sel15, Sel30 string
-			Year                            int
-			AutoRefreshEnabled              bool
-			RefreshPeriod                   string
-			MetricsJSON                     string
+			Year int
+			View dashboardView
 		}{
-			ActiveWorkflows:         agg.ActiveWorkflows,
-			TotalWorkflowsStarted:   agg.TotalWorkflowsStarted,
-			TotalWorkflowsCompleted: agg.TotalWorkflowsCompleted,
-			TotalWorkflowsFailed:    agg.TotalWorkflowsFailed,
-			Checked:                 checked,
-			Sel1:                    sel1,
-			Sel5:                    sel5,
-			Sel10:                   sel10,
-			Sel15:                   sel15,
-			Sel30:                   sel30,
-			Year:                    time.Now().Year(),
-			AutoRefreshEnabled:      autoRefresh == "true",
-			RefreshPeriod:           refreshPeriod,
-			MetricsJSON:             string(metricsJSON),
+			Year: time.Now().Year(),
+			View: newDashboardView(readMetricsFiles(), time.Now()),
 		}
 		if err := dashboardTemplate.Execute(w, data); err != nil {
 			log.Printf("Error executing dashboard template: %v", err)
 		}
 	})
+	go liveDashboard.run()
 
 	log.Printf("Dashboard available at http://localhost:%d/dashboard", dashboardPort)
 	go func() {
@@ -1121,15 +3386,307 @@ func runDashboard() {
 }
 
 type Metrics struct {
-	PID                     int       `json:"pid"`
-	ActiveWorkflows         int       `json:"activeWorkflows"`
-	TotalWorkflowsStarted   int64     `json:"totalWorkflowsStarted"`
-	TotalWorkflowsCompleted int64     `json:"totalWorkflowsCompleted"`
-	TotalWorkflowsFailed    int64     `json:"totalWorkflowsFailed"`
-	Durations               []float64 `json:"durations"`
-	CPUUsage                []float64 `json:"cpuUsage"`
-	MemoryUsage             []float64 `json:"memoryUsage"`
-	Params                  string    `json:"params"`
+	PID                     int                             `json:"pid"`
+	ActiveWorkflows         int                             `json:"activeWorkflows"`
+	TotalWorkflowsStarted   int64                           `json:"totalWorkflowsStarted"`
+	TotalWorkflowsCompleted int64                           `json:"totalWorkflowsCompleted"`
+	TotalWorkflowsFailed    int64                           `json:"totalWorkflowsFailed"`
+	TotalIterationsDropped  int64                           `json:"totalIterationsDropped,omitempty"`
+	Durations               *histogram.Histogram            `json:"durations"`
+	Transactions            map[string]*histogram.Histogram `json:"transactions,omitempty"`
+	Completions             histogram.Series                `json:"completions"`
+	Failures                histogram.Series                `json:"failures"`
+	StepTypes               map[string]*StepMetrics         `json:"stepTypes,omitempty"`    // Keyed by step type
+	Steps                   map[string]*StepMetrics         `json:"steps,omitempty"`        // Keyed by stepName
+	StepFailures            map[string]map[string]int64     `json:"stepFailures,omitempty"` // Failed steps by stepName and error category
+	FailureScreens          map[string]int64                `json:"failureScreens,omitempty"`
+	CPUUsage                []float64                       `json:"cpuUsage"`
+	MemoryUsage             []float64                       `json:"memoryUsage"`
+	Params                  string                          `json:"params"`
+	Agent                   string                          `json:"agent,omitempty"` // Address of the agent that ran the workflows, for a controller
+	Sessions                []sessionInfo                   `json:"sessions,omitempty"`
+}
+
+// processMetrics is the results of one process as the dashboard charts them,
+// with the histograms and series reduced to statistics.
+type processMetrics struct {
+	Metrics
+	Summary       histogram.Summary `json:"summary"`
+	CompletedRate float64           `json:"completedRate"` // Per second over rateWindows[1]
+	FailedRate    float64           `json:"failedRate"`
+}
+
+// newProcessMetrics summarises the results in m.
+func newProcessMetrics(m Metrics, now time.Time) processMetrics {
+	p := processMetrics{
+		Metrics:       m,
+		Summary:       m.Durations.Summarize(),
+		CompletedRate: m.Completions.Rate(now, rateWindows[1]),
+		FailedRate:    m.Failures.Rate(now, rateWindows[1]),
+	}
+	p.Durations = nil
+	p.Transactions = nil
+	p.Completions = histogram.Series{}
+	p.Failures = histogram.Series{}
+	p.StepTypes = nil
+	p.Steps = nil
+	p.StepFailures = nil
+	p.Sessions = nil
+	return p
+}
+
+// TransactionStats summarises the recorded durations of one named transaction.
+type TransactionStats struct {
+	Name string `json:"name"`
+	histogram.Summary
+}
+
+// summarizeTransactions computes per-transaction statistics, sorted by name.
+func summarizeTransactions(transactions map[string]*histogram.Histogram) []TransactionStats {
+	var stats []TransactionStats
+	for name, durations := range transactions {
+		if durations.Count == 0 {
+			continue
+		}
+		stats = append(stats, TransactionStats{Name: name, Summary: durations.Summarize()})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// stepStats summarises the results of one step or step type.
+type stepStats struct {
+	Name              string `json:"name"`
+	List              string `json:"list,omitempty"`
+	Index             int    `json:"index,omitempty"`
+	Type              string `json:"type"`
+	Executions        int64  `json:"executions"`
+	Failures          int64  `json:"failures"`
+	Retries           int64  `json:"retries"`
+	histogram.Summary `json:"durations"`
+}
+
+// summarizeSteps computes per-step statistics. Steps are sorted by list and
+// position, and step types by name.
+func summarizeSteps(steps map[string]*StepMetrics) []stepStats {
+	var stats []stepStats
+	for name, sm := range steps {
+		stats = append(stats, stepStats{
+			Name:       name,
+			List:       sm.List,
+			Index:      sm.Index,
+			Type:       sm.Type,
+			Executions: sm.Executions,
+			Failures:   sm.Failures,
+			Retries:    sm.Retries,
+			Summary:    sm.Durations.Summarize(),
+		})
+	}
+	listOrder := func(list string) int {
+		for i, l := range stepLists {
+			if l == list {
+				return i
+			}
+		}
+		return len(stepLists)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.List != b.List {
+			return listOrder(a.List) < listOrder(b.List)
+		}
+		if a.Index != b.Index {
+			return a.Index < b.Index
+		}
+		return a.Name < b.Name
+	})
+	return stats
+}
+
+// stepFailure is the number of failures of one step with one category of
+// error.
+type stepFailure struct {
+	Step     string `json:"step"`
+	Category string `json:"category"`
+	Failures int64  `json:"failures"`
+}
+
+// summarizeStepFailures lists the failures by step and error category, most
+// frequent first.
+func summarizeStepFailures(failures map[string]map[string]int64) []stepFailure {
+	var stats []stepFailure
+	for step, categories := range failures {
+		for category, n := range categories {
+			stats = append(stats, stepFailure{Step: step, Category: category, Failures: n})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.Failures != b.Failures {
+			return a.Failures > b.Failures
+		}
+		if a.Step != b.Step {
+			return a.Step < b.Step
+		}
+		return a.Category < b.Category
+	})
+	return stats
+}
+
+// logFailureBreakdown prints the failures in m by step and error category.
+func logFailureBreakdown(m Metrics) {
+	failures := summarizeStepFailures(m.StepFailures)
+	if len(failures) == 0 {
+		return
+	}
+	log.Print("Failures by step:")
+	storeLog("Failures by step:")
+	for _, f := range failures {
+		msg := fmt.Sprintf("  %6d  %s: %s", f.Failures, f.Step, f.Category)
+		log.Print(msg)
+		storeLog(msg)
+	}
+}
+
+// rateWindows are the windows the dashboard reports workflow rates over.
+var rateWindows = []time.Duration{10 * time.Second, time.Minute, histogram.SeriesWindow}
+
+// rateStats is the rate of completed and failed workflows over one window.
+type rateStats struct {
+	Window    string  `json:"window"`
+	Completed float64 `json:"completed"` // Per second
+	Failed    float64 `json:"failed"`    // Per second
+}
+
+// summarizeRates computes the workflow rates in m over each of rateWindows.
+func summarizeRates(m Metrics, now time.Time) []rateStats {
+	stats := make([]rateStats, len(rateWindows))
+	for i, window := range rateWindows {
+		stats[i] = rateStats{
+			Window:    window.String(),
+			Completed: m.Completions.Rate(now, window),
+			Failed:    m.Failures.Rate(now, window),
+		}
+	}
+	return stats
+}
+
+// thresholdCheck is the outcome of one threshold rule.
+type thresholdCheck struct {
+	Rule   string `json:"rule"`
+	Actual string `json:"actual"`
+	Passed bool   `json:"passed"`
+}
+
+// exitThresholdsFailed is the exit code of a run that broke a threshold.
+const exitThresholdsFailed = 99
+
+// thresholdCheckInterval is how often AbortOnBreach checks the thresholds.
+const thresholdCheckInterval = 5 * time.Second
+
+// thresholdsFailed is set when a run breaks a threshold.
+var thresholdsFailed int32
+
+// evaluateThresholds checks t against the results in m. While the run is
+// still going, MinCompleted is skipped, since it can only be met at the end,
+// and so are rules without results yet.
+func evaluateThresholds(t *Thresholds, m Metrics, final bool) []thresholdCheck {
+	completed := m.TotalWorkflowsCompleted
+	failed := m.TotalWorkflowsFailed
+
+	var checks []thresholdCheck
+	add := func(rule string, passed bool, actual string) {
+		checks = append(checks, thresholdCheck{Rule: rule, Actual: actual, Passed: passed})
+	}
+	if t.MaxErrorRate != nil {
+		rule := fmt.Sprintf("error rate <= %g%%", *t.MaxErrorRate)
+		if finished := completed + failed; finished > 0 {
+			rate := float64(failed) * 100 / float64(finished)
+			add(rule, rate <= *t.MaxErrorRate, fmt.Sprintf("%.2f%% (%d of %d failed)", rate, failed, finished))
+		} else if final {
+			add(rule, false, "no workflows finished")
+		}
+	}
+	p95Check := func(rule string, durations *histogram.Histogram, limit float64) {
+		if durations == nil || durations.Count == 0 {
+			if final {
+				add(rule, false, "no durations recorded")
+			}
+			return
+		}
+		p95 := durations.Quantile(0.95)
+		add(rule, p95 <= limit, fmt.Sprintf("%.3fs", p95))
+	}
+	if t.MaxP95Duration > 0 {
+		p95Check(fmt.Sprintf("p95 workflow duration <= %gs", t.MaxP95Duration), m.Durations, t.MaxP95Duration)
+	}
+	names := make([]string, 0, len(t.MaxTransactionP95))
+	for name := range t.MaxTransactionP95 {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p95Check(fmt.Sprintf("p95 %s duration <= %gs", name, t.MaxTransactionP95[name]), m.Transactions[name], t.MaxTransactionP95[name])
+	}
+	if t.MinCompleted > 0 && final {
+		add(fmt.Sprintf("completed >= %d", t.MinCompleted), completed >= t.MinCompleted, strconv.FormatInt(completed, 10))
+	}
+	return checks
+}
+
+// checkThresholds evaluates the thresholds against the results of a finished
+// run, prints a summary, records whether any were broken and returns the
+// checks.
+func checkThresholds(t *Thresholds, m Metrics) []thresholdCheck {
+	checks := evaluateThresholds(t, m, true)
+	passed := 0
+	log.Print("Thresholds:")
+	storeLog("Thresholds:")
+	for _, c := range checks {
+		result := "PASS"
+		if c.Passed {
+			passed++
+		} else {
+			result = "FAIL"
+		}
+		msg := fmt.Sprintf("  %s  %s: %s", result, c.Rule, c.Actual)
+		log.Print(msg)
+		storeLog(msg)
+	}
+	msg := fmt.Sprintf("%d of %d thresholds passed", passed, len(checks))
+	log.Print(msg)
+	storeLog(msg)
+	if passed < len(checks) {
+		atomic.StoreInt32(&thresholdsFailed, 1)
+	}
+	return checks
+}
+
+// watchThresholds checks the thresholds against results while the run goes
+// and stops it on the first breach.
+func watchThresholds(t *Thresholds, results func() Metrics) {
+	minWorkflows := t.AbortMinWorkflows
+	if minWorkflows == 0 {
+		minWorkflows = 10
+	}
+	for {
+		select {
+		case <-stopRun:
+			return
+		case <-time.After(thresholdCheckInterval):
+		}
+		m := results()
+		if m.TotalWorkflowsCompleted+m.TotalWorkflowsFailed < minWorkflows {
+			continue
+		}
+		for _, c := range evaluateThresholds(t, m, false) {
+			if !c.Passed {
+				atomic.StoreInt32(&thresholdsFailed, 1)
+				requestStop(fmt.Sprintf("Threshold %s broken with %s", c.Rule, c.Actual), nil)
+				return
+			}
+		}
+	}
 }
 
 func updateMetricsFile() {
@@ -1147,78 +3704,142 @@ func updateMetricsFile() {
 	cpuHistory = append(cpuHistory, hostCPU)
 	memHistory = append(memHistory, hostMem)
 	mutex.Unlock()
+	metrics := currentMetrics()
+	writeMetricsFile(fmt.Sprintf("metrics_%d.json", metrics.PID), metrics)
+}
+
+// currentMetrics returns the results of this process so far.
+func currentMetrics() Metrics {
 	timingsMutex.Lock()
-	durationsCopy := make([]float64, len(workflowDurations))
-	copy(durationsCopy, workflowDurations)
+	durationsCopy := workflowDurations.Copy()
+	transactionsCopy := make(map[string]*histogram.Histogram, len(transactionDurations))
+	for name, durations := range transactionDurations {
+		transactionsCopy[name] = durations.Copy()
+	}
+	completionsCopy := completedSeries.Copy()
+	failuresCopy := failedSeries.Copy()
+	stepTypesCopy := copyStepMetrics(stepTypeMetrics)
+	stepsCopy := copyStepMetrics(stepMetrics)
+	stepFailuresCopy := make(map[string]map[string]int64, len(stepFailures))
+	for name, categories := range stepFailures {
+		stepFailuresCopy[name] = make(map[string]int64, len(categories))
+		for category, n := range categories {
+			stepFailuresCopy[name][category] = n
+		}
+	}
 	timingsMutex.Unlock()
-	pid := os.Getpid()
+	failureScreensMutex.Lock()
+	failureScreensCopy := make(map[string]int64, len(failureScreens))
+	for name, count := range failureScreens {
+		failureScreensCopy[name] = count
+	}
+	failureScreensMutex.Unlock()
+	mutex.Lock()
+	cpuCopy := append([]float64(nil), cpuHistory...)
+	memCopy := append([]float64(nil), memHistory...)
+	mutex.Unlock()
 	// Get the entire command-line arguments except the program name
 	args := os.Args[1:]
-	parameters := strings.Join(args, " ")
-	metrics := Metrics{
-		PID:                     pid,
+	parameters := secrets.Redact(strings.Join(args, " "))
+	return Metrics{
+		PID:                     os.Getpid(),
 		ActiveWorkflows:         getActiveWorkflows(),
 		TotalWorkflowsStarted:   atomic.LoadInt64(&totalWorkflowsStarted),
 		TotalWorkflowsCompleted: atomic.LoadInt64(&totalWorkflowsCompleted),
 		TotalWorkflowsFailed:    atomic.LoadInt64(&totalWorkflowsFailed),
+		TotalIterationsDropped:  atomic.LoadInt64(&totalIterationsDropped),
 		Durations:               durationsCopy,
-		CPUUsage:                cpuHistory,
-		MemoryUsage:             memHistory,
+		Transactions:            transactionsCopy,
+		Completions:             completionsCopy,
+		Failures:                failuresCopy,
+		StepTypes:               stepTypesCopy,
+		Steps:                   stepsCopy,
+		StepFailures:            stepFailuresCopy,
+		FailureScreens:          failureScreensCopy,
+		CPUUsage:                cpuCopy,
+		MemoryUsage:             memCopy,
 		Params:                  parameters,
+		Sessions:                currentSessions(),
 	}
-	data, err := json.Marshal(metrics)
-	if err != nil {
-		log.Printf("Error marshaling metrics for pid %d: %v", pid, err)
-		return
-	}
+}
+
+// metricsDir returns the directory the dashboard reads metrics files from.
+func metricsDir() string {
 	dashboardDir, err := os.UserConfigDir()
 	if err != nil {
 		log.Printf("Error fetching user config directory: %v", err)
-		dashboardDir = filepath.Join(".", "dashboard")
-	} else {
-		dashboardDir = filepath.Join(dashboardDir, "3270Connect", "dashboard")
+		return filepath.Join(".", "dashboard")
+	}
+	return filepath.Join(dashboardDir, "3270Connect", "dashboard")
+}
+
+// writeMetricsFile writes metrics to the dashboard directory as name.
+func writeMetricsFile(name string, metrics Metrics) {
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		log.Printf("Error marshaling metrics for pid %d: %v", metrics.PID, err)
+		return
 	}
+	dashboardDir := metricsDir()
 	os.MkdirAll(dashboardDir, 0755)
-	filePath := filepath.Join(dashboardDir, fmt.Sprintf("metrics_%d.json", pid))
+	filePath := filepath.Join(dashboardDir, name)
 	if err := ioutil.WriteFile(filePath, data, 0644); err != nil {
-		log.Printf("Error writing metrics file for pid %d: %v", pid, err)
+		log.Printf("Error writing metrics file for pid %d: %v", metrics.PID, err)
 	}
 }
 
+// aggregateMetrics adds up the results in every metrics file.
 func aggregateMetrics() Metrics {
-	dashboardDir, err := os.UserConfigDir()
-	if err != nil {
-		log.Printf("Error fetching user config directory: %v", err)
-		dashboardDir = filepath.Join(".", "dashboard")
-	} else {
-		dashboardDir = filepath.Join(dashboardDir, "3270Connect", "dashboard")
+	var agg Metrics
+	for _, m := range readMetricsFiles() {
+		agg.add(m)
 	}
-	files, err := filepath.Glob(filepath.Join(dashboardDir, "metrics_*.json"))
-	if err != nil {
-		log.Printf("Error listing metrics files: %v", err)
-		return Metrics{}
+	return agg
+}
+
+// add adds the results in m to those in agg.
+func (agg *Metrics) add(m Metrics) {
+	agg.TotalWorkflowsStarted += m.TotalWorkflowsStarted
+	agg.TotalWorkflowsCompleted += m.TotalWorkflowsCompleted
+	agg.TotalWorkflowsFailed += m.TotalWorkflowsFailed
+	agg.TotalIterationsDropped += m.TotalIterationsDropped
+	agg.ActiveWorkflows += m.ActiveWorkflows
+	if agg.Durations == nil {
+		agg.Durations = &histogram.Histogram{}
 	}
-	var agg Metrics
-	for _, f := range files {
-		data, err := ioutil.ReadFile(f)
-		if err != nil {
-			log.Printf("Error reading file %s: %v", f, err)
-			continue
+	agg.Durations.Merge(m.Durations)
+	for name, durations := range m.Transactions {
+		if agg.Transactions == nil {
+			agg.Transactions = map[string]*histogram.Histogram{}
 		}
-		var m Metrics
-		if err := json.Unmarshal(data, &m); err != nil {
-			log.Printf("Error unmarshaling file %s: %v", f, err)
-			continue
+		if agg.Transactions[name] == nil {
+			agg.Transactions[name] = &histogram.Histogram{}
 		}
-		agg.TotalWorkflowsStarted += m.TotalWorkflowsStarted
-		agg.TotalWorkflowsCompleted += m.TotalWorkflowsCompleted
-		agg.TotalWorkflowsFailed += m.TotalWorkflowsFailed
-		agg.ActiveWorkflows += m.ActiveWorkflows
-		agg.Durations = append(agg.Durations, m.Durations...)
-		agg.CPUUsage = append(agg.CPUUsage, m.CPUUsage...)
-		agg.MemoryUsage = append(agg.MemoryUsage, m.MemoryUsage...)
+		agg.Transactions[name].Merge(durations)
 	}
-	return agg
+	agg.Completions.Merge(m.Completions)
+	agg.Failures.Merge(m.Failures)
+	mergeStepMetrics(&agg.StepTypes, m.StepTypes)
+	mergeStepMetrics(&agg.Steps, m.Steps)
+	for name, categories := range m.StepFailures {
+		if agg.StepFailures == nil {
+			agg.StepFailures = map[string]map[string]int64{}
+		}
+		if agg.StepFailures[name] == nil {
+			agg.StepFailures[name] = map[string]int64{}
+		}
+		for category, n := range categories {
+			agg.StepFailures[name][category] += n
+		}
+	}
+	for name, count := range m.FailureScreens {
+		if agg.FailureScreens == nil {
+			agg.FailureScreens = map[string]int64{}
+		}
+		agg.FailureScreens[name] += count
+	}
+	agg.CPUUsage = append(agg.CPUUsage, m.CPUUsage...)
+	agg.MemoryUsage = append(agg.MemoryUsage, m.MemoryUsage...)
 }
 
 func monitorSystemUsage() {
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/3270io/3270Connect/histogram"
+)
+
+// writeFile writes data to name in a temporary directory and returns its path.
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestNormalizeJSON(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`{"a": 1}`, `{"a": 1}`},
+		{"{\"a\": 1} // note", "{\"a\": 1}        "},
+		{"// first\n{}", "        \n{}"},
+		{"{/* a\nb */}", "{    \n    }"},
+		{`{"url": "http://host/a"}`, `{"url": "http://host/a"}`},
+		{`{"a": "/* not a comment */"}`, `{"a": "/* not a comment */"}`},
+		{`{"a": "x\/y \"q\""}`, `{"a": "x/y \"q\""}`},
+	}
+	for _, tt := range tests {
+		if got := string(normalizeJSON([]byte(tt.in))); got != tt.want {
+			t.Errorf("normalizeJSON(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestReadConfigurations(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		want    []string // Host of each workflow
+		wantErr string
+	}{
+		{
+			name: "JSON with comments",
+			file: "workflow.json",
+			data: "{\n  // The host\n  \"Host\": \"a\", /* port */ \"Port\": 23,\n  \"Steps\": [{\"Type\": \"Connect\"}]\n}",
+			want: []string{"a"},
+		},
+		{
+			name: "JSON keys in any case",
+			file: "workflow.json",
+			data: `{"host": "a", "PORT": 23, "steps": [{"type": "Connect", "coordinates": {"row": 1}}]}`,
+			want: []string{"a"},
+		},
+		{
+			name: "JSON list",
+			file: "workflows.json",
+			data: `[{"Name": "one", "Host": "a"}, {"Name": "two", "Host": "b"}]`,
+			want: []string{"a", "b"},
+		},
+		{
+			name: "YAML documents",
+			file: "workflows.yaml",
+			data: "Name: one\nHost: a\n---\nName: two\nHost: b\n",
+			want: []string{"a", "b"},
+		},
+		{
+			name: "YAML list",
+			file: "workflows.yml",
+			data: "- Host: a\n- Host: b\n",
+			want: []string{"a", "b"},
+		},
+		{
+			name:    "YAML keys match exactly",
+			file:    "workflow.yaml",
+			data:    "host: a\n",
+			wantErr: "line 1: field host not found",
+		},
+		{
+			name:    "unknown JSON field",
+			file:    "workflow.json",
+			data:    "{\n  \"Host\": \"a\",\n  \"Hots\": \"b\"\n}",
+			wantErr: "line 3: field Hots not found",
+		},
+		{
+			name:    "unknown step field",
+			file:    "workflow.yaml",
+			data:    "Host: a\nSteps:\n  - Type: FillString\n    Txt: x\n",
+			wantErr: "line 4: field Txt not found in type main.Step",
+		},
+		{
+			name:    "empty",
+			file:    "workflow.yaml",
+			data:    "",
+			wantErr: "no workflow defined",
+		},
+	}
+	for _, tt := range tests {
+		configs, err := readConfigurations(writeFile(t, tt.file, tt.data))
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error = %v, want one containing %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		var hosts []string
+		for _, c := range configs {
+			hosts = append(hosts, c.Host)
+		}
+		if strings.Join(hosts, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: hosts = %v, want %v", tt.name, hosts, tt.want)
+		}
+	}
+}
+
+func TestReadConfigurationsKeepsMapKeys(t *testing.T) {
+	configs, err := readConfigurations(writeFile(t, "workflow.json", `{"thresholds": {"maxtransactionp95": {"logon": 2}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := configs[0].Thresholds.MaxTransactionP95; got["logon"] != 2 || len(got) != 1 {
+		t.Errorf("MaxTransactionP95 = %v, want the transaction name as written", got)
+	}
+}
+
+func TestSelectConfiguration(t *testing.T) {
+	configs := []Configuration{{Name: "one", Host: "a"}, {Name: "two", Host: "b"}}
+	if c, err := selectConfiguration(configs, "two"); err != nil || c.Host != "b" {
+		t.Errorf("selecting two gave %v, %v", c, err)
+	}
+	if _, err := selectConfiguration(configs, ""); err == nil || !strings.Contains(err.Error(), "one, two") {
+		t.Errorf("selecting nothing from two workflows gave %v, want an error listing them", err)
+	}
+	if _, err := selectConfiguration(configs, "three"); err == nil {
+		t.Error("selecting an unknown workflow succeeded")
+	}
+	if c, err := selectConfiguration(configs[:1], ""); err != nil || c.Host != "a" {
+		t.Errorf("selecting the only workflow gave %v, %v", c, err)
+	}
+}
+
+func TestLoadProfileTarget(t *testing.T) {
+	p := newLoadProfile(&Configuration{Stages: []Stage{
+		{Duration: 10, Target: 10},
+		{Duration: 20, Target: 10},
+		{Duration: 10, Target: 0},
+		{Duration: 10, Target: 4, Interpolation: "step"},
+	}})
+	if p.rate {
+		t.Fatal("stages with targets were read as arrival rates")
+	}
+	if got := p.duration(); got.Seconds() != 50 {
+		t.Errorf("duration() = %v, want 50s", got)
+	}
+	tests := []struct {
+		elapsed float64
+		want    float64
+	}{
+		{0, 0},
+		{5, 5},
+		{10, 10},
+		{25, 10},
+		{35, 5},
+		{40, 4},
+		{45, 4},
+		{100, 4},
+	}
+	for _, tt := range tests {
+		if got := p.target(tt.elapsed); got != tt.want {
+			t.Errorf("target(%v) = %v, want %v", tt.elapsed, got, tt.want)
+		}
+	}
+}
+
+func TestLoadProfileArrivals(t *testing.T) {
+	p := newLoadProfile(&Configuration{ArrivalRateUnit: "minute", Stages: []Stage{
+		{Duration: 60, Rate: 60},
+		{Duration: 60, Rate: 60},
+		{Duration: 60, Rate: 120, Interpolation: "step"},
+	}})
+	if !p.rate || p.per != "minute" {
+		t.Fatalf("profile is %+v, want arrival rates per minute", p)
+	}
+	tests := []struct {
+		elapsed float64
+		target  float64 // Arrivals per second
+		due     float64
+	}{
+		{0, 0, 0},
+		{30, 0.5, 7.5},
+		{60, 1, 30},
+		{90, 1, 60},
+		{120, 2, 90},
+		{150, 2, 150},
+		{180, 2, 210},
+		{240, 2, 210},
+	}
+	for _, tt := range tests {
+		if got := p.target(tt.elapsed); got != tt.target {
+			t.Errorf("target(%v) = %v, want %v", tt.elapsed, got, tt.target)
+		}
+		if got := p.arrivals(tt.elapsed); got != tt.due {
+			t.Errorf("arrivals(%v) = %v, want %v", tt.elapsed, got, tt.due)
+		}
+	}
+}
+
+func TestLoadProfileConstantArrivalRate(t *testing.T) {
+	saved := runtimeDuration
+	defer func() { runtimeDuration = saved }()
+	runtimeDuration = 10
+	p := newLoadProfile(&Configuration{ArrivalRate: 3})
+	if !p.rate || p.per != "second" || p.duration().Seconds() != 10 {
+		t.Fatalf("profile is %+v, want 3 arrivals per second for 10s", p)
+	}
+	for _, elapsed := range []float64{0, 4, 10} {
+		if got := p.target(elapsed); got != 3 {
+			t.Errorf("target(%v) = %v, want 3", elapsed, got)
+		}
+		if got := p.arrivals(elapsed); got != 3*elapsed {
+			t.Errorf("arrivals(%v) = %v, want %v", elapsed, got, 3*elapsed)
+		}
+	}
+}
+
+// durations returns a histogram of the given durations in milliseconds.
+func durations(ms ...int) *histogram.Histogram {
+	h := &histogram.Histogram{}
+	for _, d := range ms {
+		h.Record(time.Duration(d) * time.Millisecond)
+	}
+	return h
+}
+
+func TestEvaluateThresholds(t *testing.T) {
+	maxErrorRate := 10.0
+	thresholds := &Thresholds{
+		MaxErrorRate:      &maxErrorRate,
+		MaxP95Duration:    1,
+		MaxTransactionP95: map[string]float64{"search": 0.5, "logon": 2},
+		MinCompleted:      9,
+	}
+	tests := []struct {
+		name    string
+		metrics Metrics
+		final   bool
+		want    []thresholdCheck
+	}{
+		{
+			name: "all passed",
+			metrics: Metrics{
+				TotalWorkflowsCompleted: 9,
+				TotalWorkflowsFailed:    1,
+				Durations:               durations(500, 600, 700),
+				Transactions:            map[string]*histogram.Histogram{"logon": durations(1000), "search": durations(100, 200)},
+			},
+			final: true,
+			want: []thresholdCheck{
+				{Rule: "error rate <= 10%", Actual: "10.00% (1 of 10 failed)", Passed: true},
+				{Rule: "p95 workflow duration <= 1s", Actual: "0.698s", Passed: true}, // 700ms to within the histogram's precision
+				{Rule: "p95 logon duration <= 2s", Actual: "1.000s", Passed: true},
+				{Rule: "p95 search duration <= 0.5s", Actual: "0.200s", Passed: true},
+				{Rule: "completed >= 9", Actual: "9", Passed: true},
+			},
+		},
+		{
+			name: "all broken",
+			metrics: Metrics{
+				TotalWorkflowsCompleted: 2,
+				TotalWorkflowsFailed:    2,
+				Durations:               durations(1500),
+				Transactions:            map[string]*histogram.Histogram{"logon": durations(3000), "search": durations(600)},
+			},
+			final: true,
+			want: []thresholdCheck{
+				{Rule: "error rate <= 10%", Actual: "50.00% (2 of 4 failed)", Passed: false},
+				{Rule: "p95 workflow duration <= 1s", Actual: "1.500s", Passed: false},
+				{Rule: "p95 logon duration <= 2s", Actual: "3.000s", Passed: false},
+				{Rule: "p95 search duration <= 0.5s", Actual: "0.600s", Passed: false},
+				{Rule: "completed >= 9", Actual: "2", Passed: false},
+			},
+		},
+		{
+			name:  "nothing finished at the end",
+			final: true,
+			want: []thresholdCheck{
+				{Rule: "error rate <= 10%", Actual: "no workflows finished", Passed: false},
+				{Rule: "p95 workflow duration <= 1s", Actual: "no durations recorded", Passed: false},
+				{Rule: "p95 logon duration <= 2s", Actual: "no durations recorded", Passed: false},
+				{Rule: "p95 search duration <= 0.5s", Actual: "no durations recorded", Passed: false},
+				{Rule: "completed >= 9", Actual: "0", Passed: false},
+			},
+		},
+		{
+			// While running, rules without data yet and MinCompleted are
+			// not checked.
+			name: "while running",
+			metrics: Metrics{
+				TotalWorkflowsCompleted: 1,
+				Durations:               durations(2000),
+			},
+			want: []thresholdCheck{
+				{Rule: "error rate <= 10%", Actual: "0.00% (0 of 1 failed)", Passed: true},
+				{Rule: "p95 workflow duration <= 1s", Actual: "2.000s", Passed: false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := evaluateThresholds(thresholds, tt.metrics, tt.final); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: evaluateThresholds =\n%+v\nwant\n%+v", tt.name, got, tt.want)
+		}
+	}
+	if got := evaluateThresholds(&Thresholds{}, Metrics{}, true); len(got) != 0 {
+		t.Errorf("empty thresholds gave checks %+v", got)
+	}
+}
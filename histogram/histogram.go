@@ -0,0 +1,196 @@
+// Package histogram records durations in fixed-size, mergeable histograms in
+// the style of HdrHistogram, so that percentiles can be reported for any
+// number of samples, and across processes, without keeping every sample.
+package histogram
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"time"
+)
+
+// subBuckets is the number of buckets for each power of two. Values are kept
+// in microseconds to within 1/subBuckets, under 1%, of their true value.
+const subBuckets = 128
+
+// subBucketBits is log2(subBuckets).
+const subBucketBits = 7
+
+// Histogram counts durations in logarithmic buckets. The zero value is
+// empty and ready to use. A Histogram is not safe for concurrent use.
+type Histogram struct {
+	Count   int64         `json:"count"`
+	Sum     int64         `json:"sum"` // Microseconds
+	Min     int64         `json:"min"` // Microseconds
+	Max     int64         `json:"max"` // Microseconds
+	Buckets map[int]int64 `json:"buckets,omitempty"`
+}
+
+// Summary is the statistics of a histogram in seconds.
+type Summary struct {
+	Count int64   `json:"count"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+}
+
+// bucket returns the index of the bucket that holds v microseconds. Values
+// below subBuckets have a bucket each; above that every power of two is split
+// into subBuckets buckets.
+func bucket(v int64) int {
+	if v < subBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(uint64(v)) - subBucketBits - 1
+	return (shift+1)*subBuckets + int(v>>uint(shift)) - subBuckets
+}
+
+// bucketRange returns the lowest and highest value held by bucket i.
+func bucketRange(i int) (int64, int64) {
+	if i < subBuckets {
+		return int64(i), int64(i)
+	}
+	shift := uint(i/subBuckets - 1)
+	m := int64(i%subBuckets + subBuckets)
+	return m << shift, (m+1)<<shift - 1
+}
+
+// Record adds a duration.
+func (h *Histogram) Record(d time.Duration) {
+	v := d.Microseconds()
+	if v < 0 {
+		v = 0
+	}
+	if h.Buckets == nil {
+		h.Buckets = map[int]int64{}
+	}
+	if h.Count == 0 || v < h.Min {
+		h.Min = v
+	}
+	if v > h.Max {
+		h.Max = v
+	}
+	h.Count++
+	h.Sum += v
+	h.Buckets[bucket(v)]++
+}
+
+// Merge adds the durations recorded in o.
+func (h *Histogram) Merge(o *Histogram) {
+	if o == nil || o.Count == 0 {
+		return
+	}
+	if h.Buckets == nil {
+		h.Buckets = map[int]int64{}
+	}
+	if h.Count == 0 || o.Min < h.Min {
+		h.Min = o.Min
+	}
+	if o.Max > h.Max {
+		h.Max = o.Max
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+	for i, n := range o.Buckets {
+		h.Buckets[i] += n
+	}
+}
+
+// Copy returns a copy of h that shares nothing with it.
+func (h *Histogram) Copy() *Histogram {
+	c := &Histogram{}
+	c.Merge(h)
+	return c
+}
+
+// Quantile returns the duration in seconds that a fraction q of the recorded
+// durations are at or below, or 0 if none were recorded.
+func (h *Histogram) Quantile(q float64) float64 {
+	if h == nil || h.Count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	indexes := make([]int, 0, len(h.Buckets))
+	for i := range h.Buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	var seen int64
+	for _, i := range indexes {
+		seen += h.Buckets[i]
+		if seen >= rank {
+			low, high := bucketRange(i)
+			v := (low + high) / 2
+			if v < h.Min {
+				v = h.Min
+			}
+			if v > h.Max {
+				v = h.Max
+			}
+			return seconds(v)
+		}
+	}
+	return seconds(h.Max)
+}
+
+// CountAtOrBelow returns how many of the recorded durations are at or below
+// d, to within the precision of the buckets.
+func (h *Histogram) CountAtOrBelow(d time.Duration) int64 {
+	if h == nil {
+		return 0
+	}
+	limit := bucket(d.Microseconds())
+	var n int64
+	for i, count := range h.Buckets {
+		if i <= limit {
+			n += count
+		}
+	}
+	return n
+}
+
+// SumSeconds returns the sum of the recorded durations in seconds.
+func (h *Histogram) SumSeconds() float64 {
+	if h == nil {
+		return 0
+	}
+	return seconds(h.Sum)
+}
+
+// Mean returns the mean duration in seconds, or 0 if none were recorded.
+func (h *Histogram) Mean() float64 {
+	if h == nil || h.Count == 0 {
+		return 0
+	}
+	return seconds(h.Sum) / float64(h.Count)
+}
+
+// Summarize returns the statistics of the recorded durations.
+func (h *Histogram) Summarize() Summary {
+	if h == nil || h.Count == 0 {
+		return Summary{}
+	}
+	return Summary{
+		Count: h.Count,
+		Min:   seconds(h.Min),
+		Max:   seconds(h.Max),
+		Mean:  h.Mean(),
+		P50:   h.Quantile(0.50),
+		P90:   h.Quantile(0.90),
+		P95:   h.Quantile(0.95),
+		P99:   h.Quantile(0.99),
+	}
+}
+
+// seconds converts microseconds to seconds.
+func seconds(us int64) float64 {
+	return float64(us) / 1e6
+}
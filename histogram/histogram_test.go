@@ -0,0 +1,176 @@
+package histogram
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBucket(t *testing.T) {
+	tests := []struct {
+		v      int64
+		bucket int
+	}{
+		{0, 0},
+		{1, 1},
+		{127, 127},
+		{128, 128},
+		{255, 255},
+		{256, 256},
+		{257, 256},
+		{511, 383},
+		{512, 384},
+		{1000000, 1780},
+	}
+	for _, tt := range tests {
+		if got := bucket(tt.v); got != tt.bucket {
+			t.Errorf("bucket(%d) = %d, want %d", tt.v, got, tt.bucket)
+		}
+	}
+}
+
+func TestBucketRange(t *testing.T) {
+	for _, v := range []int64{0, 5, 127, 128, 200, 4095, 4096, 123456, 3600000000} {
+		low, high := bucketRange(bucket(v))
+		if v < low || v > high {
+			t.Errorf("bucketRange(bucket(%d)) = %d..%d, which does not hold %d", v, low, high, v)
+		}
+		if width := float64(high - low + 1); width/float64(v+1) > 0.01 && v >= subBuckets {
+			t.Errorf("bucket of %d is %v wide, more than 1%%", v, width)
+		}
+		if high+1 <= math.MaxInt64/2 && bucket(high+1) != bucket(v)+1 {
+			t.Errorf("the bucket after %d..%d is %d, want %d", low, high, bucket(high+1), bucket(v)+1)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	var h Histogram
+	for ms := 1; ms <= 1000; ms++ {
+		h.Record(time.Duration(ms) * time.Millisecond)
+	}
+	tests := []struct {
+		q    float64
+		want float64
+	}{
+		{0, 0.001},
+		{0.5, 0.5},
+		{0.9, 0.9},
+		{0.95, 0.95},
+		{0.99, 0.99},
+		{1, 1},
+	}
+	for _, tt := range tests {
+		if got := h.Quantile(tt.q); math.Abs(got-tt.want) > tt.want*0.01 {
+			t.Errorf("Quantile(%v) = %v, want %v to within 1%%", tt.q, got, tt.want)
+		}
+	}
+	if got := h.Mean(); math.Abs(got-0.5005) > 1e-9 {
+		t.Errorf("Mean() = %v, want 0.5005", got)
+	}
+}
+
+func TestQuantileEmpty(t *testing.T) {
+	var h *Histogram
+	if got := h.Quantile(0.5); got != 0 {
+		t.Errorf("Quantile of a nil histogram = %v, want 0", got)
+	}
+	if got := (&Histogram{}).Summarize(); got != (Summary{}) {
+		t.Errorf("Summarize of an empty histogram = %+v, want the zero Summary", got)
+	}
+}
+
+func TestQuantileClampedToMinAndMax(t *testing.T) {
+	var h Histogram
+	h.Record(1000 * time.Microsecond)
+	for _, q := range []float64{0, 0.5, 1} {
+		if got := h.Quantile(q); got != 0.001 {
+			t.Errorf("Quantile(%v) of a single 1ms sample = %v, want 0.001", q, got)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	var all, odd, even Histogram
+	for ms := 1; ms <= 500; ms++ {
+		d := time.Duration(ms) * time.Millisecond
+		all.Record(d)
+		if ms%2 == 1 {
+			odd.Record(d)
+		} else {
+			even.Record(d)
+		}
+	}
+	merged := odd.Copy()
+	merged.Merge(&even)
+	merged.Merge(nil)
+	merged.Merge(&Histogram{})
+	if !reflect.DeepEqual(*merged, all) {
+		t.Errorf("merging the odd and even samples gave %+v, want %+v", merged.Summarize(), all.Summarize())
+	}
+	if odd.Count != 250 {
+		t.Errorf("Merge changed the histogram that was copied: Count = %d, want 250", odd.Count)
+	}
+}
+
+func TestCountAtOrBelow(t *testing.T) {
+	var h Histogram
+	for _, ms := range []int{10, 20, 30, 40} {
+		h.Record(time.Duration(ms) * time.Millisecond)
+	}
+	tests := []struct {
+		d    time.Duration
+		want int64
+	}{
+		{5 * time.Millisecond, 0},
+		{10 * time.Millisecond, 1},
+		{25 * time.Millisecond, 2},
+		{time.Second, 4},
+	}
+	for _, tt := range tests {
+		if got := h.CountAtOrBelow(tt.d); got != tt.want {
+			t.Errorf("CountAtOrBelow(%v) = %d, want %d", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestSeriesRate(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	var s Series
+	for i := 0; i < 60; i++ {
+		s.Add(now.Add(-time.Duration(i) * time.Second))
+	}
+	s.Add(now.Add(-10 * time.Minute))
+	tests := []struct {
+		window time.Duration
+		want   float64
+	}{
+		{0, 1},
+		{10 * time.Second, 1},
+		{time.Minute, 1},
+		{2 * time.Minute, 0.5},
+		{time.Hour, 0.2},
+	}
+	for _, tt := range tests {
+		if got := s.Rate(now, tt.window); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("Rate(%v) = %v, want %v", tt.window, got, tt.want)
+		}
+	}
+}
+
+func TestSeriesMerge(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	var a, b Series
+	a.Add(now)
+	b.Add(now)
+	b.Add(now.Add(-time.Second))
+	merged := a.Copy()
+	merged.Merge(b)
+	if got := merged.Rate(now, 2*time.Second); got != 1.5 {
+		t.Errorf("Rate of the merged series = %v, want 1.5", got)
+	}
+	if got := a.Rate(now, 2*time.Second); got != 0.5 {
+		t.Errorf("Merge changed the series that was copied: Rate = %v, want 0.5", got)
+	}
+}
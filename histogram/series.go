@@ -0,0 +1,73 @@
+package histogram
+
+import "time"
+
+// SeriesWindow is how far back a Series keeps its counts.
+const SeriesWindow = 5 * time.Minute
+
+// Series counts events per second over the last SeriesWindow, so that rates
+// over shorter windows can be reported and series from several processes
+// merged. The zero value is empty and ready to use. A Series is not safe for
+// concurrent use.
+type Series struct {
+	Counts map[int64]int64 `json:"counts,omitempty"` // Unix second to count
+}
+
+// Add counts an event at t and forgets counts older than SeriesWindow.
+func (s *Series) Add(t time.Time) {
+	if s.Counts == nil {
+		s.Counts = map[int64]int64{}
+	}
+	s.Counts[t.Unix()]++
+	s.prune(t)
+}
+
+// prune forgets counts older than SeriesWindow before now.
+func (s *Series) prune(now time.Time) {
+	oldest := now.Add(-SeriesWindow).Unix()
+	for sec := range s.Counts {
+		if sec <= oldest {
+			delete(s.Counts, sec)
+		}
+	}
+}
+
+// Merge adds the counts in o.
+func (s *Series) Merge(o Series) {
+	if len(o.Counts) == 0 {
+		return
+	}
+	if s.Counts == nil {
+		s.Counts = map[int64]int64{}
+	}
+	for sec, n := range o.Counts {
+		s.Counts[sec] += n
+	}
+}
+
+// Copy returns a copy of s that shares nothing with it.
+func (s Series) Copy() Series {
+	var c Series
+	c.Merge(s)
+	return c
+}
+
+// Rate returns the events per second over the window before now. Windows
+// longer than SeriesWindow are cut to it.
+func (s Series) Rate(now time.Time, window time.Duration) float64 {
+	if window > SeriesWindow {
+		window = SeriesWindow
+	}
+	if window < time.Second {
+		window = time.Second
+	}
+	newest := now.Unix()
+	oldest := now.Add(-window).Unix()
+	var n int64
+	for sec, count := range s.Counts {
+		if sec > oldest && sec <= newest {
+			n += count
+		}
+	}
+	return float64(n) / window.Seconds()
+}
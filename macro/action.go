@@ -0,0 +1,163 @@
+// Package macro converts terminal macros and scripts written for other 3270
+// tools to and from a common list of actions that 3270Connect can turn into
+// workflow steps.
+package macro
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kind identifies what an Action does.
+type Kind int
+
+const (
+	// Text types Text at Row and Column, or at the cursor if they are 0.
+	Text Kind = iota
+	// Key presses Key.
+	Key
+	// Cursor moves the cursor to Row and Column.
+	Cursor
+	// WaitText waits up to Timeout for Text to appear at Row and Column.
+	WaitText
+	// WaitInputReady waits up to Timeout for the keyboard to unlock on an
+	// input field.
+	WaitInputReady
+	// Pause waits for Timeout.
+	Pause
+	// Capture saves the current screen to the output file.
+	Capture
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Text:
+		return "Text"
+	case Key:
+		return "Key"
+	case Cursor:
+		return "Cursor"
+	case WaitText:
+		return "WaitText"
+	case WaitInputReady:
+		return "WaitInputReady"
+	case Pause:
+		return "Pause"
+	case Capture:
+		return "Capture"
+	default:
+		return fmt.Sprintf("Kind(%d)", int(k))
+	}
+}
+
+// Action is a single macro operation.
+type Action struct {
+	Kind    Kind
+	Text    string
+	Key     string // Enter, Tab, Clear or PF1 to PF24
+	Row     int    // 1-based, 0 if not set
+	Column  int    // 1-based, 0 if not set
+	Timeout time.Duration
+	Secret  bool // Text was typed into a field that is not displayed
+	Line    int  // Source line the action came from
+}
+
+// Error reports a problem at a line of a macro file.
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// ErrorList is every problem found in a macro file.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// err returns l as an error, or nil if it is empty.
+func (l ErrorList) err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// NormalizeKey returns the canonical name of an attention or cursor key such
+// as "enter", "PF03" or "F3", and whether it is supported.
+func NormalizeKey(name string) (string, bool) {
+	upper := strings.ToUpper(strings.TrimSpace(name))
+	switch upper {
+	case "ENTER":
+		return "Enter", true
+	case "TAB":
+		return "Tab", true
+	case "CLEAR":
+		return "Clear", true
+	}
+	for _, prefix := range []string{"PF", "F"} {
+		if strings.HasPrefix(upper, prefix) {
+			n, err := strconv.Atoi(strings.TrimPrefix(upper, prefix))
+			if err == nil && n >= 1 && n <= 24 {
+				return fmt.Sprintf("PF%d", n), true
+			}
+		}
+	}
+	return "", false
+}
+
+// splitKeys splits s into Text and Key actions, treating names of keys
+// between open and close, such as [enter] or <Pf3>, as key presses. A doubled
+// open character stands for itself.
+func splitKeys(s string, open, close byte, line int) ([]Action, error) {
+	var actions []Action
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			actions = append(actions, Action{Kind: Text, Text: text.String(), Line: line})
+			text.Reset()
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != open {
+			text.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == open {
+			text.WriteByte(open)
+			i++
+			continue
+		}
+		end := strings.IndexByte(s[i:], close)
+		if end < 0 {
+			text.WriteByte(open)
+			continue
+		}
+		key, ok := NormalizeKey(s[i+1 : i+end])
+		if !ok {
+			return nil, fmt.Errorf("key %s is not supported", s[i:i+end+1])
+		}
+		flush()
+		actions = append(actions, Action{Kind: Key, Key: key, Line: line})
+		i += end
+	}
+	flush()
+	if len(actions) == 0 {
+		actions = []Action{{Kind: Text, Line: line}}
+	}
+	return actions, nil
+}
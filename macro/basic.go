@@ -0,0 +1,851 @@
+package macro
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// basicMethod converts a call to one of the terminal methods of a Basic
+// dialect.
+type basicMethod func(c *basicCall) error
+
+// basicCall is a method call being converted.
+type basicCall struct {
+	name   string // As written in the macro
+	args   []basicValue
+	line   int
+	script *Script
+	result basicValue
+}
+
+// basicValue is the result of evaluating a Basic expression while parsing.
+type basicValue struct {
+	kind   valueKind // keysValue holds plain text
+	text   string    // Text, or the name of a constantValue
+	number float64
+	line   int // Line of the call for runtimeValue
+}
+
+func (c *basicCall) add(actions ...Action) {
+	for _, a := range actions {
+		a.Line = c.line
+		c.script.Actions = append(c.script.Actions, a)
+	}
+}
+
+func (c *basicCall) has(i int) bool {
+	return i < len(c.args)
+}
+
+func (c *basicCall) text(i int) (string, error) {
+	if !c.has(i) {
+		return "", fmt.Errorf("%s needs at least %d argument(s)", c.name, i+1)
+	}
+	v := c.args[i]
+	switch v.kind {
+	case keysValue:
+		return v.text, nil
+	case numberValue:
+		return strconv.FormatFloat(v.number, 'f', -1, 64), nil
+	case runtimeValue:
+		return "", fmt.Errorf("the value read at line %d is only known when the macro runs and cannot be converted", v.line)
+	}
+	return "", fmt.Errorf("argument %d of %s is not text", i+1, c.name)
+}
+
+func (c *basicCall) number(i int) (int, error) {
+	if !c.has(i) {
+		return 0, fmt.Errorf("%s needs at least %d argument(s)", c.name, i+1)
+	}
+	v := c.args[i]
+	if v.kind == keysValue {
+		if n, err := strconv.ParseFloat(strings.TrimSpace(v.text), 64); err == nil {
+			return int(n), nil
+		}
+	}
+	if v.kind != numberValue {
+		return 0, fmt.Errorf("argument %d of %s is not a number", i+1, c.name)
+	}
+	return int(v.number), nil
+}
+
+// position reads a row and a column starting at argument i.
+func (c *basicCall) position(i int) (row, col int, err error) {
+	if row, err = c.number(i); err != nil {
+		return 0, 0, err
+	}
+	if col, err = c.number(i + 1); err != nil {
+		return 0, 0, err
+	}
+	return row, col, nil
+}
+
+// millis reads an optional timeout in milliseconds at argument i.
+func (c *basicCall) millis(i int) (time.Duration, error) {
+	if !c.has(i) {
+		return 0, nil
+	}
+	n, err := c.number(i)
+	return time.Duration(n) * time.Millisecond, err
+}
+
+// waitText adds a WaitText action, which needs a position.
+func (c *basicCall) waitText(text string, row, col int, timeout time.Duration) error {
+	if row <= 0 || col <= 0 {
+		return fmt.Errorf("%s without a position is not supported", c.name)
+	}
+	c.add(Action{Kind: WaitText, Text: text, Row: row, Column: col, Timeout: timeout})
+	return nil
+}
+
+func ignoreCall(c *basicCall) error {
+	return nil
+}
+
+func runtimeCall(c *basicCall) error {
+	c.result = basicValue{kind: runtimeValue, line: c.line}
+	return nil
+}
+
+func waitInputReadyCall(c *basicCall) error {
+	c.add(Action{Kind: WaitInputReady})
+	return nil
+}
+
+// pcommMethods are the IBM Personal Communications autECL methods.
+var pcommMethods = map[string]basicMethod{
+	"setconnectionbyname":   ignoreCall,
+	"setconnectionbyhandle": ignoreCall,
+	"startcommunication":    ignoreCall,
+	"stopcommunication":     ignoreCall,
+	"waitforappavailable":   ignoreCall,
+	"gettext":               runtimeCall,
+	"waitforinputready": func(c *basicCall) error {
+		timeout, err := c.millis(0)
+		c.add(Action{Kind: WaitInputReady, Timeout: timeout})
+		return err
+	},
+	"sendkeys": func(c *basicCall) error {
+		text, err := c.text(0)
+		if err != nil {
+			return err
+		}
+		if c.has(1) {
+			row, col, err := c.position(1)
+			if err != nil {
+				return err
+			}
+			c.add(Action{Kind: Cursor, Row: row, Column: col})
+		}
+		keys, err := splitKeys(text, '[', ']', c.line)
+		c.add(keys...)
+		return err
+	},
+	"setcursorpos": func(c *basicCall) error {
+		row, col, err := c.position(0)
+		c.add(Action{Kind: Cursor, Row: row, Column: col})
+		return err
+	},
+	"waitforcursor": func(c *basicCall) error {
+		row, col, err := c.position(0)
+		if err != nil {
+			return err
+		}
+		timeout, err := c.millis(2)
+		c.add(Action{Kind: WaitInputReady, Timeout: timeout}, Action{Kind: Cursor, Row: row, Column: col})
+		return err
+	},
+	"waitforstring": func(c *basicCall) error {
+		text, err := c.text(0)
+		if err != nil {
+			return err
+		}
+		if !c.has(2) {
+			return fmt.Errorf("%s without a position is not supported", c.name)
+		}
+		row, col, err := c.position(1)
+		if err != nil {
+			return err
+		}
+		timeout, err := c.millis(3)
+		if err != nil {
+			return err
+		}
+		return c.waitText(text, row, col, timeout)
+	},
+	"wait": func(c *basicCall) error {
+		pause, err := c.millis(0)
+		c.add(Action{Kind: Pause, Timeout: pause})
+		return err
+	},
+}
+
+// basicMethods are the Attachmate EXTRA! Screen methods and the Reflection
+// for IBM session methods.
+var basicMethods = map[string]basicMethod{
+	"connect":          ignoreCall,
+	"getstring":        runtimeCall,
+	"getdisplaytext":   runtimeCall,
+	"waithostquiet":    waitInputReadyCall,
+	"waitforkbdunlock": waitInputReadyCall,
+	"sendkeys": func(c *basicCall) error {
+		text, err := c.text(0)
+		if err != nil {
+			return err
+		}
+		keys, err := splitKeys(text, '<', '>', c.line)
+		c.add(keys...)
+		return err
+	},
+	"putstring": func(c *basicCall) error {
+		text, err := c.text(0)
+		if err != nil {
+			return err
+		}
+		if c.has(1) {
+			row, col, err := c.position(1)
+			if err != nil {
+				return err
+			}
+			c.add(Action{Kind: Cursor, Row: row, Column: col})
+		}
+		c.add(Action{Kind: Text, Text: text})
+		return nil
+	},
+	"moveto": func(c *basicCall) error {
+		row, col, err := c.position(0)
+		c.add(Action{Kind: Cursor, Row: row, Column: col})
+		return err
+	},
+	"waitforstring": func(c *basicCall) error {
+		text, err := c.text(0)
+		if err != nil {
+			return err
+		}
+		if !c.has(2) {
+			return fmt.Errorf("%s without a position is not supported", c.name)
+		}
+		row, col, err := c.position(1)
+		if err != nil {
+			return err
+		}
+		return c.waitText(text, row, col, 0)
+	},
+	"waitforcursor": func(c *basicCall) error {
+		row, col, err := c.position(0)
+		c.add(Action{Kind: WaitInputReady}, Action{Kind: Cursor, Row: row, Column: col})
+		return err
+	},
+	"transmitansi": func(c *basicCall) error {
+		text, err := c.text(0)
+		c.add(Action{Kind: Text, Text: text})
+		return err
+	},
+	"transmitterminalkey": func(c *basicCall) error {
+		if !c.has(0) || c.args[0].kind != constantValue {
+			return fmt.Errorf("%s needs a key constant such as rcIBMEnterKey", c.name)
+		}
+		name := c.args[0].text
+		key, ok := NormalizeKey(strings.TrimSuffix(strings.TrimPrefix(strings.ToLower(name), "rcibm"), "key"))
+		if !ok {
+			return fmt.Errorf("%s is not supported", name)
+		}
+		c.add(Action{Kind: Key, Key: key})
+		return nil
+	},
+	"setcursorposition": func(c *basicCall) error {
+		row, col, err := c.position(0)
+		c.add(Action{Kind: Cursor, Row: row, Column: col})
+		return err
+	},
+	"waitfordisplaystring": func(c *basicCall) error {
+		text, err := c.text(0)
+		if err != nil {
+			return err
+		}
+		timeout, err := reflectionTimeout(c, 1)
+		if err != nil {
+			return err
+		}
+		if !c.has(3) {
+			return fmt.Errorf("%s without a position is not supported", c.name)
+		}
+		row, col, err := c.position(2)
+		if err != nil {
+			return err
+		}
+		return c.waitText(text, row, col, timeout)
+	},
+	"waitforevent": func(c *basicCall) error {
+		if !c.has(0) || c.args[0].kind != constantValue || !strings.EqualFold(c.args[0].text, "rcKbdEnabled") {
+			return fmt.Errorf("%s is only supported for rcKbdEnabled", c.name)
+		}
+		timeout, err := reflectionTimeout(c, 1)
+		c.add(Action{Kind: WaitInputReady, Timeout: timeout})
+		return err
+	},
+}
+
+// reflectionTimeout reads an optional Reflection timeout at argument i,
+// given in seconds or as "hh:mm:ss".
+func reflectionTimeout(c *basicCall, i int) (time.Duration, error) {
+	if !c.has(i) {
+		return 0, nil
+	}
+	if c.args[i].kind == numberValue {
+		return time.Duration(c.args[i].number * float64(time.Second)), nil
+	}
+	text, err := c.text(i)
+	if err != nil {
+		return 0, err
+	}
+	var seconds float64
+	for _, part := range strings.Split(text, ":") {
+		n, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return 0, fmt.Errorf("timeout %q is not a time", text)
+		}
+		seconds = seconds*60 + n
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// basicLine is a logical line of a Basic macro, with comments removed and
+// continuation lines joined.
+type basicLine struct {
+	text string
+	line int
+}
+
+func basicLines(src string) []basicLine {
+	first := 1
+	if i := strings.Index(strings.ToUpper(src), "[PCOMM SCRIPT SOURCE]"); i >= 0 {
+		// Everything before the source section is the PCOMM header.
+		first += strings.Count(src[:i], "\n") + 1
+		if nl := strings.IndexByte(src[i:], '\n'); nl >= 0 {
+			src = src[i+nl+1:]
+		} else {
+			src = ""
+		}
+	}
+	var lines []basicLine
+	var pending *basicLine
+	for n, raw := range strings.Split(src, "\n") {
+		text := strings.TrimSpace(stripBasicComment(raw))
+		if pending != nil {
+			pending.text += " " + text
+		} else {
+			lines = append(lines, basicLine{text, first + n})
+			pending = &lines[len(lines)-1]
+		}
+		if strings.HasSuffix(pending.text, " _") || pending.text == "_" {
+			pending.text = strings.TrimSuffix(pending.text, "_")
+			continue
+		}
+		pending.text = strings.TrimSpace(pending.text)
+		pending = nil
+	}
+	return lines
+}
+
+// stripBasicComment removes a ' or Rem comment.
+func stripBasicComment(line string) string {
+	trimmed := strings.TrimSpace(line)
+	if len(trimmed) >= 3 && strings.EqualFold(trimmed[:3], "rem") && (len(trimmed) == 3 || trimmed[3] == ' ' || trimmed[3] == '\t') {
+		return ""
+	}
+	inString := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			inString = !inString
+		case '\'':
+			if !inString {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// basicSub is a Sub or Function of the macro. Its body is converted at each
+// call, with its parameters set to the arguments of the call.
+type basicSub struct {
+	params []string
+	body   []basicLine
+	called bool
+}
+
+type basicParser struct {
+	file    string
+	methods map[string]basicMethod
+	vars    map[string]basicValue
+	subs    map[string]*basicSub
+	calling map[string]bool // Subs being converted, to report recursion
+	script  *Script
+	errs    ErrorList
+}
+
+// parseBasic converts a Basic or VBScript macro using the terminal methods of
+// one dialect. Object set-up such as Dim, Set and With is skipped, as are If
+// blocks that do nothing to the screen, like the checks recorded macros make
+// after creating their session objects. Subs are converted where they are
+// called. A Sub Main that nothing calls is where the macro starts, as in
+// EXTRA! and Reflection.
+func parseBasic(file string, data []byte, methods map[string]basicMethod) (*Script, error) {
+	b := &basicParser{
+		file:    file,
+		methods: methods,
+		vars:    map[string]basicValue{},
+		subs:    map[string]*basicSub{},
+		calling: map[string]bool{},
+		script:  &Script{},
+	}
+	b.run(b.defineSubs(basicLines(string(data))))
+	if main, ok := b.subs["main"]; ok && !main.called {
+		b.callSub("main", main, nil)
+	}
+	return b.script, b.errs.err()
+}
+
+// defineSubs records the Subs and Functions in lines and returns the lines
+// outside them.
+func (b *basicParser) defineSubs(lines []basicLine) []basicLine {
+	var top []basicLine
+	for i := 0; i < len(lines); i++ {
+		written := strings.Fields(lines[i].text)
+		words := strings.Fields(strings.ToLower(lines[i].text))
+		for len(words) > 0 && (words[0] == "private" || words[0] == "public" || words[0] == "static") {
+			words, written = words[1:], written[1:]
+		}
+		if len(words) < 2 || words[0] != "sub" && words[0] != "function" {
+			top = append(top, lines[i])
+			continue
+		}
+		kind, header := words[0], strings.Join(words[1:], " ")
+		name := strings.TrimSpace(strings.SplitN(header, "(", 2)[0])
+		sub := &basicSub{params: basicParams(header)}
+		start := lines[i].line
+		for i++; i < len(lines); i++ {
+			words := strings.Fields(strings.ToLower(lines[i].text))
+			if len(words) > 1 && words[0] == "end" && words[1] == kind {
+				break
+			}
+			sub.body = append(sub.body, lines[i])
+		}
+		if i >= len(lines) {
+			b.fail(start, "%s %s without End %s", written[0], strings.SplitN(written[1], "(", 2)[0], written[0])
+		}
+		b.subs[name] = sub
+	}
+	return top
+}
+
+// basicParams returns the parameter names in the header of a Sub, such as
+// "logon(byval user as string, pass$)".
+func basicParams(header string) []string {
+	open, end := strings.IndexByte(header, '('), strings.LastIndexByte(header, ')')
+	if open < 0 || end < open {
+		return nil
+	}
+	var params []string
+	for _, p := range strings.Split(header[open+1:end], ",") {
+		words := strings.Fields(p)
+		for len(words) > 0 && (words[0] == "byval" || words[0] == "byref" || words[0] == "optional") {
+			words = words[1:]
+		}
+		if len(words) > 0 {
+			params = append(params, strings.TrimRight(words[0], "&%$!#"))
+		}
+	}
+	return params
+}
+
+// callSub converts the body of sub with its parameters set to args.
+func (b *basicParser) callSub(name string, sub *basicSub, args []basicValue) {
+	sub.called = true
+	b.calling[name] = true
+	saved := map[string]basicValue{}
+	for i, p := range sub.params {
+		if v, ok := b.vars[p]; ok {
+			saved[p] = v
+		}
+		if i < len(args) {
+			b.vars[p] = args[i]
+		} else {
+			delete(b.vars, p)
+		}
+	}
+	b.run(sub.body)
+	for _, p := range sub.params {
+		if v, ok := saved[p]; ok {
+			b.vars[p] = v
+		} else {
+			delete(b.vars, p)
+		}
+	}
+	delete(b.calling, name)
+}
+
+func (b *basicParser) fail(line int, format string, args ...interface{}) {
+	b.errs = append(b.errs, &Error{b.file, line, fmt.Sprintf(format, args...)})
+}
+
+func (b *basicParser) run(lines []basicLine) {
+	for i := 0; i < len(lines); i++ {
+		l := lines[i]
+		words := strings.Fields(strings.ToLower(l.text))
+		if len(words) == 0 {
+			continue
+		}
+		switch words[0] {
+		case "dim", "set", "option", "global", "declare", "private", "public", "with":
+			continue
+		case "end":
+			if len(words) == 1 {
+				b.fail(l.line, "End is not supported")
+			}
+			continue
+		case "if":
+			i = b.ifBlock(lines, i)
+			continue
+		case "call":
+			l.text = strings.TrimSpace(l.text[len("call"):])
+		case "const":
+			l.text = strings.TrimSpace(l.text[len("const"):])
+		case "stop", "exit", "goto", "do", "loop", "for", "next", "while", "wend", "select", "else", "elseif", "on", "msgbox", "inputbox":
+			b.fail(l.line, "%s is not supported", strings.Fields(l.text)[0])
+			continue
+		}
+		b.statement(l)
+	}
+}
+
+// ifBlock skips the If statement starting at lines[i], reporting it if it
+// would act on the screen, and returns the index of its last line.
+func (b *basicParser) ifBlock(lines []basicLine, i int) int {
+	start := lines[i]
+	end := i
+	var body []basicLine
+	lower := strings.ToLower(start.text)
+	if then := strings.LastIndex(lower, " then"); then >= 0 && strings.TrimSpace(start.text[then+len(" then"):]) != "" {
+		// Single-line If ... Then statement [Else statement]
+		rest := start.text[then+len(" then"):]
+		for _, part := range strings.SplitN(rest, " Else ", 2) {
+			body = append(body, basicLine{strings.TrimSpace(part), start.line})
+		}
+	} else {
+		depth := 1
+		for end = i + 1; end < len(lines) && depth > 0; end++ {
+			words := strings.Fields(strings.ToLower(lines[end].text))
+			switch {
+			case len(words) == 0:
+			case words[0] == "if" && strings.HasSuffix(strings.ToLower(lines[end].text), "then"):
+				depth++
+			case len(words) > 1 && words[0] == "end" && words[1] == "if", words[0] == "endif":
+				depth--
+				continue
+			case depth == 1 && (words[0] == "else" || words[0] == "elseif"):
+				continue
+			}
+			body = append(body, lines[end])
+		}
+		end--
+		if end >= len(lines) {
+			b.fail(start.line, "If without End If")
+		}
+	}
+	scratch := &basicParser{file: b.file, methods: b.methods, vars: b.vars, subs: b.subs, calling: b.calling, script: &Script{}}
+	scratch.run(body)
+	if len(scratch.script.Actions) > 0 {
+		b.fail(start.line, "If statements around screen operations are not supported")
+	}
+	return end
+}
+
+// statement converts an assignment or a call.
+func (b *basicParser) statement(l basicLine) {
+	tokens, err := basicTokens(l.text)
+	if err != nil {
+		b.fail(l.line, "%v", err)
+		return
+	}
+	e := &basicExpr{b: b, tokens: tokens, line: l.line}
+	defer func() {
+		if r := recover(); r != nil {
+			he, ok := r.(hodError)
+			if !ok {
+				panic(r)
+			}
+			b.errs = append(b.errs, he.err)
+		}
+	}()
+	name, dotted := e.chain()
+	if e.at("=") {
+		e.next()
+		v := e.expression()
+		e.end()
+		if !dotted {
+			b.vars[strings.ToLower(name)] = v
+		}
+		// Assignments to properties such as Sess0.Visible only set up the
+		// emulator window.
+		return
+	}
+	var sub *basicSub
+	if !dotted {
+		// Only calls to the macro's own subroutines are allowed without an
+		// object.
+		if sub = b.subs[strings.ToLower(name)]; sub == nil {
+			e.fail("%s is not supported", name)
+		}
+	}
+	var args []basicValue
+	if e.at("(") {
+		args = e.arguments()
+	} else {
+		for e.pos < len(e.tokens) {
+			args = append(args, e.expression())
+			if !e.at(",") {
+				break
+			}
+			e.next()
+		}
+	}
+	e.end()
+	if sub == nil {
+		e.call(name, args)
+		return
+	}
+	switch lower := strings.ToLower(name); {
+	case b.calling[lower]:
+		e.fail("recursive call to %s is not supported", name)
+	case len(args) > len(sub.params):
+		e.fail("%s takes %d argument(s)", name, len(sub.params))
+	default:
+		b.callSub(lower, sub, args)
+	}
+}
+
+// basicTokens splits a statement into tokens. Type suffixes such as & and $
+// are dropped from names.
+func basicTokens(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '"':
+			var sb strings.Builder
+			sb.WriteByte('"')
+			for i++; ; i++ {
+				if i >= len(s) {
+					return nil, fmt.Errorf("unterminated string")
+				}
+				if s[i] == '"' {
+					if i+1 < len(s) && s[i+1] == '"' {
+						sb.WriteByte('"')
+						i++
+						continue
+					}
+					break
+				}
+				sb.WriteByte(s[i])
+			}
+			tokens = append(tokens, sb.String())
+			i++
+		case isIdentStart(c) || isDigit(c):
+			start := i
+			for i < len(s) && (isIdentStart(s[i]) || isDigit(s[i]) || s[i] == '.' && isDigit(c)) {
+				i++
+			}
+			tokens = append(tokens, s[start:i])
+			for i < len(s) && strings.IndexByte("&%$!#", s[i]) >= 0 && (i+1 == len(s) || !isIdentStart(s[i+1]) && !isDigit(s[i+1]) && s[i+1] != '"') {
+				i++
+			}
+		case strings.IndexByte(".(),=&+-<>", c) >= 0:
+			tokens = append(tokens, string(c))
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+// basicExpr evaluates the tokens of one statement.
+type basicExpr struct {
+	b      *basicParser
+	tokens []string
+	pos    int
+	line   int
+}
+
+func (e *basicExpr) fail(format string, args ...interface{}) {
+	panic(hodError{&Error{e.b.file, e.line, fmt.Sprintf(format, args...)}})
+}
+
+func (e *basicExpr) at(text string) bool {
+	return e.pos < len(e.tokens) && e.tokens[e.pos] == text
+}
+
+func (e *basicExpr) next() string {
+	if e.pos >= len(e.tokens) {
+		e.fail("unexpected end of statement")
+	}
+	e.pos++
+	return e.tokens[e.pos-1]
+}
+
+func (e *basicExpr) end() {
+	if e.pos < len(e.tokens) {
+		e.fail("unexpected %q", e.tokens[e.pos])
+	}
+}
+
+// chain reads a name such as Sess0.Screen.SendKeys or .TransmitANSI,
+// returning its last part and whether it was reached through an object.
+func (e *basicExpr) chain() (string, bool) {
+	dotted := false
+	if e.at(".") {
+		e.next()
+		dotted = true
+	}
+	name := e.next()
+	if !isIdentStart(name[0]) {
+		e.fail("unexpected %q", name)
+	}
+	for e.at(".") {
+		e.next()
+		name = e.next()
+		dotted = true
+	}
+	return name, dotted
+}
+
+func (e *basicExpr) arguments() []basicValue {
+	e.next()
+	var args []basicValue
+	for !e.at(")") {
+		args = append(args, e.expression())
+		if !e.at(",") {
+			break
+		}
+		e.next()
+	}
+	if !e.at(")") {
+		e.fail("missing )")
+	}
+	e.next()
+	return args
+}
+
+// expression reads terms joined by & or +.
+func (e *basicExpr) expression() basicValue {
+	v := e.term()
+	for e.at("&") || e.at("+") {
+		op := e.next()
+		w := e.term()
+		if op == "+" && v.kind == numberValue && w.kind == numberValue {
+			v.number += w.number
+			continue
+		}
+		a, b := e.asText(v), e.asText(w)
+		v = basicValue{kind: keysValue, text: a + b}
+	}
+	return v
+}
+
+func (e *basicExpr) asText(v basicValue) string {
+	switch v.kind {
+	case keysValue:
+		return v.text
+	case numberValue:
+		return strconv.FormatFloat(v.number, 'f', -1, 64)
+	case runtimeValue:
+		e.fail("the value read at line %d is only known when the macro runs and cannot be converted", v.line)
+	}
+	e.fail("cannot use %s as text", v.text)
+	return ""
+}
+
+func (e *basicExpr) term() basicValue {
+	if e.pos >= len(e.tokens) {
+		e.fail("unexpected end of statement")
+	}
+	t := e.tokens[e.pos]
+	switch {
+	case t[0] == '"':
+		e.next()
+		return basicValue{kind: keysValue, text: t[1:]}
+	case isDigit(t[0]):
+		e.next()
+		n, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			e.fail("invalid number %s", t)
+		}
+		return basicValue{kind: numberValue, number: n}
+	case t == "-":
+		e.next()
+		v := e.term()
+		if v.kind != numberValue {
+			e.fail("cannot negate text")
+		}
+		v.number = -v.number
+		return v
+	case t == "(":
+		e.next()
+		v := e.expression()
+		if !e.at(")") {
+			e.fail("missing )")
+		}
+		e.next()
+		return v
+	}
+	name, dotted := e.chain()
+	var args []basicValue
+	hasArgs := e.at("(")
+	if hasArgs {
+		args = e.arguments()
+	}
+	if dotted {
+		if _, ok := e.b.methods[strings.ToLower(name)]; !ok && !hasArgs {
+			// A property such as System.TimeoutValue.
+			return basicValue{kind: runtimeValue, line: e.line}
+		}
+		return e.call(name, args)
+	}
+	lower := strings.ToLower(name)
+	if hasArgs {
+		e.fail("%s is not supported", name)
+	}
+	if v, ok := e.b.vars[lower]; ok {
+		return v
+	}
+	switch {
+	case lower == "true" || lower == "false":
+		return basicValue{kind: boolValue, text: name}
+	case strings.HasPrefix(lower, "rc"):
+		return basicValue{kind: constantValue, text: name}
+	case lower == "thissessionname":
+		return basicValue{kind: runtimeValue, line: e.line}
+	}
+	e.fail("unknown name %s", name)
+	return basicValue{}
+}
+
+// call converts a call to a method of the dialect.
+func (e *basicExpr) call(name string, args []basicValue) basicValue {
+	method, ok := e.b.methods[strings.ToLower(name)]
+	if !ok {
+		e.fail("%s is not supported", name)
+	}
+	c := &basicCall{name: name, args: args, line: e.line, script: e.b.script, result: basicValue{kind: boolValue}}
+	if err := method(c); err != nil {
+		e.fail("%v", err)
+	}
+	return c.result
+}
@@ -0,0 +1,485 @@
+package macro
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3270io/3270Connect/secrets"
+)
+
+// Formats that Export writes, besides FormatS3270 and FormatHOD.
+const (
+	FormatGo     = "go"     // A standalone Go program using connect3270
+	FormatPython = "python" // A Python script using py3270
+)
+
+// ExportFormats lists every format Export writes.
+var ExportFormats = []string{FormatS3270, FormatHOD, FormatGo, FormatPython}
+
+// Export writes script as a macro or program in the given format. The script
+// connects to script.Host and script.Port first and disconnects at the end.
+// source names the workflow in the generated header. Actions that cannot be
+// written are returned as an ErrorList; actions that can only be
+// approximated are returned as warnings. Both use the Line of the action.
+func Export(target string, script *Script, source string) ([]byte, ErrorList, error) {
+	x := &exporter{script: script, source: source}
+	switch target {
+	case FormatS3270:
+		x.s3270()
+	case FormatHOD:
+		x.hod()
+	case FormatGo:
+		x.goProgram()
+	case FormatPython:
+		x.python()
+	default:
+		return nil, nil, fmt.Errorf("unknown export format %q, expected one of %s", target, strings.Join(ExportFormats, ", "))
+	}
+	if err := x.errs.err(); err != nil {
+		return nil, x.warnings, err
+	}
+	data := x.buf.Bytes()
+	if target == FormatGo {
+		formatted, err := format.Source(data)
+		if err != nil {
+			return nil, x.warnings, fmt.Errorf("error formatting generated Go program: %v", err)
+		}
+		data = formatted
+	}
+	return data, x.warnings, nil
+}
+
+type exporter struct {
+	script   *Script
+	source   string
+	buf      bytes.Buffer
+	errs     ErrorList
+	warnings ErrorList
+}
+
+func (x *exporter) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&x.buf, format, args...)
+}
+
+func (x *exporter) fail(a Action, format string, args ...interface{}) {
+	x.errs = append(x.errs, &Error{Line: a.Line, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (x *exporter) warn(a Action, format string, args ...interface{}) {
+	x.warnings = append(x.warnings, &Error{Line: a.Line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// literal returns the text of a, which must not refer to the environment or
+// files because the target format has no way to read them.
+func (x *exporter) literal(a Action, target string) string {
+	parts, err := secrets.Split(a.Text)
+	if err != nil {
+		x.fail(a, "%v", err)
+		return ""
+	}
+	var sb strings.Builder
+	for _, part := range parts {
+		if part.Source != "" {
+			x.fail(a, "${%s:%s} cannot be read by %s", part.Source, part.Text, target)
+			continue
+		}
+		sb.WriteString(part.Text)
+	}
+	return sb.String()
+}
+
+// attempts is how many times a WaitText is checked, once a second for its
+// timeout.
+func attempts(timeout time.Duration) int {
+	return int(math.Ceil(timeout.Seconds())) + 1
+}
+
+func (x *exporter) hostPort() string {
+	if x.script.Port == 0 {
+		return x.script.Host
+	}
+	return fmt.Sprintf("%s:%d", x.script.Host, x.script.Port)
+}
+
+// s3270 writes an x3270/s3270 script. Scripts cannot compare screen text, so
+// WaitText is written as a comment and an Ascii action that shows the text.
+func (x *exporter) s3270() {
+	x.printf("# Generated by 3270Connect from %s\n", x.source)
+	x.printf("Connect(%s)\n", s3270Quote(x.hostPort()))
+	x.printf("Wait(30, InputField)\n")
+	for _, a := range x.script.Actions {
+		switch a.Kind {
+		case Text:
+			x.printf("String(%s)\n", s3270Quote(x.literal(a, "s3270")))
+		case Key:
+			if strings.HasPrefix(a.Key, "PF") {
+				x.printf("PF(%s)\n", strings.TrimPrefix(a.Key, "PF"))
+			} else {
+				x.printf("%s()\n", a.Key)
+			}
+		case Cursor:
+			x.printf("MoveCursor(%d, %d)\n", a.Row-1, a.Column-1)
+		case WaitInputReady:
+			if a.Timeout > 0 {
+				x.printf("Wait(%g, InputField)\n", math.Ceil(a.Timeout.Seconds()))
+			} else {
+				x.printf("Wait(InputField)\n")
+			}
+		case WaitText:
+			text := x.literal(a, "s3270")
+			x.warn(a, "s3270 scripts cannot check screen text, so the text is only shown")
+			x.printf("# Expect %s at row %d, column %d\n", s3270Quote(text), a.Row, a.Column)
+			x.printf("Ascii(%d, %d, %d)\n", a.Row-1, a.Column-1, len(text))
+		case Pause:
+			x.printf("Wait(%g, Seconds)\n", math.Ceil(a.Timeout.Seconds()))
+		case Capture:
+			x.printf("Ascii()\n")
+		}
+	}
+	x.printf("Disconnect()\n")
+}
+
+// s3270Quote quotes an argument of an s3270 action, escaping backslashes so
+// that String types them instead of treating them as key escapes.
+func s3270Quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// hod writes a Host On-Demand style JavaScript macro that ParseHOD reads.
+func (x *exporter) hod() {
+	x.printf("// Generated by 3270Connect from %s\n", x.source)
+	x.printf("// Connect to %s first\n\n", x.hostPort())
+	actions := x.script.Actions
+	for i := 0; i < len(actions); i++ {
+		a := actions[i]
+		switch a.Kind {
+		case Cursor:
+			if i+1 < len(actions) && actions[i+1].Kind == Text {
+				i++
+				x.printf("yield ps.sendKeys(%s, new Position(%d, %d));\n", hodQuote(x.literal(actions[i], "JavaScript macros")), a.Row, a.Column)
+				continue
+			}
+			x.printf("yield ps.setCursorPosition(new Position(%d, %d));\n", a.Row, a.Column)
+		case Text:
+			x.printf("yield ps.sendKeys(%s);\n", hodQuote(x.literal(a, "JavaScript macros")))
+		case Key:
+			name := strings.ToUpper(a.Key)
+			if strings.HasPrefix(a.Key, "PF") {
+				name = "F" + strings.TrimPrefix(a.Key, "PF")
+			}
+			x.printf("yield ps.sendKeys(ControlKey.%s);\n", name)
+		case WaitInputReady:
+			if a.Timeout > 0 {
+				x.printf("yield wait.forInputReady(%d);\n", a.Timeout.Milliseconds())
+			} else {
+				x.printf("yield wait.forInputReady();\n")
+			}
+		case WaitText:
+			text := hodQuote(x.literal(a, "JavaScript macros"))
+			if a.Timeout > 0 {
+				x.printf("yield wait.forText(%s, new Position(%d, %d), %d);\n", text, a.Row, a.Column, a.Timeout.Milliseconds())
+			} else {
+				x.printf("yield wait.forText(%s, new Position(%d, %d));\n", text, a.Row, a.Column)
+			}
+		case Pause:
+			x.warn(a, "JavaScript macros have no pause, so it is written as a comment")
+			x.printf("// Think for %v\n", a.Timeout)
+		case Capture:
+			x.warn(a, "JavaScript macros cannot save the screen, so it is written as a comment")
+			x.printf("// Capture the screen\n")
+		}
+	}
+}
+
+// hodQuote quotes a JavaScript string, doubling [ so that it is not read as
+// a key mnemonic.
+func hodQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "[", "[[").Replace(s) + "'"
+}
+
+// goText returns a Go expression for the text of a, reading references from
+// the environment or files when the program runs.
+func (x *exporter) goText(a Action, uses map[string]bool) string {
+	parts, err := secrets.Split(a.Text)
+	if err != nil {
+		x.fail(a, "%v", err)
+		return `""`
+	}
+	var exprs []string
+	for _, part := range parts {
+		switch part.Source {
+		case "env":
+			uses["os"] = true
+			exprs = append(exprs, fmt.Sprintf("os.Getenv(%q)", part.Text))
+		case "file":
+			uses["readFile"] = true
+			exprs = append(exprs, fmt.Sprintf("readFile(%q)", part.Text))
+		default:
+			exprs = append(exprs, strconv.Quote(part.Text))
+		}
+	}
+	if len(exprs) == 0 {
+		return `""`
+	}
+	return strings.Join(exprs, " + ")
+}
+
+// goCheckValue and goReadFile are helpers added to generated Go programs
+// that need them.
+const goCheckValue = `
+// checkValue checks for want at row and column, trying once a second.
+func checkValue(e *connect3270.Emulator, row, column int, want string, attempts int) error {
+var got string
+for attempt := 1; ; attempt++ {
+value, err := e.GetValue(row, column, len(want))
+if err != nil {
+return err
+}
+got = strings.TrimSpace(value)
+if got == want || attempt >= attempts {
+break
+}
+time.Sleep(time.Second)
+}
+if got != want {
+return fmt.Errorf("CheckValue failed at row %d, column %d. Expected: %s, Found: %s", row, column, want, got)
+}
+return nil
+}
+`
+
+const goReadFile = `
+// readFile returns the contents of a file without a trailing newline.
+func readFile(path string) string {
+data, err := ioutil.ReadFile(path)
+if err != nil {
+log.Fatalf("Error reading %s: %v", path, err)
+}
+return strings.TrimRight(string(data), "\r\n")
+}
+`
+
+// goProgram writes a standalone Go program that runs the script with
+// connect3270.
+func (x *exporter) goProgram() {
+	uses := map[string]bool{}
+	var body bytes.Buffer
+	check := func(call string) {
+		fmt.Fprintf(&body, "if err := %s; err != nil {\nreturn err\n}\n", call)
+	}
+	actions := x.script.Actions
+	for i := 0; i < len(actions); i++ {
+		a := actions[i]
+		switch a.Kind {
+		case Cursor:
+			if i+1 < len(actions) && actions[i+1].Kind == Text {
+				i++
+				check(fmt.Sprintf("e.FillString(%d, %d, %s)", a.Row, a.Column, x.goText(actions[i], uses)))
+				continue
+			}
+			check(fmt.Sprintf("e.MoveCursor(%d, %d)", a.Row, a.Column))
+		case Text:
+			check(fmt.Sprintf("e.SetString(%s)", x.goText(a, uses)))
+		case Key:
+			key := a.Key
+			if strings.HasPrefix(key, "PF") {
+				key = "F" + strings.TrimPrefix(key, "PF")
+			}
+			check("e.Press(connect3270." + key + ")")
+		case WaitInputReady:
+			timeout := a.Timeout
+			if timeout == 0 {
+				timeout = 30 * time.Second
+			}
+			check(fmt.Sprintf("e.WaitForField(%d * time.Second)", int(math.Ceil(timeout.Seconds()))))
+		case WaitText:
+			uses["checkValue"] = true
+			check(fmt.Sprintf("checkValue(e, %d, %d, %s, %d)", a.Row, a.Column, x.goText(a, uses), attempts(a.Timeout)))
+		case Pause:
+			fmt.Fprintf(&body, "time.Sleep(%d * time.Millisecond)\n", a.Timeout.Milliseconds())
+		case Capture:
+			check("e.AsciiScreenGrab(outputFile, false)")
+		}
+	}
+
+	imports := []string{"log", "time"}
+	if uses["checkValue"] {
+		imports = append(imports, "fmt", "strings")
+	}
+	if uses["readFile"] {
+		imports = append(imports, "io/ioutil", "strings")
+	}
+	if uses["os"] {
+		imports = append(imports, "os")
+	}
+	sort.Strings(imports)
+	x.printf("// Code generated by 3270Connect from %s. DO NOT EDIT.\n\n", x.source)
+	x.printf("package main\n\nimport (\n")
+	for i, name := range imports {
+		if i == 0 || imports[i-1] != name {
+			x.printf("%q\n", name)
+		}
+	}
+	x.printf("\n\"github.com/3270io/3270Connect/connect3270\"\n)\n\n")
+	x.printf("const (\nhost = %q\nport = %d\noutputFile = %q\n)\n\n", x.script.Host, x.script.Port, x.script.OutputFile)
+	x.printf(`func main() {
+e := connect3270.NewEmulator(host, port, "5000")
+if err := e.InitializeOutput(outputFile, false); err != nil {
+log.Fatalf("Error initializing output: %%v", err)
+}
+err := run(e)
+if e.IsConnected() {
+e.Disconnect()
+}
+if err != nil {
+log.Fatal(err)
+}
+}
+
+func run(e *connect3270.Emulator) error {
+if err := e.Connect(); err != nil {
+return err
+}
+if err := e.WaitForField(30 * time.Second); err != nil {
+return err
+}
+`)
+	x.buf.Write(body.Bytes())
+	x.printf("return e.Disconnect()\n}\n")
+	if uses["checkValue"] {
+		x.printf("%s", goCheckValue)
+	}
+	if uses["readFile"] {
+		x.printf("%s", goReadFile)
+	}
+}
+
+// pyText returns a Python expression for the text of a.
+func (x *exporter) pyText(a Action) string {
+	parts, err := secrets.Split(a.Text)
+	if err != nil {
+		x.fail(a, "%v", err)
+		return `""`
+	}
+	var exprs []string
+	for _, part := range parts {
+		switch part.Source {
+		case "env":
+			exprs = append(exprs, fmt.Sprintf("os.environ[%s]", pyQuote(part.Text)))
+		case "file":
+			exprs = append(exprs, fmt.Sprintf("read_file(%s)", pyQuote(part.Text)))
+		default:
+			exprs = append(exprs, pyQuote(part.Text))
+		}
+	}
+	if len(exprs) == 0 {
+		return `""`
+	}
+	return strings.Join(exprs, " + ")
+}
+
+// pyQuote quotes a Python string. Go escapes are all valid in Python.
+func pyQuote(s string) string {
+	return strconv.Quote(s)
+}
+
+// python writes a Python script that runs the script with py3270.
+func (x *exporter) python() {
+	x.printf(`#!/usr/bin/env python3
+# Generated by 3270Connect from %s
+import os
+import sys
+import time
+
+from py3270 import Emulator
+
+HOST = %s
+PORT = %d
+OUTPUT_FILE = %s
+
+
+def check_value(em, row, column, expected, attempts):
+    """Checks for expected at row and column, trying once a second."""
+    for attempt in range(attempts):
+        found = em.string_get(row, column, len(expected)).strip()
+        if found == expected:
+            return
+        if attempt + 1 < attempts:
+            time.sleep(1)
+    raise AssertionError("CheckValue failed at row %%d, column %%d. Expected: %%s, Found: %%s"
+                         %% (row, column, expected, found))
+
+
+def capture(em):
+    """Appends the current screen to OUTPUT_FILE."""
+    screen = em.exec_command(b"Ascii()").data
+    with open(OUTPUT_FILE, "a") as output:
+        output.write("\n".join(line.decode("utf-8", "replace") for line in screen) + "\n\n")
+
+
+def read_file(path):
+    """Returns the contents of a file without a trailing newline."""
+    with open(path) as f:
+        return f.read().rstrip("\r\n")
+
+
+def run(em):
+    em.connect("%%s:%%d" %% (HOST, PORT))
+    em.wait_for_field()
+`, x.source, pyQuote(x.script.Host), x.script.Port, pyQuote(x.script.OutputFile))
+	actions := x.script.Actions
+	for i := 0; i < len(actions); i++ {
+		a := actions[i]
+		switch a.Kind {
+		case Cursor:
+			if i+1 < len(actions) && actions[i+1].Kind == Text {
+				i++
+				x.printf("    em.send_string(%s, %d, %d)\n", x.pyText(actions[i]), a.Row, a.Column)
+				continue
+			}
+			x.printf("    em.move_to(%d, %d)\n", a.Row, a.Column)
+		case Text:
+			x.printf("    em.send_string(%s)\n", x.pyText(a))
+		case Key:
+			command := a.Key
+			if strings.HasPrefix(command, "PF") {
+				command = "PF(" + strings.TrimPrefix(command, "PF") + ")"
+			}
+			x.printf("    em.exec_command(b%q)\n", command)
+		case WaitInputReady:
+			if a.Timeout > 0 {
+				x.printf("    em.exec_command(b\"Wait(%d, InputField)\")\n", int(math.Ceil(a.Timeout.Seconds())))
+			} else {
+				x.printf("    em.wait_for_field()\n")
+			}
+		case WaitText:
+			x.printf("    check_value(em, %d, %d, %s, %d)\n", a.Row, a.Column, x.pyText(a), attempts(a.Timeout))
+		case Pause:
+			x.printf("    time.sleep(%g)\n", a.Timeout.Seconds())
+		case Capture:
+			x.printf("    capture(em)\n")
+		}
+	}
+	x.printf(`
+
+def main():
+    em = Emulator(visible=False)
+    try:
+        run(em)
+    except Exception as e:
+        print(e, file=sys.stderr)
+        sys.exit(1)
+    finally:
+        em.terminate()
+
+
+if __name__ == "__main__":
+    main()
+`)
+}
@@ -0,0 +1,199 @@
+package macro
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logon is a script that uses every kind of action.
+var logon = &Script{Host: "myhost", Port: 3270, OutputFile: "out.txt", Actions: []Action{
+	{Kind: Cursor, Row: 5, Column: 21, Line: 1},
+	{Kind: Text, Text: `user[1]\x`, Line: 1},
+	{Kind: Key, Key: "Tab", Line: 2},
+	{Kind: Text, Text: "it's \"quoted\"", Line: 3},
+	{Kind: Key, Key: "PF3", Line: 4},
+	{Kind: Key, Key: "Enter", Line: 5},
+	{Kind: WaitInputReady, Timeout: 5 * time.Second, Line: 6},
+	{Kind: Cursor, Row: 2, Column: 2, Line: 7},
+	{Kind: Key, Key: "Clear", Line: 8},
+	{Kind: WaitText, Text: "READY", Row: 1, Column: 2, Timeout: 3 * time.Second, Line: 9},
+	{Kind: Pause, Timeout: 2 * time.Second, Line: 10},
+	{Kind: Capture, Line: 11},
+}}
+
+// withoutLines returns actions with their source lines cleared, since a
+// round trip gives them the lines of the exported file.
+func withoutLines(actions []Action) []Action {
+	var out []Action
+	for _, a := range actions {
+		a.Line = 0
+		out = append(out, a)
+	}
+	return out
+}
+
+// messages returns the messages in l.
+func messages(l ErrorList) []string {
+	var msgs []string
+	for _, e := range l {
+		msgs = append(msgs, e.Error())
+	}
+	return msgs
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	tests := []struct {
+		format   string
+		want     []Action // The actions read back from the exported file
+		warnings []string
+	}{
+		{
+			// s3270 scripts wait for the first screen, only show the text of
+			// a WaitText and pause for whole seconds.
+			format: FormatS3270,
+			want: []Action{
+				{Kind: WaitInputReady, Timeout: 30 * time.Second},
+				{Kind: Cursor, Row: 5, Column: 21},
+				{Kind: Text, Text: `user[1]\x`},
+				{Kind: Key, Key: "Tab"},
+				{Kind: Text, Text: "it's \"quoted\""},
+				{Kind: Key, Key: "PF3"},
+				{Kind: Key, Key: "Enter"},
+				{Kind: WaitInputReady, Timeout: 5 * time.Second},
+				{Kind: Cursor, Row: 2, Column: 2},
+				{Kind: Key, Key: "Clear"},
+				{Kind: Pause, Timeout: 2 * time.Second},
+				{Kind: Capture},
+			},
+			warnings: []string{"line 9: s3270 scripts cannot check screen text, so the text is only shown"},
+		},
+		{
+			// JavaScript macros have no pause or capture.
+			format: FormatHOD,
+			want: []Action{
+				{Kind: Cursor, Row: 5, Column: 21},
+				{Kind: Text, Text: `user[1]\x`},
+				{Kind: Key, Key: "Tab"},
+				{Kind: Text, Text: "it's \"quoted\""},
+				{Kind: Key, Key: "PF3"},
+				{Kind: Key, Key: "Enter"},
+				{Kind: WaitInputReady, Timeout: 5 * time.Second},
+				{Kind: Cursor, Row: 2, Column: 2},
+				{Kind: Key, Key: "Clear"},
+				{Kind: WaitText, Text: "READY", Row: 1, Column: 2, Timeout: 3 * time.Second},
+			},
+			warnings: []string{
+				"line 10: JavaScript macros have no pause, so it is written as a comment",
+				"line 11: JavaScript macros cannot save the screen, so it is written as a comment",
+			},
+		},
+	}
+	for _, tt := range tests {
+		data, warnings, err := Export(tt.format, logon, "logon.yaml")
+		if err != nil {
+			t.Errorf("%s: Export failed: %v", tt.format, err)
+			continue
+		}
+		if got := messages(warnings); !reflect.DeepEqual(got, tt.warnings) {
+			t.Errorf("%s: warnings = %q, want %q", tt.format, got, tt.warnings)
+		}
+		script, err := Import("exported", data, tt.format)
+		if err != nil {
+			t.Errorf("%s: exported macro does not import: %v\n%s", tt.format, err, data)
+			continue
+		}
+		if got := withoutLines(script.Actions); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: round trip gave\n%+v\nwant\n%+v\nfrom\n%s", tt.format, got, tt.want, data)
+		}
+		if tt.format == FormatS3270 && (script.Host != logon.Host || script.Port != logon.Port) {
+			t.Errorf("%s: round trip connects to %s:%d, want %s:%d", tt.format, script.Host, script.Port, logon.Host, logon.Port)
+		}
+	}
+}
+
+func TestExportPrograms(t *testing.T) {
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{
+			format: FormatGo,
+			want: []string{
+				"// Code generated by 3270Connect from logon.yaml. DO NOT EDIT.",
+				`host       = "myhost"`,
+				`e.FillString(5, 21, "user[1]\\x")`,
+				"e.Press(connect3270.Tab)",
+				`e.SetString("it's \"quoted\"")`,
+				"e.Press(connect3270.F3)",
+				"e.WaitForField(5 * time.Second)",
+				"e.MoveCursor(2, 2)",
+				`checkValue(e, 1, 2, "READY", 4)`,
+				"time.Sleep(2000 * time.Millisecond)",
+				"e.AsciiScreenGrab(outputFile, false)",
+				"func checkValue(",
+			},
+		},
+		{
+			format: FormatPython,
+			want: []string{
+				"# Generated by 3270Connect from logon.yaml",
+				`HOST = "myhost"`,
+				`em.send_string("user[1]\\x", 5, 21)`,
+				`em.exec_command(b"Tab")`,
+				`em.exec_command(b"PF(3)")`,
+				`em.exec_command(b"Wait(5, InputField)")`,
+				"em.move_to(2, 2)",
+				`check_value(em, 1, 2, "READY", 4)`,
+				"time.sleep(2)",
+				"capture(em)",
+			},
+		},
+	}
+	for _, tt := range tests {
+		data, warnings, err := Export(tt.format, logon, "logon.yaml")
+		if err != nil || len(warnings) > 0 {
+			t.Errorf("%s: Export gave %v, warnings %q", tt.format, err, messages(warnings))
+			continue
+		}
+		for _, want := range tt.want {
+			if !strings.Contains(string(data), want) {
+				t.Errorf("%s: exported program does not contain %s:\n%s", tt.format, want, data)
+			}
+		}
+	}
+}
+
+func TestExportReferences(t *testing.T) {
+	script := &Script{Host: "h", Actions: []Action{{Kind: Text, Text: "${env:USER}/${file:/run/pw}", Line: 7}}}
+	tests := []struct {
+		format  string
+		want    string
+		wantErr string
+	}{
+		{format: FormatS3270, wantErr: "line 7: ${env:USER} cannot be read by s3270\nline 7: ${file:/run/pw} cannot be read by s3270"},
+		{format: FormatHOD, wantErr: "line 7: ${env:USER} cannot be read by JavaScript macros\nline 7: ${file:/run/pw} cannot be read by JavaScript macros"},
+		{format: FormatGo, want: `e.SetString(os.Getenv("USER") + "/" + readFile("/run/pw"))`},
+		{format: FormatPython, want: `em.send_string(os.environ["USER"] + "/" + read_file("/run/pw"))`},
+	}
+	for _, tt := range tests {
+		data, _, err := Export(tt.format, script, "w.yaml")
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("%s: Export error = %v, want %q", tt.format, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.format, err)
+			continue
+		}
+		if !strings.Contains(string(data), tt.want) {
+			t.Errorf("%s: exported program does not contain %s:\n%s", tt.format, tt.want, data)
+		}
+	}
+	if _, _, err := Export("rexx", script, "w.yaml"); err == nil {
+		t.Error("Export to an unknown format succeeded")
+	}
+}
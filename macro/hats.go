@@ -0,0 +1,293 @@
+package macro
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xmlNode is an element of a macro XML file with the line it starts on.
+type xmlNode struct {
+	name     string
+	attrs    map[string]string
+	children []*xmlNode
+	line     int
+}
+
+func (n *xmlNode) attr(name string) string {
+	return n.attrs[strings.ToLower(name)]
+}
+
+func (n *xmlNode) find(name string) *xmlNode {
+	if strings.EqualFold(n.name, name) {
+		return n
+	}
+	for _, child := range n.children {
+		if found := child.find(name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func (n *xmlNode) child(name string) *xmlNode {
+	for _, child := range n.children {
+		if strings.EqualFold(child.name, name) {
+			return child
+		}
+	}
+	return nil
+}
+
+// readXML reads an XML document into a tree of elements.
+func readXML(data []byte) (*xmlNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	var root *xmlNode
+	var stack []*xmlNode
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			// The decoder is now just past the start tag, which begins at the
+			// last < before it.
+			start := bytes.LastIndexByte(data[:d.InputOffset()], '<')
+			line := bytes.Count(data[:start+1], []byte("\n")) + 1
+			n := &xmlNode{name: t.Name.Local, attrs: map[string]string{}, line: line}
+			for _, a := range t.Attr {
+				n.attrs[strings.ToLower(a.Name.Local)] = a.Value
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil {
+				root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+	if root == nil {
+		return nil, fmt.Errorf("no XML elements found")
+	}
+	return root, nil
+}
+
+// parseHATS converts a HATS or Host Access macro (HAScript). Macros are a set
+// of screens, each recognised by descriptors and followed by one of its next
+// screens; only macros that go through their screens in a single line can
+// be converted. Descriptors other than text and keyboard state only help
+// recognise a screen and are not checked.
+func parseHATS(file string, data []byte) (*Script, error) {
+	root, err := readXML(data)
+	if err != nil {
+		return nil, ErrorList{{file, 1, err.Error()}}
+	}
+	script := root.find("HAScript")
+	if script == nil {
+		return nil, ErrorList{{file, root.line, "no HAScript element found"}}
+	}
+	h := &hatsParser{file: file, script: &Script{}, usevars: script.attr("usevars") == "true", screens: map[string]*xmlNode{}}
+	defaultTimeout := h.millis(script, "timeout")
+
+	var order []*xmlNode
+	var entry *xmlNode
+	for _, n := range script.children {
+		if !strings.EqualFold(n.name, "screen") {
+			continue
+		}
+		order = append(order, n)
+		h.screens[n.attr("name")] = n
+		if entry == nil && n.attr("entryscreen") == "true" {
+			entry = n
+		}
+		if n.attr("transient") == "true" {
+			h.fail(n, "transient screen %s is not supported", n.attr("name"))
+		}
+	}
+	if entry == nil && len(order) > 0 {
+		entry = order[0]
+	}
+
+	visited := map[*xmlNode]bool{}
+	timeout := time.Duration(0)
+	for screen := entry; screen != nil; {
+		if visited[screen] {
+			h.fail(screen, "screen %s is reached twice; loops are not supported", screen.attr("name"))
+			break
+		}
+		visited[screen] = true
+		h.describe(screen, timeout)
+		h.actions(screen)
+		if screen.attr("exitscreen") == "true" {
+			break
+		}
+		screen, timeout = h.nextScreen(screen, defaultTimeout)
+	}
+	return h.script, h.errs.err()
+}
+
+type hatsParser struct {
+	file    string
+	script  *Script
+	usevars bool
+	screens map[string]*xmlNode
+	errs    ErrorList
+}
+
+func (h *hatsParser) fail(n *xmlNode, format string, args ...interface{}) {
+	h.errs = append(h.errs, &Error{h.file, n.line, fmt.Sprintf(format, args...)})
+}
+
+func (h *hatsParser) add(n *xmlNode, actions ...Action) {
+	for _, a := range actions {
+		a.Line = n.line
+		h.script.Actions = append(h.script.Actions, a)
+	}
+}
+
+func (h *hatsParser) number(n *xmlNode, name string) int {
+	value := n.attr(name)
+	if value == "" {
+		return 0
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		h.fail(n, "%s %q is not a number", name, value)
+	}
+	return i
+}
+
+func (h *hatsParser) millis(n *xmlNode, name string) time.Duration {
+	return time.Duration(h.number(n, name)) * time.Millisecond
+}
+
+// value reads a value attribute, which is a quoted expression when the macro
+// uses variables.
+func (h *hatsParser) value(n *xmlNode) string {
+	value := n.attr("value")
+	if !h.usevars {
+		return value
+	}
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' && !strings.Contains(value[1:len(value)-1], "'") {
+		return value[1 : len(value)-1]
+	}
+	h.fail(n, "expression %s is not supported", value)
+	return ""
+}
+
+// describe waits for the descriptors that identify a screen.
+func (h *hatsParser) describe(screen *xmlNode, timeout time.Duration) {
+	description := screen.child("description")
+	if description == nil {
+		return
+	}
+	for _, d := range description.children {
+		if d.attr("optional") == "true" || d.attr("invertmatch") == "true" {
+			h.fail(d, "optional and inverted descriptors are not supported")
+			continue
+		}
+		switch strings.ToLower(d.name) {
+		case "oia":
+			if d.attr("status") != "NOTINHIBITED" && d.attr("status") != "" {
+				h.fail(d, "OIA status %s is not supported", d.attr("status"))
+				continue
+			}
+			h.add(d, Action{Kind: WaitInputReady, Timeout: timeout})
+		case "string":
+			row, col := h.number(d, "row"), h.number(d, "col")
+			if row <= 0 || col <= 0 {
+				h.fail(d, "text descriptors without a position are not supported")
+				continue
+			}
+			h.add(d, Action{Kind: WaitText, Text: h.value(d), Row: row, Column: col, Timeout: timeout})
+		case "cursor", "numfields", "numinputfields":
+		default:
+			h.fail(d, "%s descriptor is not supported", d.name)
+		}
+	}
+}
+
+// actions converts the actions run on a screen.
+func (h *hatsParser) actions(screen *xmlNode) {
+	actions := screen.child("actions")
+	if actions == nil {
+		return
+	}
+	for _, a := range actions.children {
+		switch strings.ToLower(a.name) {
+		case "input":
+			if a.attr("encrypted") == "true" {
+				h.fail(a, "encrypted input is not supported; use a Secret FillString step")
+				continue
+			}
+			row, col := h.number(a, "row"), h.number(a, "col")
+			if row > 0 && col > 0 {
+				h.add(a, Action{Kind: Cursor, Row: row, Column: col})
+			}
+			value := h.value(a)
+			if a.attr("xlatehostkeys") == "false" {
+				h.add(a, Action{Kind: Text, Text: value})
+				continue
+			}
+			keys, err := splitKeys(value, '[', ']', a.line)
+			if err != nil {
+				h.fail(a, "%v", err)
+				continue
+			}
+			h.add(a, keys...)
+		case "pause":
+			h.add(a, Action{Kind: Pause, Timeout: h.millis(a, "value")})
+		case "mouseclick":
+			h.add(a, Action{Kind: Cursor, Row: h.number(a, "row"), Column: h.number(a, "col")})
+		default:
+			h.fail(a, "%s action is not supported", a.name)
+		}
+	}
+}
+
+// nextScreen returns the screen that follows screen and how long to wait for
+// it, or nil at the end of the macro.
+func (h *hatsParser) nextScreen(screen *xmlNode, defaultTimeout time.Duration) (*xmlNode, time.Duration) {
+	next := screen.child("nextscreens")
+	if next == nil {
+		return nil, 0
+	}
+	var names []*xmlNode
+	for _, n := range next.children {
+		if strings.EqualFold(n.name, "nextscreen") {
+			names = append(names, n)
+		}
+	}
+	switch len(names) {
+	case 0:
+		return nil, 0
+	case 1:
+	default:
+		h.fail(next, "screen %s can be followed by %d screens; only macros without branches are supported", screen.attr("name"), len(names))
+		return nil, 0
+	}
+	target, ok := h.screens[names[0].attr("name")]
+	if !ok {
+		h.fail(names[0], "next screen %s is not defined", names[0].attr("name"))
+		return nil, 0
+	}
+	timeout := h.millis(next, "timeout")
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	return target, timeout
+}
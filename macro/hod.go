@@ -0,0 +1,507 @@
+package macro
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseHOD parses a Host On-Demand style JavaScript macro, such as
+//
+//	yield wait.forText('3270 Example Application', new Position(1, 29));
+//	yield ps.setCursorPosition(new Position(5, 21));
+//	yield ps.sendKeys('user1-firstname' + ControlKey.TAB);
+//	yield ps.sendKeys(ControlKey.ENTER);
+//
+// It understands ps.sendKeys, ps.setCursorPosition, ps.getText,
+// wait.forCursor, wait.forInputReady and wait.forText, string concatenation,
+// [enter]-style key mnemonics inside strings, and var, let and const
+// variables. file is only used in error messages. All problems are returned
+// together as an ErrorList.
+//
+// Input files written for earlier versions gave the position of typed text in
+// the comment before it, as in "// Fill in the first name at row 5, column
+// 21". Such comments are reported as errors rather than ignored, since the
+// text would otherwise be typed at the cursor.
+func ParseHOD(file string, src []byte) ([]Action, error) {
+	tokens, comments, errs := tokenize(file, string(src))
+	p := &hodParser{file: file, tokens: tokens, vars: map[string]hodValue{}, comments: comments, errs: errs}
+	for !p.at(tokEOF, "") {
+		p.statement()
+	}
+	return p.actions, p.errs.err()
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokPunct
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	line int
+}
+
+// positionComment matches the position given in a comment by input files
+// written for earlier versions.
+var positionComment = regexp.MustCompile(`(?i)\brow\s+(\d+)\s*,?\s*col(?:umn)?\s+(\d+)`)
+
+// tokenize splits a macro into tokens, dropping whitespace and comments. It
+// also returns the positions given in // comments, by line.
+func tokenize(file, src string) ([]token, map[int]string, ErrorList) {
+	var tokens []token
+	comments := map[int]string{}
+	var errs ErrorList
+	line := 1
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			start := i
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			if m := positionComment.FindStringSubmatch(src[start:i]); m != nil {
+				comments[line] = m[1] + ", " + m[2]
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				errs = append(errs, &Error{file, line, "unterminated comment"})
+				return append(tokens, token{tokEOF, "", line}), comments, errs
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == '\'' || c == '"':
+			start := line
+			var sb strings.Builder
+			i++
+			for i < len(src) && src[i] != c && src[i] != '\n' {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+					switch src[i] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(src[i])
+					}
+				} else {
+					sb.WriteByte(src[i])
+				}
+				i++
+			}
+			if i >= len(src) || src[i] != c {
+				errs = append(errs, &Error{file, start, "unterminated string"})
+			} else {
+				i++
+			}
+			tokens = append(tokens, token{tokString, sb.String(), start})
+		case isIdentStart(c):
+			start := i
+			for i < len(src) && (isIdentStart(src[i]) || isDigit(src[i])) {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, src[start:i], line})
+		case isDigit(c):
+			start := i
+			for i < len(src) && (isDigit(src[i]) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, src[start:i], line})
+		case strings.ContainsRune("(),;.+={}[]-", rune(c)):
+			tokens = append(tokens, token{tokPunct, string(c), line})
+			i++
+		default:
+			errs = append(errs, &Error{file, line, fmt.Sprintf("unexpected character %q", c)})
+			i++
+		}
+	}
+	return append(tokens, token{tokEOF, "", line}), comments, errs
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// hodValue is the result of evaluating an expression while parsing.
+type hodValue struct {
+	kind     valueKind
+	segments []Action // keysValue: Text and Key actions in order
+	number   float64
+	row, col int
+	line     int // Line of the ps.getText call for runtimeValue
+}
+
+type valueKind int
+
+const (
+	keysValue valueKind = iota
+	numberValue
+	boolValue
+	positionValue
+	runtimeValue  // Only known when the macro runs, e.g. the result of ps.getText
+	constantValue // A named constant such as rcIBMEnterKey
+)
+
+// hodError is used to abandon the current statement.
+type hodError struct {
+	err *Error
+}
+
+type hodParser struct {
+	file     string
+	tokens   []token
+	pos      int
+	vars     map[string]hodValue
+	comments map[int]string // Positions given in comments, by line
+	actions  []Action
+	errs     ErrorList
+}
+
+func (p *hodParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *hodParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *hodParser) at(kind tokenKind, text string) bool {
+	t := p.peek()
+	return t.kind == kind && (text == "" || t.text == text)
+}
+
+func (p *hodParser) fail(line int, format string, args ...interface{}) {
+	panic(hodError{&Error{p.file, line, fmt.Sprintf(format, args...)}})
+}
+
+func (p *hodParser) expect(text string) token {
+	t := p.next()
+	if t.kind != tokPunct || t.text != text {
+		p.fail(t.line, "expected %q but found %s", text, describe(t))
+	}
+	return t
+}
+
+func describe(t token) string {
+	switch t.kind {
+	case tokEOF:
+		return "end of file"
+	case tokString:
+		return fmt.Sprintf("string %q", t.text)
+	default:
+		return fmt.Sprintf("%q", t.text)
+	}
+}
+
+// statement parses one statement. On error it records the problem and skips
+// to the start of the next statement.
+func (p *hodParser) statement() {
+	start, startPos := p.peek(), p.pos
+	defer func() {
+		if r := recover(); r != nil {
+			he, ok := r.(hodError)
+			if !ok {
+				panic(r)
+			}
+			p.errs = append(p.errs, he.err)
+			p.skipStatement(start.line)
+			if p.pos == startPos {
+				p.next()
+			}
+		}
+	}()
+	if p.at(tokPunct, ";") {
+		p.next()
+		return
+	}
+	if p.at(tokIdent, "yield") {
+		p.next()
+	}
+	t := p.peek()
+	if t.kind == tokIdent && (t.text == "var" || t.text == "let" || t.text == "const") {
+		p.next()
+		name := p.next()
+		if name.kind != tokIdent {
+			p.fail(name.line, "expected a variable name but found %s", describe(name))
+		}
+		p.expect("=")
+		if p.at(tokIdent, "yield") {
+			p.next()
+		}
+		p.vars[name.text] = p.expression()
+	} else if t.kind == tokIdent && p.tokens[p.pos+1].kind == tokPunct && p.tokens[p.pos+1].text == "=" {
+		name := p.next()
+		if _, ok := p.vars[name.text]; !ok {
+			p.fail(name.line, "assignment to undeclared variable %s", name.text)
+		}
+		p.next()
+		if p.at(tokIdent, "yield") {
+			p.next()
+		}
+		p.vars[name.text] = p.expression()
+	} else {
+		p.expression()
+	}
+	if p.at(tokPunct, ";") {
+		p.next()
+	} else if p.peek().kind != tokEOF && p.peek().line == p.tokens[p.pos-1].line {
+		p.fail(p.peek().line, "expected end of statement but found %s", describe(p.peek()))
+	}
+}
+
+// skipStatement moves past the rest of a statement that failed to parse.
+func (p *hodParser) skipStatement(startLine int) {
+	for {
+		t := p.peek()
+		if t.kind == tokEOF {
+			return
+		}
+		if t.kind == tokPunct && t.text == ";" {
+			p.next()
+			return
+		}
+		if t.line > startLine && p.pos > 0 && p.tokens[p.pos-1].line < t.line {
+			return
+		}
+		p.next()
+	}
+}
+
+// expression parses terms joined by +.
+func (p *hodParser) expression() hodValue {
+	v := p.term()
+	for p.at(tokPunct, "+") {
+		op := p.next()
+		w := p.term()
+		v = p.concat(op.line, v, w)
+	}
+	return v
+}
+
+func (p *hodParser) concat(line int, a, b hodValue) hodValue {
+	if a.kind == numberValue && b.kind == numberValue {
+		return hodValue{kind: numberValue, number: a.number + b.number}
+	}
+	a = p.asKeys(line, a)
+	b = p.asKeys(line, b)
+	segments := append(append([]Action(nil), a.segments...), b.segments...)
+	return hodValue{kind: keysValue, segments: segments}
+}
+
+// asKeys converts a value to text and keys, as JavaScript does when
+// concatenating it with a string.
+func (p *hodParser) asKeys(line int, v hodValue) hodValue {
+	switch v.kind {
+	case keysValue:
+		return v
+	case numberValue:
+		return hodValue{kind: keysValue, segments: []Action{{Kind: Text, Text: strconv.FormatFloat(v.number, 'f', -1, 64), Line: line}}}
+	case runtimeValue:
+		p.fail(line, "the result of ps.getText at line %d is only known when the macro runs and cannot be converted", v.line)
+	}
+	p.fail(line, "cannot use a position or boolean as text")
+	return hodValue{}
+}
+
+func (p *hodParser) term() hodValue {
+	t := p.next()
+	switch t.kind {
+	case tokString:
+		return hodValue{kind: keysValue, segments: splitMnemonics(p, t)}
+	case tokNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			p.fail(t.line, "invalid number %s", t.text)
+		}
+		return hodValue{kind: numberValue, number: n}
+	case tokPunct:
+		if t.text == "(" {
+			v := p.expression()
+			p.expect(")")
+			return v
+		}
+		if t.text == "-" && p.at(tokNumber, "") {
+			v := p.term()
+			v.number = -v.number
+			return v
+		}
+	case tokIdent:
+		switch t.text {
+		case "true", "false":
+			return hodValue{kind: boolValue}
+		case "new":
+			return p.newPosition()
+		case "ControlKey":
+			p.expect(".")
+			name := p.next()
+			key, ok := NormalizeKey(name.text)
+			if !ok {
+				p.fail(name.line, "ControlKey.%s is not supported", name.text)
+			}
+			return hodValue{kind: keysValue, segments: []Action{{Kind: Key, Key: key, Line: name.line}}}
+		case "ps", "wait":
+			p.expect(".")
+			method := p.next()
+			if method.kind != tokIdent {
+				p.fail(method.line, "expected a method name after %s. but found %s", t.text, describe(method))
+			}
+			args := p.arguments()
+			return p.call(t.text+"."+method.text, method.line, args)
+		}
+		if v, ok := p.vars[t.text]; ok {
+			return v
+		}
+		p.fail(t.line, "unknown identifier %s", t.text)
+	}
+	p.fail(t.line, "unexpected %s", describe(t))
+	return hodValue{}
+}
+
+// newPosition parses the rest of "new Position(row, column)".
+func (p *hodParser) newPosition() hodValue {
+	name := p.next()
+	if name.text != "Position" {
+		p.fail(name.line, "only new Position(row, column) is supported, not new %s", name.text)
+	}
+	args := p.arguments()
+	if len(args) != 2 || args[0].kind != numberValue || args[1].kind != numberValue {
+		p.fail(name.line, "new Position needs a row and a column")
+	}
+	return hodValue{kind: positionValue, row: int(args[0].number), col: int(args[1].number)}
+}
+
+func (p *hodParser) arguments() []hodValue {
+	p.expect("(")
+	var args []hodValue
+	for !p.at(tokPunct, ")") {
+		args = append(args, p.expression())
+		if !p.at(tokPunct, ",") {
+			break
+		}
+		p.next()
+	}
+	p.expect(")")
+	return args
+}
+
+// position reads a position given either as a Position or as a row and a
+// column, returning the number of arguments used.
+func (p *hodParser) position(line int, args []hodValue) (row, col, used int) {
+	if len(args) > 0 && args[0].kind == positionValue {
+		return args[0].row, args[0].col, 1
+	}
+	if len(args) > 1 && args[0].kind == numberValue && args[1].kind == numberValue {
+		return int(args[0].number), int(args[1].number), 2
+	}
+	p.fail(line, "expected a position")
+	return 0, 0, 0
+}
+
+// timeout reads an optional timeout in milliseconds.
+func (p *hodParser) timeout(line int, args []hodValue) time.Duration {
+	if len(args) == 0 || args[0].kind == boolValue {
+		return 0
+	}
+	if args[0].kind != numberValue {
+		p.fail(line, "expected a timeout in milliseconds")
+	}
+	return time.Duration(args[0].number) * time.Millisecond
+}
+
+func (p *hodParser) emit(a Action) {
+	p.actions = append(p.actions, a)
+}
+
+func (p *hodParser) call(name string, line int, args []hodValue) hodValue {
+	switch name {
+	case "ps.sendKeys":
+		if len(args) == 0 {
+			p.fail(line, "ps.sendKeys needs the keys to send")
+		}
+		keys := p.asKeys(line, args[0])
+		if len(args) > 1 && args[1].kind != boolValue {
+			row, col, _ := p.position(line, args[1:])
+			p.emit(Action{Kind: Cursor, Row: row, Column: col, Line: line})
+		} else if position, ok := p.comments[line-1]; ok && hasText(keys.segments) {
+			p.fail(line, "the position in the comment on line %d is not read; give it as ps.sendKeys(text, new Position(%s)) or set it first with ps.setCursorPosition(new Position(%s))", line-1, position, position)
+		}
+		for _, segment := range keys.segments {
+			segment.Line = line
+			p.emit(segment)
+		}
+	case "ps.setCursorPosition":
+		row, col, _ := p.position(line, args)
+		p.emit(Action{Kind: Cursor, Row: row, Column: col, Line: line})
+	case "ps.getText":
+		p.position(line, args)
+		return hodValue{kind: runtimeValue, line: line}
+	case "wait.forCursor":
+		// Waiting for the cursor is waiting for the host to present the
+		// next screen, after which typing continues at that position.
+		row, col, used := p.position(line, args)
+		p.emit(Action{Kind: WaitInputReady, Timeout: p.timeout(line, args[used:]), Line: line})
+		p.emit(Action{Kind: Cursor, Row: row, Column: col, Line: line})
+	case "wait.forInputReady":
+		p.emit(Action{Kind: WaitInputReady, Timeout: p.timeout(line, args), Line: line})
+	case "wait.forText":
+		if len(args) == 0 {
+			p.fail(line, "wait.forText needs the text to wait for")
+		}
+		text := p.asKeys(line, args[0])
+		if len(text.segments) != 1 || text.segments[0].Kind != Text {
+			p.fail(line, "wait.forText needs plain text")
+		}
+		if len(args) < 2 || args[1].kind == numberValue && len(args) == 2 {
+			p.fail(line, "wait.forText without a position is not supported")
+		}
+		row, col, used := p.position(line, args[1:])
+		p.emit(Action{Kind: WaitText, Text: text.segments[0].Text, Row: row, Column: col, Timeout: p.timeout(line, args[1+used:]), Line: line})
+	default:
+		p.fail(line, "%s is not supported", name)
+	}
+	return hodValue{kind: boolValue}
+}
+
+// hasText reports whether segments type any text.
+func hasText(segments []Action) bool {
+	for _, s := range segments {
+		if s.Kind == Text {
+			return true
+		}
+	}
+	return false
+}
+
+// splitMnemonics splits a string into text and keys, turning mnemonics such
+// as [enter], [tab], [clear] and [pf3] into Key actions. [[ stands for [.
+func splitMnemonics(p *hodParser, t token) []Action {
+	segments, err := splitKeys(t.text, '[', ']', t.line)
+	if err != nil {
+		p.fail(t.line, "%v", err)
+	}
+	return segments
+}
@@ -0,0 +1,157 @@
+package macro
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseHOD(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []Action
+	}{
+		{
+			name: "keys at the cursor",
+			src:  "yield ps.sendKeys('user1' + ControlKey.TAB);\nyield ps.sendKeys(ControlKey.ENTER);",
+			want: []Action{
+				{Kind: Text, Text: "user1", Line: 1},
+				{Kind: Key, Key: "Tab", Line: 1},
+				{Kind: Key, Key: "Enter", Line: 2},
+			},
+		},
+		{
+			name: "keys at a position",
+			src:  "yield ps.sendKeys('abc', new Position(5, 21));\nyield ps.sendKeys('x', 6, 1);",
+			want: []Action{
+				{Kind: Cursor, Row: 5, Column: 21, Line: 1},
+				{Kind: Text, Text: "abc", Line: 1},
+				{Kind: Cursor, Row: 6, Column: 1, Line: 2},
+				{Kind: Text, Text: "x", Line: 2},
+			},
+		},
+		{
+			name: "mnemonics",
+			src:  "ps.sendKeys('a[tab]b[[c[pf3]');",
+			want: []Action{
+				{Kind: Text, Text: "a", Line: 1},
+				{Kind: Key, Key: "Tab", Line: 1},
+				{Kind: Text, Text: "b[c", Line: 1},
+				{Kind: Key, Key: "PF3", Line: 1},
+			},
+		},
+		{
+			name: "cursor",
+			src:  "yield ps.setCursorPosition(new Position(5, 21))",
+			want: []Action{{Kind: Cursor, Row: 5, Column: 21, Line: 1}},
+		},
+		{
+			name: "waits",
+			src: "yield wait.forText('READY', new Position(1, 29), 5000);\n" +
+				"yield wait.forInputReady(2000);\n" +
+				"yield wait.forCursor(new Position(3, 4));",
+			want: []Action{
+				{Kind: WaitText, Text: "READY", Row: 1, Column: 29, Timeout: 5 * time.Second, Line: 1},
+				{Kind: WaitInputReady, Timeout: 2 * time.Second, Line: 2},
+				{Kind: WaitInputReady, Line: 3},
+				{Kind: Cursor, Row: 3, Column: 4, Line: 3},
+			},
+		},
+		{
+			name: "variables",
+			src: "var user = 'alice';\nlet row = 4;\nconst sep = '-' + 2;\nuser = user + sep;\n" +
+				"/* several\nlines */ ps.sendKeys(user, row, 10);",
+			want: []Action{
+				{Kind: Cursor, Row: 4, Column: 10, Line: 6},
+				{Kind: Text, Text: "alice", Line: 6},
+				{Kind: Text, Text: "-", Line: 6},
+				{Kind: Text, Text: "2", Line: 6},
+			},
+		},
+		{
+			name: "comments that give no position",
+			src:  "// Fill in the first name\nps.sendKeys('a');",
+			want: []Action{{Kind: Text, Text: "a", Line: 2}},
+		},
+		{
+			name: "position comment before a key only",
+			src:  "// Press enter at row 5, column 21\nps.sendKeys(ControlKey.ENTER);",
+			want: []Action{{Kind: Key, Key: "Enter", Line: 2}},
+		},
+		{
+			name: "position comment with the position also given",
+			src:  "// at row 5 column 21\nps.sendKeys('a', new Position(5, 21));",
+			want: []Action{
+				{Kind: Cursor, Row: 5, Column: 21, Line: 2},
+				{Kind: Text, Text: "a", Line: 2},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := ParseHOD("test.js", []byte(tt.src))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseHOD =\n%+v\nwant\n%+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseHODErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{
+			name: "old position comment",
+			src:  "// Fill in the first name at row 5, column 21\nyield ps.sendKeys('user1-firstname');",
+			want: []string{"test.js:2: the position in the comment on line 1 is not read; give it as ps.sendKeys(text, new Position(5, 21)) or set it first with ps.setCursorPosition(new Position(5, 21))"},
+		},
+		{
+			name: "getText",
+			src:  "var t = ps.getText(new Position(1, 1));\nps.sendKeys(t);",
+			want: []string{"test.js:2: the result of ps.getText at line 1 is only known when the macro runs and cannot be converted"},
+		},
+		{
+			name: "every problem is reported",
+			src:  "ps.sendKeys('a');\nps.print();\nps.sendKeys(ControlKey.ALT);\nps.sendKeys('[home]');\nwait.forText('x');\nfoo;",
+			want: []string{
+				"test.js:2: ps.print is not supported",
+				"test.js:3: ControlKey.ALT is not supported",
+				"test.js:4: key [home] is not supported",
+				"test.js:5: wait.forText without a position is not supported",
+				"test.js:6: unknown identifier foo",
+			},
+		},
+		{
+			name: "syntax",
+			src:  "ps.sendKeys('a'\nps.sendKeys('b');\nps.sendKeys('c') ps.sendKeys('d');\nx = 1;\n'open",
+			want: []string{
+				"test.js:5: unterminated string",
+				"test.js:2: expected \")\" but found \"ps\"",
+				"test.js:3: expected end of statement but found \"ps\"",
+				"test.js:4: assignment to undeclared variable x",
+			},
+		},
+		{
+			name: "unterminated comment",
+			src:  "ps.sendKeys('a');\n/* never closed",
+			want: []string{"test.js:2: unterminated comment"},
+		},
+	}
+	for _, tt := range tests {
+		_, err := ParseHOD("test.js", []byte(tt.src))
+		if err == nil {
+			t.Errorf("%s: ParseHOD succeeded, want %q", tt.name, tt.want)
+			continue
+		}
+		if got := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ParseHOD errors =\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+}
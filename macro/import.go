@@ -0,0 +1,76 @@
+package macro
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Formats that Import understands.
+const (
+	FormatHOD   = "hod"   // Host On-Demand style JavaScript, as read from InputFilePath
+	FormatS3270 = "s3270" // x3270/s3270 action scripts
+	FormatPCOMM = "pcomm" // IBM Personal Communications VBScript .mac files
+	FormatBasic = "basic" // Attachmate EXTRA! and Reflection Basic macros
+	FormatHATS  = "hats"  // HATS and Host Access macro XML
+)
+
+// Formats lists every format Import understands.
+var Formats = []string{FormatHOD, FormatS3270, FormatPCOMM, FormatBasic, FormatHATS}
+
+// Script is a macro converted to actions.
+type Script struct {
+	Host       string // Host the macro connects to, if it says
+	Port       int    // Port the macro connects to, 0 if it does not say
+	OutputFile string // File that Capture actions write to when exported
+	Actions    []Action
+}
+
+// Import converts a macro in the given format to actions. Constructs that
+// cannot be converted are all reported together as an ErrorList.
+func Import(file string, data []byte, format string) (*Script, error) {
+	switch format {
+	case FormatHOD:
+		actions, err := ParseHOD(file, data)
+		return &Script{Actions: actions}, err
+	case FormatS3270:
+		return parseS3270(file, data)
+	case FormatPCOMM:
+		return parseBasic(file, data, pcommMethods)
+	case FormatBasic:
+		return parseBasic(file, data, basicMethods)
+	case FormatHATS:
+		return parseHATS(file, data)
+	}
+	return nil, fmt.Errorf("unknown macro format %q, expected one of %s", format, strings.Join(Formats, ", "))
+}
+
+// DetectFormat guesses the format of a macro from its contents and file
+// extension.
+func DetectFormat(file string, data []byte) (string, error) {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	if bytes.HasPrefix(trimmed, []byte("<")) {
+		return FormatHATS, nil
+	}
+	lower := strings.ToLower(string(trimmed))
+	switch {
+	case strings.Contains(lower, "[pcomm script"), strings.Contains(lower, "autecl"):
+		return FormatPCOMM, nil
+	case strings.Contains(lower, "yield ps."), strings.Contains(lower, "yield wait."):
+		return FormatHOD, nil
+	}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".mac":
+		return FormatPCOMM, nil
+	case ".ebm", ".ebs", ".rbs", ".bas":
+		return FormatBasic, nil
+	case ".hma", ".xml":
+		return FormatHATS, nil
+	case ".js", ".txt":
+		return FormatHOD, nil
+	case ".s3270", ".x3270":
+		return FormatS3270, nil
+	}
+	return "", fmt.Errorf("%s: cannot tell the macro format, choose one of %s", file, strings.Join(Formats, ", "))
+}
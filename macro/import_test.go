@@ -0,0 +1,277 @@
+package macro
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		src    string
+		want   *Script
+	}{
+		{
+			name:   "s3270",
+			format: FormatS3270,
+			src: "# Log on\nConnect(L:myhost:3270)\nWait(30, 3270Mode)\n" +
+				"MoveCursor(4, 20) String(\"user1\\tpw\\n\")\n" +
+				"Wait 5 InputField\nPF(3)\nString \"a \\\"b\\\"\" \"\\\\c\"\nWait(1.5, Seconds)\nAscii()\nDisconnect\n",
+			want: &Script{Host: "myhost", Port: 3270, Actions: []Action{
+				{Kind: Cursor, Row: 5, Column: 21, Line: 4},
+				{Kind: Text, Text: "user1", Line: 4},
+				{Kind: Key, Key: "Tab", Line: 4},
+				{Kind: Text, Text: "pw", Line: 4},
+				{Kind: Key, Key: "Enter", Line: 4},
+				{Kind: WaitInputReady, Timeout: 5 * time.Second, Line: 5},
+				{Kind: Key, Key: "PF3", Line: 6},
+				{Kind: Text, Text: "a \"b\"", Line: 7},
+				{Kind: Text, Text: "\\c", Line: 7},
+				{Kind: Pause, Timeout: 1500 * time.Millisecond, Line: 8},
+				{Kind: Capture, Line: 9},
+			}},
+		},
+		{
+			name:   "PCOMM",
+			format: FormatPCOMM,
+			src: "[PCOMM SCRIPT HEADER]\nLANGUAGE=VBSCRIPT\n[PCOMM SCRIPT SOURCE]\nOPTION EXPLICIT\n" +
+				"autECLSession.SetConnectionByName(ThisSessionName)\n" +
+				"REM the logon screen\n" +
+				"autECLSession.autECLOIA.WaitForAppAvailable\n" +
+				"autECLSession.autECLPS.WaitForString \"LOGON\", 1, 10, 10000\n" +
+				"autECLSession.autECLPS.SendKeys \"user1\", 5, 21\n" +
+				"Dim pw\npw = \"secret\"\n" +
+				"autECLSession.autECLPS.SendKeys pw & \"[tab]\" ' the password\n" +
+				"autECLSession.autECLPS.SendKeys \"[enter]\"\n" +
+				"autECLSession.autECLOIA.WaitForInputReady\n" +
+				"autECLSession.autECLPS.Wait 500\n",
+			want: &Script{Actions: []Action{
+				{Kind: WaitText, Text: "LOGON", Row: 1, Column: 10, Timeout: 10 * time.Second, Line: 8},
+				{Kind: Cursor, Row: 5, Column: 21, Line: 9},
+				{Kind: Text, Text: "user1", Line: 9},
+				{Kind: Text, Text: "secret", Line: 12},
+				{Kind: Key, Key: "Tab", Line: 12},
+				{Kind: Key, Key: "Enter", Line: 13},
+				{Kind: WaitInputReady, Line: 14},
+				{Kind: Pause, Timeout: 500 * time.Millisecond, Line: 15},
+			}},
+		},
+		{
+			name:   "EXTRA! with Sub Main",
+			format: FormatBasic,
+			src: "Global g_HostSettleTime%\n" +
+				"Sub Main\n" +
+				"\tDim Sess0 As Object\n" +
+				"\tSet Sess0 = System.ActiveSession\n" +
+				"\tg_HostSettleTime = 3000\n" +
+				"\tSess0.Screen.WaitHostQuiet(g_HostSettleTime)\n" +
+				"\tSess0.Screen.PutString \"user1\", 5, 21\n" +
+				"\tSess0.Screen.SendKeys(\"<Tab>pw<Enter>\")\n" +
+				"\tSess0.Screen.MoveTo 6, 1\n" +
+				"End Sub\n",
+			want: &Script{Actions: []Action{
+				{Kind: WaitInputReady, Line: 6},
+				{Kind: Cursor, Row: 5, Column: 21, Line: 7},
+				{Kind: Text, Text: "user1", Line: 7},
+				{Kind: Key, Key: "Tab", Line: 8},
+				{Kind: Text, Text: "pw", Line: 8},
+				{Kind: Key, Key: "Enter", Line: 8},
+				{Kind: Cursor, Row: 6, Column: 1, Line: 9},
+			}},
+		},
+		{
+			// Subs are converted where they are called, in the order of the
+			// calls, with their parameters set to the arguments.
+			name:   "Basic subs",
+			format: FormatBasic,
+			src: "Sub Logon(ByVal user As String, pass$)\n" +
+				"  Session.PutString user, 5, 21\n" +
+				"  Session.PutString pass, 6, 21\n" +
+				"End Sub\n" +
+				"Private Sub PressEnter\n" +
+				"  Session.TransmitTerminalKey rcIBMEnterKey\n" +
+				"End Sub\n" +
+				"Session.WaitForDisplayString \"LOGON\", \"00:00:05\", 1, 2\n" +
+				"Call Logon(\"alice\", \"pw\")\n" +
+				"PressEnter\n" +
+				"Logon \"bob\", \"pw2\"\n",
+			want: &Script{Actions: []Action{
+				{Kind: WaitText, Text: "LOGON", Row: 1, Column: 2, Timeout: 5 * time.Second, Line: 8},
+				{Kind: Cursor, Row: 5, Column: 21, Line: 2},
+				{Kind: Text, Text: "alice", Line: 2},
+				{Kind: Cursor, Row: 6, Column: 21, Line: 3},
+				{Kind: Text, Text: "pw", Line: 3},
+				{Kind: Key, Key: "Enter", Line: 6},
+				{Kind: Cursor, Row: 5, Column: 21, Line: 2},
+				{Kind: Text, Text: "bob", Line: 2},
+				{Kind: Cursor, Row: 6, Column: 21, Line: 3},
+				{Kind: Text, Text: "pw2", Line: 3},
+			}},
+		},
+		{
+			name:   "HATS",
+			format: FormatHATS,
+			src: `<?xml version="1.0" encoding="UTF-8" ?>
+<HAScript name="logon" timeout="60000" usevars="false">
+  <screen name="Screen1" entryscreen="true" exitscreen="false">
+    <description>
+      <oia status="NOTINHIBITED" optional="false" invertmatch="false" />
+      <string value="LOGON" row="1" col="29" />
+    </description>
+    <actions>
+      <input value="user1[tab]" row="5" col="21" />
+      <input value="[enter]" />
+    </actions>
+    <nextscreens timeout="5000">
+      <nextscreen name="Screen2" />
+    </nextscreens>
+  </screen>
+  <screen name="Screen2" exitscreen="true">
+    <description>
+      <string value="READY" row="2" col="1" />
+    </description>
+    <actions>
+      <pause value="250" />
+    </actions>
+  </screen>
+</HAScript>
+`,
+			want: &Script{Actions: []Action{
+				{Kind: WaitInputReady, Line: 5},
+				{Kind: WaitText, Text: "LOGON", Row: 1, Column: 29, Line: 6},
+				{Kind: Cursor, Row: 5, Column: 21, Line: 9},
+				{Kind: Text, Text: "user1", Line: 9},
+				{Kind: Key, Key: "Tab", Line: 9},
+				{Kind: Key, Key: "Enter", Line: 10},
+				{Kind: WaitText, Text: "READY", Row: 2, Column: 1, Timeout: 5 * time.Second, Line: 18},
+				{Kind: Pause, Timeout: 250 * time.Millisecond, Line: 21},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		got, err := Import("macro", []byte(tt.src), tt.format)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Import =\n%+v\nwant\n%+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestImportErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		src    string
+		want   []string
+	}{
+		{
+			name:   "s3270",
+			format: FormatS3270,
+			src:    "Connect(lu@host)\nString(\"x\"\nWait(Disconnect)\nPF(25)\nString(\"\\e\")\nScript(x)\n",
+			want: []string{
+				"m:1: connecting to a specific LU (lu@host) is not supported",
+				"m:2: missing \")\"",
+				"m:3: Wait(Disconnect) is not supported",
+				"m:4: PF(25) is not supported",
+				"m:5: \\e in String is not supported",
+				"m:6: Script is not supported",
+			},
+		},
+		{
+			name:   "PCOMM",
+			format: FormatPCOMM,
+			src: "Dim t\nt = autECLSession.autECLPS.GetText(1, 1, 5)\nautECLSession.autECLPS.SendKeys t\n" +
+				"autECLSession.autECLPS.WaitForString \"x\"\nFor i = 1 To 3\nMsgBox \"done\"\n" +
+				"If x Then autECLSession.autECLPS.SendKeys \"[enter]\"\n",
+			want: []string{
+				"m:3: the value read at line 2 is only known when the macro runs and cannot be converted",
+				"m:4: WaitForString without a position is not supported",
+				"m:5: For is not supported",
+				"m:6: MsgBox is not supported",
+				"m:7: If statements around screen operations are not supported",
+			},
+		},
+		{
+			name:   "Basic subs",
+			format: FormatBasic,
+			src: "Sub Loop1\n  Loop2\nEnd Sub\nSub Loop2\n  Loop1\nEnd Sub\nSub Two(a, b)\nEnd Sub\n" +
+				"Loop1\nTwo 1, 2, 3\nMissing 1\nSub Open\n",
+			want: []string{
+				"m:12: Sub Open without End Sub",
+				"m:5: recursive call to Loop1 is not supported",
+				"m:10: Two takes 2 argument(s)",
+				"m:11: Missing is not supported",
+			},
+		},
+		{
+			name:   "HATS",
+			format: FormatHATS,
+			src: `<HAScript usevars="true">
+  <screen name="A" entryscreen="true">
+    <description><cursor row="1" col="1" /><string value="'x'" /></description>
+    <actions><input value="$v$" /><input value="'p'" encrypted="true" /><extract /></actions>
+    <nextscreens><nextscreen name="A" /></nextscreens>
+  </screen>
+</HAScript>`,
+			want: []string{
+				"m:3: text descriptors without a position are not supported",
+				"m:4: expression $v$ is not supported",
+				"m:4: encrypted input is not supported; use a Secret FillString step",
+				"m:4: extract action is not supported",
+				"m:2: screen A is reached twice; loops are not supported",
+			},
+		},
+		{
+			name:   "not XML",
+			format: FormatHATS,
+			src:    "plain text",
+			want:   []string{"m:1: no XML elements found"},
+		},
+	}
+	for _, tt := range tests {
+		_, err := Import("m", []byte(tt.src), tt.format)
+		if err == nil {
+			t.Errorf("%s: Import succeeded, want %q", tt.name, tt.want)
+			continue
+		}
+		if got := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Import errors =\n%s\nwant\n%s", tt.name, strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+		}
+	}
+	if _, err := Import("m", nil, "rexx"); err == nil || !strings.Contains(err.Error(), "unknown macro format") {
+		t.Errorf("Import of an unknown format gave %v", err)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		file string
+		src  string
+		want string
+	}{
+		{"logon.mac", "[PCOMM SCRIPT HEADER]\n", FormatPCOMM},
+		{"logon.vbs", "autECLSession.autECLPS.SendKeys \"x\"", FormatPCOMM},
+		{"logon", "yield ps.sendKeys('x');", FormatHOD},
+		{"logon", "\xef\xbb\xbf  <HAScript/>", FormatHATS},
+		{"logon.xml", "", FormatHATS},
+		{"logon.hma", "", FormatHATS},
+		{"logon.EBM", "Sub Main\nEnd Sub", FormatBasic},
+		{"logon.rbs", "", FormatBasic},
+		{"logon.mac", "Sub Main\nEnd Sub", FormatPCOMM},
+		{"logon.js", "", FormatHOD},
+		{"logon.s3270", "String(x)", FormatS3270},
+		{"logon", "String(x)", ""},
+	}
+	for _, tt := range tests {
+		got, err := DetectFormat(tt.file, []byte(tt.src))
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("DetectFormat(%q, %q) = %q, %v, want %q", tt.file, tt.src, got, err, tt.want)
+		}
+	}
+}
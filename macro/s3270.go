@@ -0,0 +1,268 @@
+package macro
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseS3270 converts an x3270/s3270 script with one or more actions per
+// line, written as Action(arg, ...) or Action arg ... Lines starting with #
+// are comments.
+func parseS3270(file string, data []byte) (*Script, error) {
+	script := &Script{}
+	var errs ErrorList
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		calls, err := splitS3270Actions(line)
+		if err != nil {
+			errs = append(errs, &Error{file, i + 1, err.Error()})
+			continue
+		}
+		for _, call := range calls {
+			if err := script.s3270Action(call[0], call[1:], i+1); err != nil {
+				errs = append(errs, &Error{file, i + 1, err.Error()})
+			}
+		}
+	}
+	return script, errs.err()
+}
+
+// splitS3270Actions splits a line into actions, each given as its name
+// followed by its arguments.
+func splitS3270Actions(line string) ([][]string, error) {
+	var calls [][]string
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		end := strings.IndexAny(line, "( \t")
+		if end < 0 {
+			return append(calls, []string{line}), nil
+		}
+		name := line[:end]
+		if line[end] != '(' {
+			// Action arg arg ... takes the rest of the line.
+			args, rest, err := s3270Arguments(line[end:], "")
+			if err != nil {
+				return nil, err
+			}
+			if rest != "" {
+				return nil, fmt.Errorf("unexpected %q", rest)
+			}
+			return append(calls, append([]string{name}, args...)), nil
+		}
+		args, rest, err := s3270Arguments(line[end+1:], ")")
+		if err != nil {
+			return nil, err
+		}
+		calls = append(calls, append([]string{name}, args...))
+		line = rest
+	}
+	return calls, nil
+}
+
+// s3270Arguments reads arguments separated by commas or spaces up to closer,
+// or to the end of s if closer is empty, and returns what follows.
+func s3270Arguments(s, closer string) ([]string, string, error) {
+	var args []string
+	for i := 0; ; {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == ',') {
+			i++
+		}
+		if i >= len(s) {
+			if closer != "" {
+				return nil, "", fmt.Errorf("missing %q", closer)
+			}
+			return args, "", nil
+		}
+		if closer != "" && s[i] == closer[0] {
+			return args, s[i+1:], nil
+		}
+		if s[i] == '"' {
+			// Quoted arguments keep their backslash escapes for String to
+			// interpret, apart from \" and \\.
+			var sb strings.Builder
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+					i++
+					if s[i] == '\\' {
+						sb.WriteByte('\\')
+					}
+				}
+				sb.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return nil, "", fmt.Errorf("unterminated string")
+			}
+			args = append(args, sb.String())
+			i++
+			continue
+		}
+		start := i
+		for i < len(s) && !strings.ContainsRune(" \t,", rune(s[i])) && (closer == "" || s[i] != closer[0]) {
+			i++
+		}
+		args = append(args, s[start:i])
+	}
+}
+
+func (s *Script) s3270Action(name string, args []string, line int) error {
+	add := func(a Action) {
+		a.Line = line
+		s.Actions = append(s.Actions, a)
+	}
+	switch strings.ToLower(name) {
+	case "connect", "open":
+		if len(args) != 1 {
+			return fmt.Errorf("%s needs a host", name)
+		}
+		return s.SetHost(args[0])
+	case "disconnect", "quit", "exit", "close":
+		// Workflows always end by disconnecting.
+	case "string":
+		for _, arg := range args {
+			actions, err := s3270String(arg)
+			if err != nil {
+				return err
+			}
+			for _, a := range actions {
+				add(a)
+			}
+		}
+	case "enter", "tab", "clear":
+		key, _ := NormalizeKey(name)
+		add(Action{Kind: Key, Key: key})
+	case "pf":
+		if len(args) != 1 {
+			return fmt.Errorf("PF needs a key number")
+		}
+		key, ok := NormalizeKey("PF" + args[0])
+		if !ok {
+			return fmt.Errorf("PF(%s) is not supported", args[0])
+		}
+		add(Action{Kind: Key, Key: key})
+	case "movecursor", "movecursor1":
+		if len(args) != 2 {
+			return fmt.Errorf("%s needs a row and a column", name)
+		}
+		row, errRow := strconv.Atoi(args[0])
+		col, errCol := strconv.Atoi(args[1])
+		if errRow != nil || errCol != nil {
+			return fmt.Errorf("%s needs a numeric row and column", name)
+		}
+		if strings.ToLower(name) == "movecursor" {
+			// MoveCursor counts from 0.
+			row, col = row+1, col+1
+		}
+		add(Action{Kind: Cursor, Row: row, Column: col})
+	case "wait":
+		return s.s3270Wait(args, add)
+	case "ascii", "ascii1", "printtext":
+		// With arguments, Ascii only shows part of the screen.
+		if len(args) == 0 || strings.ToLower(name) == "printtext" {
+			add(Action{Kind: Capture})
+		}
+	default:
+		return fmt.Errorf("%s is not supported", name)
+	}
+	return nil
+}
+
+// s3270Wait converts Wait([timeout,] condition) and Wait(n, Seconds).
+func (s *Script) s3270Wait(args []string, add func(Action)) error {
+	var timeout time.Duration
+	if len(args) == 2 {
+		n, err := strconv.ParseFloat(args[0], 64)
+		if err != nil {
+			return fmt.Errorf("Wait timeout %q is not a number", args[0])
+		}
+		timeout = time.Duration(n * float64(time.Second))
+		args = args[1:]
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("Wait needs a condition")
+	}
+	switch strings.ToLower(args[0]) {
+	case "inputfield", "unlock", "output":
+		add(Action{Kind: WaitInputReady, Timeout: timeout})
+	case "3270mode":
+		// Connect already waits for the first screen.
+	case "seconds":
+		add(Action{Kind: Pause, Timeout: timeout})
+	default:
+		return fmt.Errorf("Wait(%s) is not supported", args[0])
+	}
+	return nil
+}
+
+// SetHost sets Host and Port from a host given as in an x3270 Connect
+// action: [prefix:]...host[:port].
+func (s *Script) SetHost(spec string) error {
+	for len(spec) > 2 && spec[1] == ':' {
+		spec = spec[2:]
+	}
+	if strings.Contains(spec, "@") {
+		return fmt.Errorf("connecting to a specific LU (%s) is not supported", spec)
+	}
+	host, port := spec, ""
+	if strings.HasPrefix(host, "[") {
+		if end := strings.Index(host, "]"); end > 0 {
+			host, port = host[1:end], strings.TrimPrefix(host[end+1:], ":")
+		}
+	} else if i := strings.LastIndexAny(host, ": "); i >= 0 {
+		host, port = host[:i], host[i+1:]
+	}
+	s.Host = host
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil {
+			return fmt.Errorf("port %q is not a number", port)
+		}
+		s.Port = n
+	}
+	return nil
+}
+
+// s3270String converts the argument of String, in which \n presses Enter, \t
+// presses Tab and \pfNN presses a PF key.
+func s3270String(arg string) ([]Action, error) {
+	var actions []Action
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			actions = append(actions, Action{Kind: Text, Text: text.String()})
+			text.Reset()
+		}
+	}
+	for i := 0; i < len(arg); i++ {
+		if arg[i] != '\\' || i+1 == len(arg) {
+			text.WriteByte(arg[i])
+			continue
+		}
+		i++
+		switch {
+		case arg[i] == '\\':
+			text.WriteByte('\\')
+		case arg[i] == 'n':
+			flush()
+			actions = append(actions, Action{Kind: Key, Key: "Enter"})
+		case arg[i] == 't':
+			flush()
+			actions = append(actions, Action{Kind: Key, Key: "Tab"})
+		case strings.HasPrefix(arg[i:], "pf") && i+4 <= len(arg):
+			key, ok := NormalizeKey(arg[i : i+4])
+			if !ok {
+				return nil, fmt.Errorf("\\%s in String is not supported", arg[i:i+4])
+			}
+			flush()
+			actions = append(actions, Action{Kind: Key, Key: key})
+			i += 3
+		default:
+			return nil, fmt.Errorf("\\%c in String is not supported", arg[i])
+		}
+	}
+	flush()
+	return actions, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+// Prometheus metrics. The dashboard and API servers publish the results at
+// /metrics in the Prometheus text exposition format, so that a run can be
+// graphed next to the metrics of the host it drives. Every series has run and
+// host labels: the workflow name, or the configuration file name, and the
+// name of the machine 3270Connect runs on.
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3270io/3270Connect/histogram"
+)
+
+// prometheusPrefix starts the name of every metric.
+const prometheusPrefix = "connect3270_"
+
+// prometheusBuckets are the upper bounds in seconds of the duration
+// histogram buckets.
+var prometheusBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+// metricsHandler serves the results returned by results at /metrics.
+func metricsHandler(results func() Metrics) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		out := bufio.NewWriter(w)
+		writePrometheus(out, results())
+		out.Flush()
+	}
+}
+
+// runLabel returns the run label of the metrics: the workflow selected with
+// -workflow, or the name of the configuration file without its extension.
+func runLabel() string {
+	if workflowName != "" {
+		return workflowName
+	}
+	base := filepath.Base(configFile)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// prometheusWriter writes metric families with the run and host labels.
+type prometheusWriter struct {
+	out    *bufio.Writer
+	labels string // run and host, formatted
+}
+
+// family writes the HELP and TYPE lines of a metric.
+func (p *prometheusWriter) family(name, kind, help string) {
+	fmt.Fprintf(p.out, "# HELP %s%s %s\n# TYPE %s%s %s\n", prometheusPrefix, name, help, prometheusPrefix, name, kind)
+}
+
+// sample writes one value of a metric with the extra labels given as name,
+// value pairs.
+func (p *prometheusWriter) sample(name string, value float64, labels ...string) {
+	fmt.Fprintf(p.out, "%s%s{%s", prometheusPrefix, name, p.labels)
+	for i := 0; i+1 < len(labels); i += 2 {
+		fmt.Fprintf(p.out, ",%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+	}
+	fmt.Fprintf(p.out, "} %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// histogram writes the buckets, sum and count of h as the metric name.
+func (p *prometheusWriter) histogram(name string, h *histogram.Histogram, labels ...string) {
+	withLE := func(le string) []string {
+		return append(append([]string(nil), labels...), "le", le)
+	}
+	for _, le := range prometheusBuckets {
+		n := h.CountAtOrBelow(time.Duration(le * float64(time.Second)))
+		p.sample(name+"_bucket", float64(n), withLE(strconv.FormatFloat(le, 'g', -1, 64))...)
+	}
+	var count int64
+	if h != nil {
+		count = h.Count
+	}
+	p.sample(name+"_bucket", float64(count), withLE("+Inf")...)
+	p.sample(name+"_sum", h.SumSeconds(), labels...)
+	p.sample(name+"_count", float64(count), labels...)
+}
+
+// escapeLabel escapes a label value for the exposition format.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// writePrometheus writes m and the state of this process to out.
+func writePrometheus(out *bufio.Writer, m Metrics) {
+	host, _ := os.Hostname()
+	p := &prometheusWriter{out: out, labels: fmt.Sprintf(`run="%s",host="%s"`, escapeLabel(runLabel()), escapeLabel(host))}
+
+	p.family("active_workflows", "gauge", "Workflows running now.")
+	p.sample("active_workflows", float64(m.ActiveWorkflows))
+	p.family("workflows_started_total", "counter", "Workflows started.")
+	p.sample("workflows_started_total", float64(m.TotalWorkflowsStarted))
+	p.family("workflows_completed_total", "counter", "Workflows that completed successfully.")
+	p.sample("workflows_completed_total", float64(m.TotalWorkflowsCompleted))
+	p.family("workflows_failed_total", "counter", "Workflows that failed.")
+	p.sample("workflows_failed_total", float64(m.TotalWorkflowsFailed))
+	p.family("iterations_dropped_total", "counter", "Arrivals not started because MaxInFlight iterations were running.")
+	p.sample("iterations_dropped_total", float64(m.TotalIterationsDropped))
+
+	p.family("workflow_duration_seconds", "histogram", "Durations of workflows.")
+	p.histogram("workflow_duration_seconds", m.Durations)
+	if len(m.Transactions) > 0 {
+		p.family("transaction_duration_seconds", "histogram", "Durations of named transactions.")
+		for _, t := range summarizeTransactions(m.Transactions) {
+			p.histogram("transaction_duration_seconds", m.Transactions[t.Name], "transaction", t.Name)
+		}
+	}
+
+	if len(m.Steps) > 0 {
+		steps := summarizeSteps(m.Steps)
+		p.family("step_executions_total", "counter", "Executions of each step of the workflow.")
+		for _, st := range steps {
+			p.sample("step_executions_total", float64(st.Executions), "step", st.Name, "type", st.Type)
+		}
+		p.family("step_failures_total", "counter", "Executions of each step that failed after any retries.")
+		for _, st := range steps {
+			p.sample("step_failures_total", float64(st.Failures), "step", st.Name, "type", st.Type)
+		}
+		p.family("step_retries_total", "counter", "Retries of each step.")
+		for _, st := range steps {
+			p.sample("step_retries_total", float64(st.Retries), "step", st.Name, "type", st.Type)
+		}
+	}
+	if len(m.StepFailures) > 0 {
+		p.family("step_errors_total", "counter", "Failed steps by step and error category.")
+		for _, f := range summarizeStepFailures(m.StepFailures) {
+			p.sample("step_errors_total", float64(f.Failures), "step", f.Step, "category", f.Category)
+		}
+	}
+	if len(m.StepTypes) > 0 {
+		types := make([]string, 0, len(m.StepTypes))
+		for name := range m.StepTypes {
+			types = append(types, name)
+		}
+		sort.Strings(types)
+		p.family("step_duration_seconds", "histogram", "Durations of steps by type, including retries.")
+		for _, name := range types {
+			p.histogram("step_duration_seconds", &m.StepTypes[name].Durations, "type", name)
+		}
+	}
+
+	emulatorsMutex.Lock()
+	running := len(emulators)
+	emulatorsMutex.Unlock()
+	p.family("emulator_processes", "gauge", "Emulator processes this process is running.")
+	p.sample("emulator_processes", float64(running))
+	if scriptPorts != nil {
+		p.family("script_ports_leased", "gauge", "Script ports leased to emulators.")
+		p.sample("script_ports_leased", float64(scriptPorts.Leased()))
+	}
+
+	mutex.Lock()
+	var cpuUsage, memUsage float64
+	if len(cpuHistory) > 0 {
+		cpuUsage = cpuHistory[len(cpuHistory)-1]
+	}
+	if len(memHistory) > 0 {
+		memUsage = memHistory[len(memHistory)-1]
+	}
+	mutex.Unlock()
+	p.family("host_cpu_percent", "gauge", "CPU use of the host 3270Connect runs on.")
+	p.sample("host_cpu_percent", cpuUsage)
+	p.family("host_memory_percent", "gauge", "Memory use of the host 3270Connect runs on.")
+	p.sample("host_memory_percent", memUsage)
+}
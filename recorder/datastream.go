@@ -0,0 +1,454 @@
+package recorder
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Telnet bytes used by TN3270.
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+	telnetEOR  = 239
+
+	optionTN3270E = 40
+)
+
+// telnetReader splits one direction of a telnet connection into 3270
+// records, which end with IAC EOR, and reports option negotiation.
+type telnetReader struct {
+	state    int
+	command  byte
+	record   []byte
+	onRecord func(record []byte)
+	onOption func(command, option byte)
+}
+
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSub
+	telnetSubCommand
+)
+
+func (t *telnetReader) write(p []byte) {
+	for _, b := range p {
+		switch t.state {
+		case telnetData:
+			if b == telnetIAC {
+				t.state = telnetCommand
+			} else {
+				t.record = append(t.record, b)
+			}
+		case telnetCommand:
+			t.state = telnetData
+			switch {
+			case b == telnetIAC:
+				t.record = append(t.record, b)
+			case b == telnetEOR:
+				if len(t.record) > 0 {
+					t.onRecord(t.record)
+				}
+				t.record = nil
+			case b == telnetSB:
+				t.state = telnetSub
+			case b >= telnetWILL && b <= telnetDONT:
+				t.command = b
+				t.state = telnetOption
+			}
+		case telnetOption:
+			if t.onOption != nil {
+				t.onOption(t.command, b)
+			}
+			t.state = telnetData
+		case telnetSub:
+			if b == telnetIAC {
+				t.state = telnetSubCommand
+			}
+		case telnetSubCommand:
+			if b == telnetSE {
+				t.state = telnetData
+			} else {
+				t.state = telnetSub
+			}
+		}
+	}
+}
+
+// 3270 orders in outbound data.
+const (
+	orderPT  = 0x05
+	orderGE  = 0x08
+	orderSBA = 0x11
+	orderEUA = 0x12
+	orderIC  = 0x13
+	orderSF  = 0x1d
+	orderSA  = 0x28
+	orderSFE = 0x29
+	orderMF  = 0x2c
+	orderRA  = 0x3c
+)
+
+// Field attribute bits.
+const (
+	attrProtected  = 0x20
+	attrNonDisplay = 0x0c
+	attrModified   = 0x01
+)
+
+// screen is the terminal's buffer as written by the host and by the fields
+// the user sends back.
+type screen struct {
+	rows, columns int
+	data          []byte // EBCDIC characters
+	field         []bool // Whether the position holds a field attribute
+	attr          []byte // Field attribute at positions where field is true
+	cursor        int
+}
+
+func newScreen(rows, columns int) *screen {
+	s := &screen{}
+	s.reset(rows, columns)
+	return s
+}
+
+func (s *screen) reset(rows, columns int) {
+	s.rows, s.columns = rows, columns
+	s.data = make([]byte, rows*columns)
+	s.field = make([]bool, rows*columns)
+	s.attr = make([]byte, rows*columns)
+	s.cursor = 0
+}
+
+func (s *screen) size() int {
+	return len(s.data)
+}
+
+// address decodes a 12, 14 or 16-bit buffer address.
+func (s *screen) address(b1, b2 byte) int {
+	var addr int
+	if b1&0xc0 == 0 {
+		addr = int(b1&0x3f)<<8 | int(b2)
+	} else {
+		addr = int(b1&0x3f)<<6 | int(b2&0x3f)
+	}
+	return addr % s.size()
+}
+
+// position returns the 1-based row and column of a buffer address.
+func (s *screen) position(addr int) (int, int) {
+	return addr/s.columns + 1, addr%s.columns + 1
+}
+
+// fieldAt returns the address of the attribute of the field containing addr,
+// or -1 if the screen is unformatted.
+func (s *screen) fieldAt(addr int) int {
+	for i := 0; i < s.size(); i++ {
+		p := (addr - i + s.size()) % s.size()
+		if s.field[p] {
+			return p
+		}
+	}
+	return -1
+}
+
+func (s *screen) protected(addr int) bool {
+	f := s.fieldAt(addr)
+	return f >= 0 && s.attr[f]&attrProtected != 0
+}
+
+func (s *screen) hidden(addr int) bool {
+	f := s.fieldAt(addr)
+	return f >= 0 && s.attr[f]&attrNonDisplay == attrNonDisplay
+}
+
+// formatted reports whether the screen has any fields.
+func (s *screen) formatted() bool {
+	for _, f := range s.field {
+		if f {
+			return true
+		}
+	}
+	return false
+}
+
+// write applies an outbound 3270 command. EraseWrite and EraseWriteAlternate
+// clear the screen at the size given for each.
+func (s *screen) write(record []byte, rows, columns, altRows, altColumns int) {
+	if len(record) == 0 {
+		return
+	}
+	switch record[0] {
+	case 0xf1, 0x01: // Write
+		s.orders(record[1:])
+	case 0xf5, 0x05: // Erase/Write
+		s.reset(rows, columns)
+		s.orders(record[1:])
+	case 0x7e, 0x0d: // Erase/Write Alternate
+		s.reset(altRows, altColumns)
+		s.orders(record[1:])
+	case 0x6f, 0x0f: // Erase All Unprotected
+		s.eraseUnprotected(0, 0)
+	case 0xf3, 0x11: // Write Structured Field
+		for sf := record[1:]; len(sf) >= 3; {
+			n := int(sf[0])<<8 | int(sf[1])
+			if n == 0 || n > len(sf) {
+				n = len(sf)
+			}
+			// Outbound 3270DS carries a partition ID and a write command.
+			if sf[2] == 0x40 && n > 4 {
+				s.write(sf[4:n], rows, columns, altRows, altColumns)
+			}
+			sf = sf[n:]
+		}
+	}
+}
+
+// orders applies the write control character and orders of a write command.
+func (s *screen) orders(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	p = p[1:] // WCC
+	addr := s.cursor
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case orderSBA:
+			if i+2 < len(p) {
+				addr = s.address(p[i+1], p[i+2])
+			}
+			i += 2
+		case orderSF:
+			if i+1 < len(p) {
+				s.setField(addr, p[i+1])
+				addr = (addr + 1) % s.size()
+			}
+			i++
+		case orderSFE, orderMF:
+			if i+1 >= len(p) {
+				break
+			}
+			n := int(p[i+1])
+			attr, basic := byte(0), false
+			for j := 0; j < n && i+3+2*j < len(p); j++ {
+				if p[i+2+2*j] == 0xc0 {
+					attr, basic = p[i+3+2*j], true
+				}
+			}
+			if p[i] == orderSFE {
+				s.setField(addr, attr)
+			} else if basic && s.field[addr] {
+				s.attr[addr] = attr
+			}
+			addr = (addr + 1) % s.size()
+			i += 1 + 2*n
+		case orderSA:
+			i += 2
+		case orderIC:
+			s.cursor = addr
+		case orderPT:
+			addr = s.nextInput(addr)
+		case orderRA:
+			if i+3 >= len(p) {
+				i = len(p)
+				break
+			}
+			stop := s.address(p[i+1], p[i+2])
+			c := p[i+3]
+			i += 3
+			if c == orderGE && i+1 < len(p) {
+				i++
+				c = p[i]
+			}
+			for {
+				s.set(addr, c)
+				addr = (addr + 1) % s.size()
+				if addr == stop {
+					break
+				}
+			}
+		case orderEUA:
+			if i+2 < len(p) {
+				stop := s.address(p[i+1], p[i+2])
+				s.eraseUnprotected(addr, stop)
+				addr = stop
+			}
+			i += 2
+		case orderGE:
+			if i+1 < len(p) {
+				s.set(addr, p[i+1])
+				addr = (addr + 1) % s.size()
+			}
+			i++
+		default:
+			s.set(addr, p[i])
+			addr = (addr + 1) % s.size()
+		}
+	}
+}
+
+func (s *screen) set(addr int, c byte) {
+	s.data[addr] = c
+	s.field[addr] = false
+}
+
+func (s *screen) setField(addr int, attr byte) {
+	s.data[addr] = 0
+	s.field[addr] = true
+	s.attr[addr] = attr
+}
+
+// eraseUnprotected clears unprotected characters from start up to stop, or
+// the whole screen if they are equal.
+func (s *screen) eraseUnprotected(start, stop int) {
+	for addr := start; ; {
+		if s.field[addr] {
+			s.attr[addr] &^= attrModified
+		} else if !s.protected(addr) {
+			s.data[addr] = 0
+		}
+		addr = (addr + 1) % s.size()
+		if addr == stop {
+			break
+		}
+	}
+}
+
+// nextInput returns the first position of the next unprotected field after
+// addr, or 0 if there is none.
+func (s *screen) nextInput(addr int) int {
+	for i := 1; i <= s.size(); i++ {
+		p := (addr + i) % s.size()
+		if s.field[p] && s.attr[p]&attrProtected == 0 {
+			return (p + 1) % s.size()
+		}
+	}
+	return 0
+}
+
+// input applies text the user sent for the field starting at addr. Nulls
+// are not sent, so the rest of the field is cleared.
+func (s *screen) input(addr int, text []byte) {
+	for i := 0; i < s.size(); i++ {
+		p := (addr + i) % s.size()
+		if s.field[p] {
+			return
+		}
+		if i < len(text) {
+			s.data[p] = text[i]
+		} else {
+			s.data[p] = 0
+		}
+	}
+}
+
+// char returns the character shown at addr.
+func (s *screen) char(addr int) rune {
+	c := s.data[addr]
+	if s.field[addr] || c < 0x40 || s.hidden(addr) {
+		return ' '
+	}
+	r := charmap.CodePage037.DecodeByte(c)
+	if !unicode.IsPrint(r) {
+		return ' '
+	}
+	return r
+}
+
+// String returns the screen as text, one line per row.
+func (s *screen) String() string {
+	var sb strings.Builder
+	for row := 0; row < s.rows; row++ {
+		line := make([]rune, s.columns)
+		for col := range line {
+			line[col] = s.char(row*s.columns + col)
+		}
+		sb.WriteString(strings.TrimRight(string(line), " "))
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+// titleText is text at a position on the screen.
+type titleText struct {
+	text        string
+	row, column int
+}
+
+// titles returns text that can identify the screen: protected runs of words,
+// read from the top, that are mostly letters and have no numbers written
+// with separators, so that dates, times and counters are left out. Runs are
+// separated by field attributes or by two or more spaces.
+func (s *screen) titles() []titleText {
+	var titles []titleText
+	formatted := s.formatted()
+	for r := 0; r < s.rows; r++ {
+		start := -1
+		for c := 0; c <= s.columns; c++ {
+			addr := r*s.columns + c
+			end := c == s.columns || s.field[addr] || (formatted && !s.protected(addr)) ||
+				(s.char(addr) == ' ' && (c+1 == s.columns || s.char(addr+1) == ' '))
+			if !end {
+				if start < 0 && s.char(addr) != ' ' {
+					start = c
+				}
+				continue
+			}
+			if start >= 0 {
+				if text := s.text(r*s.columns+start, c-start); usableTitle(text) {
+					titles = append(titles, titleText{text, r + 1, start + 1})
+				}
+				start = -1
+			}
+		}
+	}
+	return titles
+}
+
+func (s *screen) text(addr, length int) string {
+	runes := make([]rune, length)
+	for i := range runes {
+		runes[i] = s.char(addr + i)
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+func usableTitle(text string) bool {
+	letters, digits := 0, 0
+	runes := []rune(text)
+	for i, r := range runes {
+		switch {
+		case unicode.IsLetter(r):
+			letters++
+		case unicode.IsDigit(r):
+			digits++
+			for _, n := range []int{i - 1, i + 1} {
+				if n >= 0 && n < len(runes) && strings.ContainsRune(":/.,-", runes[n]) {
+					return false
+				}
+			}
+		}
+	}
+	return letters >= 3 && letters > digits
+}
+
+// decode converts EBCDIC text sent by the terminal.
+func decode(p []byte) string {
+	runes := make([]rune, 0, len(p))
+	for _, c := range p {
+		if c < 0x40 {
+			runes = append(runes, ' ')
+			continue
+		}
+		runes = append(runes, charmap.CodePage037.DecodeByte(c))
+	}
+	return string(runes)
+}
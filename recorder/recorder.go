@@ -0,0 +1,270 @@
+// Package recorder records workflows from interactive terminal sessions. It
+// sits between an emulator and the host as a TN3270 proxy, follows the
+// screens the host sends and turns the fields and keys the user sends back
+// into macro actions, with a text check for every screen reached.
+package recorder
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/3270io/3270Connect/macro"
+)
+
+// aidKeys names the attention keys a workflow can press.
+var aidKeys = map[byte]string{
+	0x7d: "Enter", 0x6d: "Clear",
+	0xf1: "PF1", 0xf2: "PF2", 0xf3: "PF3", 0xf4: "PF4", 0xf5: "PF5", 0xf6: "PF6",
+	0xf7: "PF7", 0xf8: "PF8", 0xf9: "PF9", 0x7a: "PF10", 0x7b: "PF11", 0x7c: "PF12",
+	0xc1: "PF13", 0xc2: "PF14", 0xc3: "PF15", 0xc4: "PF16", 0xc5: "PF17", 0xc6: "PF18",
+	0xc7: "PF19", 0xc8: "PF20", 0xc9: "PF21", 0x4a: "PF22", 0x4b: "PF23", 0x4c: "PF24",
+}
+
+// Attention keys that send no fields and those that can only be recorded as
+// a warning.
+var (
+	shortReadKeys = map[byte]bool{0x6d: true, 0x6c: true, 0x6e: true, 0x6b: true}
+	otherKeys     = map[byte]string{0x6c: "PA1", 0x6e: "PA2", 0x6b: "PA3"}
+)
+
+// Recorder relays one terminal session to Host and Port and records it.
+type Recorder struct {
+	Host string
+	Port int
+	// Rows and Columns give the alternate screen size of the emulator, 24x80
+	// if not set.
+	Rows, Columns int
+	// CheckTimeout is how long each text check waits for its screen.
+	CheckTimeout time.Duration
+	// OnAction, if set, is called for every action as it is recorded.
+	OnAction func(macro.Action)
+
+	mu       sync.Mutex
+	screen   *screen
+	changed  bool // The host has written to the screen since it was last checked
+	hostDo   bool // The host asked for TN3270E
+	termWill bool // The emulator agreed to TN3270E
+	checked  titleText
+	result   Recording
+}
+
+// Recording is what was recorded in a session.
+type Recording struct {
+	Script   *macro.Script
+	Screens  []string // Screens as text, in the order they were reached
+	Warnings []string // What the user did that could not be recorded
+}
+
+// Record accepts one emulator connection on l and relays it to the host
+// until either side disconnects or stop is closed. It returns what was
+// recorded even if the session ended with an error.
+func (r *Recorder) Record(l net.Listener, stop <-chan struct{}) (*Recording, error) {
+	if r.Rows == 0 || r.Columns == 0 {
+		r.Rows, r.Columns = 24, 80
+	}
+	r.screen = newScreen(24, 80)
+	r.result = Recording{Script: &macro.Script{Host: r.Host, Port: r.Port}}
+
+	accepted := make(chan net.Conn, 1)
+	acceptErr := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			acceptErr <- err
+			return
+		}
+		accepted <- conn
+	}()
+	var term net.Conn
+	select {
+	case term = <-accepted:
+	case err := <-acceptErr:
+		return &r.result, err
+	case <-stop:
+		l.Close()
+		return &r.result, nil
+	}
+	defer term.Close()
+
+	host, err := net.Dial("tcp", net.JoinHostPort(r.Host, strconv.Itoa(r.Port)))
+	if err != nil {
+		return &r.result, err
+	}
+	defer host.Close()
+
+	fromHost := &telnetReader{onRecord: r.outbound, onOption: func(command, option byte) {
+		if option == optionTN3270E && (command == telnetDO || command == telnetDONT) {
+			r.hostDo = command == telnetDO
+		}
+	}}
+	fromTerm := &telnetReader{onRecord: r.inbound, onOption: func(command, option byte) {
+		if option == optionTN3270E && (command == telnetWILL || command == telnetWONT) {
+			r.termWill = command == telnetWILL
+		}
+	}}
+
+	done := make(chan error, 2)
+	go func() { done <- r.relay(term, host, fromHost) }()
+	go func() { done <- r.relay(host, term, fromTerm) }()
+	finished := 0
+	select {
+	case err = <-done:
+		finished++
+	case <-stop:
+	}
+	// Closing both sides ends the other relay, whose error only says so.
+	term.Close()
+	host.Close()
+	for ; finished < 2; finished++ {
+		<-done
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.check()
+	return &r.result, err
+}
+
+// relay copies from src to dst, passing everything read to t. It returns
+// nil when src is closed.
+func (r *Recorder) relay(dst io.Writer, src io.Reader, t *telnetReader) error {
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			r.mu.Lock()
+			t.write(buf[:n])
+			r.mu.Unlock()
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// data strips the TN3270E header from a record, returning nil for records
+// that do not carry 3270 data.
+func (r *Recorder) data(record []byte) []byte {
+	if !r.hostDo || !r.termWill {
+		return record
+	}
+	if len(record) < 5 || record[0] != 0 {
+		return nil
+	}
+	return record[5:]
+}
+
+// outbound follows a record sent by the host.
+func (r *Recorder) outbound(record []byte) {
+	record = r.data(record)
+	if len(record) == 0 {
+		return
+	}
+	r.screen.write(record, 24, 80, r.Rows, r.Columns)
+	r.changed = true
+}
+
+// inbound records the fields and attention key in a record sent by the
+// emulator.
+func (r *Recorder) inbound(record []byte) {
+	record = r.data(record)
+	if len(record) == 0 {
+		return
+	}
+	aid := record[0]
+	key, ok := aidKeys[aid]
+	if !ok {
+		if name, isKey := otherKeys[aid]; isKey {
+			r.warn("%s cannot be pressed by a workflow and was not recorded", name)
+		}
+		// Anything else is a query reply or a read with no key pressed.
+		return
+	}
+	r.check()
+
+	if !shortReadKeys[aid] && len(record) >= 3 {
+		r.fields(record[1:3], record[3:])
+	}
+	r.add(macro.Action{Kind: macro.Key, Key: key})
+	if key == "Clear" {
+		r.screen.reset(24, 80)
+	}
+}
+
+// fields records the fields the user changed, each sent as SBA, its address
+// and its text, and the cursor if it was moved without typing.
+func (r *Recorder) fields(cursor, p []byte) {
+	cursorAddr := r.screen.address(cursor[0], cursor[1])
+	typed := false
+	for len(p) >= 3 && p[0] == orderSBA {
+		addr := r.screen.address(p[1], p[2])
+		end := 3
+		for end < len(p) && p[end] != orderSBA {
+			end++
+		}
+		text := p[3:end]
+		p = p[end:]
+
+		row, column := r.screen.position(addr)
+		hidden := r.screen.hidden(addr)
+		r.screen.input(addr, text)
+		typed = true
+		if len(text) == 0 {
+			r.warn("the field at row %d, column %d was cleared; clearing fields is not recorded", row, column)
+			continue
+		}
+		r.add(macro.Action{Kind: macro.Cursor, Row: row, Column: column})
+		r.add(macro.Action{Kind: macro.Text, Text: decode(text), Secret: hidden})
+	}
+	if !typed && cursorAddr != r.screen.cursor {
+		row, column := r.screen.position(cursorAddr)
+		r.add(macro.Action{Kind: macro.Cursor, Row: row, Column: column})
+	}
+	r.screen.cursor = cursorAddr
+}
+
+// check records the screen the host last sent, with a text check for it.
+func (r *Recorder) check() {
+	if !r.changed {
+		return
+	}
+	r.changed = false
+	r.result.Screens = append(r.result.Screens, r.screen.String())
+	// Text that the last screen checked also shows, such as an application
+	// banner, would not tell the two apart.
+	titles := r.screen.titles()
+	if len(titles) == 0 {
+		r.warn("screen %d has no text to check", len(r.result.Screens))
+		return
+	}
+	title := titles[0]
+	for _, t := range titles {
+		if t != r.checked {
+			title = t
+			break
+		}
+	}
+	r.checked = title
+	r.add(macro.Action{Kind: macro.WaitText, Text: title.text, Row: title.row, Column: title.column, Timeout: r.CheckTimeout})
+}
+
+func (r *Recorder) add(a macro.Action) {
+	r.result.Script.Actions = append(r.result.Script.Actions, a)
+	if r.OnAction != nil {
+		r.OnAction(a)
+	}
+}
+
+func (r *Recorder) warn(format string, args ...interface{}) {
+	r.result.Warnings = append(r.result.Warnings, fmt.Sprintf(format, args...))
+}
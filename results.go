@@ -0,0 +1,399 @@
+package main
+
+// Results export. With -results, a run writes what happened to a directory for
+// CI systems and spreadsheets: a summary of the run as JSON, every iteration
+// as a row of a CSV file and JUnit XML with a test case for every iteration,
+// every assertion step and every threshold. Iterations are written as they
+// finish, so the files hold the whole run without it being kept in memory.
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3270io/3270Connect/histogram"
+	"github.com/3270io/3270Connect/secrets"
+)
+
+// Files written to the -results directory.
+const (
+	resultsSummaryFile    = "summary.json"
+	resultsIterationsFile = "iterations.csv"
+	resultsJUnitFile      = "junit.xml"
+)
+
+// resultsDir is the directory results are written to, set with -results.
+var resultsDir string
+
+// results writes iterations as they finish, nil without -results.
+var results *resultsWriter
+var resultsMutex sync.Mutex
+
+// resultsWriter streams iterations to the CSV file and to the JUnit test
+// cases, which are kept in a temporary file until the run ends.
+type resultsWriter struct {
+	mu         sync.Mutex
+	started    time.Time
+	csvFile    *os.File
+	csv        *csv.Writer
+	casesFile  *os.File
+	cases      *xml.Encoder
+	iterations int
+	failures   int
+}
+
+// iterationColumns is the header of the iterations CSV file.
+var iterationColumns = []string{"vu", "iteration", "start", "duration", "status", "step", "error"}
+
+// junitTestCase is a test case of the JUnit XML.
+type junitTestCase struct {
+	XMLName   xml.Name      `xml:"testcase"`
+	Classname string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+// junitFailure explains why a test case failed.
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitTestSuite is a test suite of the JUnit XML whose test cases are known
+// when the run ends.
+type junitTestSuite struct {
+	XMLName  xml.Name        `xml:"testsuite"`
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+// runSummary is the summary.json of a run.
+type runSummary struct {
+	Workflow           string             `json:"workflow,omitempty"`
+	Host               string             `json:"host"`
+	Port               int                `json:"port"`
+	Started            time.Time          `json:"started"`
+	Finished           time.Time          `json:"finished"`
+	Duration           float64            `json:"duration"` // Seconds
+	Passed             bool               `json:"passed"`
+	ExitCode           int                `json:"exitCode"`
+	WorkflowsStarted   int64              `json:"workflowsStarted"`
+	WorkflowsCompleted int64              `json:"workflowsCompleted"`
+	WorkflowsFailed    int64              `json:"workflowsFailed"`
+	IterationsDropped  int64              `json:"iterationsDropped,omitempty"`
+	Durations          histogram.Summary  `json:"durations"`
+	Transactions       []TransactionStats `json:"transactions,omitempty"`
+	Steps              []stepStats        `json:"steps,omitempty"`
+	StepTypes          []stepStats        `json:"stepTypes,omitempty"`
+	StepFailures       []stepFailure      `json:"stepFailures,omitempty"`
+	FailureScreens     map[string]int64   `json:"failureScreens,omitempty"`
+	Thresholds         []thresholdCheck   `json:"thresholds,omitempty"`
+}
+
+// openResults starts writing results to resultsDir if it is set.
+func openResults() error {
+	if resultsDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(resultsDir, 0755); err != nil {
+		return err
+	}
+	csvFile, err := os.Create(filepath.Join(resultsDir, resultsIterationsFile))
+	if err != nil {
+		return err
+	}
+	casesFile, err := ioutil.TempFile(resultsDir, ".junit_")
+	if err != nil {
+		csvFile.Close()
+		return err
+	}
+	w := &resultsWriter{
+		started:   time.Now(),
+		csvFile:   csvFile,
+		csv:       csv.NewWriter(csvFile),
+		casesFile: casesFile,
+		cases:     xml.NewEncoder(casesFile),
+	}
+	w.cases.Indent("    ", "  ")
+	if err := w.csv.Write(iterationColumns); err != nil {
+		w.discard()
+		return err
+	}
+	resultsMutex.Lock()
+	results = w
+	resultsMutex.Unlock()
+	return nil
+}
+
+// recordIteration writes a finished iteration to the results, if they are
+// being written. A failed iteration names its failing step if it has one.
+func recordIteration(vu int64, iteration int, start time.Time, err error) {
+	resultsMutex.Lock()
+	w := results
+	resultsMutex.Unlock()
+	if w == nil {
+		return
+	}
+	duration := time.Since(start).Seconds()
+	status, step, message, category := "passed", "", "", ""
+	if err != nil {
+		status, message, category = "failed", err.Error(), errorEmulator
+		var se *stepError
+		if errors.As(err, &se) {
+			step = stepName(se.List, se.Index, se.Step)
+			message = se.Err.Error()
+			category = errorCategory(se.Step, se.Err)
+		}
+		message = secrets.Redact(message)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.iterations++
+	w.csv.Write([]string{
+		strconv.FormatInt(vu, 10),
+		strconv.Itoa(iteration),
+		start.Format("2006-01-02T15:04:05.000Z07:00"),
+		strconv.FormatFloat(duration, 'f', 3, 64),
+		status,
+		step,
+		message,
+	})
+	w.csv.Flush()
+	tc := junitTestCase{
+		Classname: "iterations",
+		Name:      fmt.Sprintf("workflow %d iteration %d", vu, iteration),
+		Time:      strconv.FormatFloat(duration, 'f', 3, 64),
+	}
+	if err != nil {
+		w.failures++
+		tc.Failure = &junitFailure{Message: message, Type: category, Text: step}
+	}
+	w.cases.Encode(tc)
+}
+
+// discard closes and removes the temporary file of w.
+func (w *resultsWriter) discard() {
+	w.csvFile.Close()
+	w.casesFile.Close()
+	os.Remove(w.casesFile.Name())
+}
+
+// writeResults finishes the results of a run that ended with exit code code,
+// writing the summary and JUnit XML from m and the threshold checks. It does
+// nothing without -results.
+func writeResults(config *Configuration, m Metrics, checks []thresholdCheck, code int) {
+	if resultsDir == "" {
+		return
+	}
+	resultsMutex.Lock()
+	w := results
+	results = nil
+	resultsMutex.Unlock()
+	started := time.Now()
+	if w != nil {
+		started = w.started
+	}
+	if err := writeResultFiles(w, config, m, checks, started, code); err != nil {
+		log.Printf("Error writing results to %s: %v", resultsDir, err)
+		return
+	}
+	msg := fmt.Sprintf("Results written to %s", resultsDir)
+	log.Print(msg)
+	storeLog(msg)
+}
+
+func writeResultFiles(w *resultsWriter, config *Configuration, m Metrics, checks []thresholdCheck, started time.Time, code int) error {
+	finished := time.Now()
+	summary := runSummary{
+		Workflow:           config.Name,
+		Host:               config.Host,
+		Port:               config.Port,
+		Started:            started,
+		Finished:           finished,
+		Duration:           finished.Sub(started).Seconds(),
+		Passed:             code == 0,
+		ExitCode:           code,
+		WorkflowsStarted:   m.TotalWorkflowsStarted,
+		WorkflowsCompleted: m.TotalWorkflowsCompleted,
+		WorkflowsFailed:    m.TotalWorkflowsFailed,
+		IterationsDropped:  m.TotalIterationsDropped,
+		Durations:          m.Durations.Summarize(),
+		Transactions:       summarizeTransactions(m.Transactions),
+		Steps:              summarizeSteps(m.Steps),
+		StepTypes:          summarizeSteps(m.StepTypes),
+		StepFailures:       summarizeStepFailures(m.StepFailures),
+		FailureScreens:     m.FailureScreens,
+		Thresholds:         checks,
+	}
+	var data bytes.Buffer
+	enc := json.NewEncoder(&data)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summary); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(resultsDir, resultsSummaryFile), data.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if w != nil {
+		defer w.discard()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+		if err := w.cases.Flush(); err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(filepath.Join(resultsDir, resultsJUnitFile))
+	if err != nil {
+		return err
+	}
+	if err := writeJUnit(f, w, summary); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeJUnit writes the JUnit XML of a run to out: the iterations from w,
+// then the assertion steps and thresholds of the summary.
+func writeJUnit(out io.Writer, w *resultsWriter, summary runSummary) error {
+	name := summary.Workflow
+	if name == "" {
+		name = "workflow"
+	}
+	seconds := func(s float64) string { return strconv.FormatFloat(s, 'f', 3, 64) }
+
+	steps := junitTestSuite{Name: name + " steps", Time: "0"}
+	var stepsTime float64
+	for _, st := range summary.Steps {
+		if !isAssertionStep(st.Type) {
+			continue
+		}
+		tc := junitTestCase{Classname: "steps", Name: st.Name, Time: seconds(st.Mean * float64(st.Executions))}
+		stepsTime += st.Mean * float64(st.Executions)
+		if st.Failures > 0 {
+			var causes []string
+			for _, f := range summary.StepFailures {
+				if f.Step == st.Name {
+					causes = append(causes, fmt.Sprintf("%s: %d", f.Category, f.Failures))
+				}
+			}
+			tc.Failure = &junitFailure{
+				Message: fmt.Sprintf("%d of %d executions failed", st.Failures, st.Executions),
+				Type:    "step",
+				Text:    strings.Join(causes, ", "),
+			}
+			steps.Failures++
+		}
+		steps.Cases = append(steps.Cases, tc)
+	}
+	steps.Tests = len(steps.Cases)
+	steps.Time = seconds(stepsTime)
+
+	thresholds := junitTestSuite{Name: name + " thresholds", Time: "0"}
+	for _, c := range summary.Thresholds {
+		tc := junitTestCase{Classname: "thresholds", Name: c.Rule, Time: "0"}
+		if !c.Passed {
+			tc.Failure = &junitFailure{Message: c.Actual, Type: "threshold"}
+			thresholds.Failures++
+		}
+		thresholds.Cases = append(thresholds.Cases, tc)
+	}
+	thresholds.Tests = len(thresholds.Cases)
+
+	iterations, iterationFailures := 0, 0
+	if w != nil {
+		iterations, iterationFailures = w.iterations, w.failures
+	}
+	attr := func(name, value string) xml.Attr { return xml.Attr{Name: xml.Name{Local: name}, Value: value} }
+	enc := xml.NewEncoder(out)
+	enc.Indent("", "  ")
+	if _, err := io.WriteString(out, xml.Header); err != nil {
+		return err
+	}
+	root := xml.StartElement{Name: xml.Name{Local: "testsuites"}, Attr: []xml.Attr{
+		attr("name", "3270Connect"),
+		attr("tests", strconv.Itoa(iterations+steps.Tests+thresholds.Tests)),
+		attr("failures", strconv.Itoa(iterationFailures+steps.Failures+thresholds.Failures)),
+		attr("time", seconds(summary.Duration)),
+	}}
+	suite := xml.StartElement{Name: xml.Name{Local: "testsuite"}, Attr: []xml.Attr{
+		attr("name", name+" iterations"),
+		attr("tests", strconv.Itoa(iterations)),
+		attr("failures", strconv.Itoa(iterationFailures)),
+		attr("time", seconds(summary.Duration)),
+		attr("timestamp", summary.Started.Format("2006-01-02T15:04:05")),
+	}}
+	if err := enc.EncodeToken(root); err != nil {
+		return err
+	}
+	if err := enc.EncodeToken(suite); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	if iterations > 0 {
+		// The iteration test cases were encoded with the indentation they
+		// have here.
+		if _, err := w.casesFile.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(out, "\n"); err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, w.casesFile); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(out, "\n  "); err != nil {
+		return err
+	}
+	if err := enc.EncodeToken(suite.End()); err != nil {
+		return err
+	}
+	for _, s := range []junitTestSuite{steps, thresholds} {
+		if s.Tests == 0 {
+			continue
+		}
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	if err := enc.EncodeToken(root.End()); err != nil {
+		return err
+	}
+	if err := enc.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, "\n")
+	return err
+}
+
+// isAssertionStep reports whether stepType checks what the host shows rather
+// than acting on it.
+func isAssertionStep(stepType string) bool {
+	return stepType == "CheckValue" || stepType == "ExpectScreen" || stepType == "WaitForScreen"
+}
@@ -0,0 +1,179 @@
+// Package screens identifies host screens from a catalogue of named screen
+// definitions, so that workflows can assert which screen they are on by name
+// rather than by checking text at fixed coordinates.
+package screens
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	connect3270 "github.com/3270io/3270Connect/connect3270"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Catalogue is a set of named screen definitions.
+type Catalogue struct {
+	Screens []Screen `yaml:"Screens"`
+}
+
+// Screen defines a named screen. A screen matches when every signature and
+// every field matches.
+type Screen struct {
+	Name       string      `yaml:"Name"`
+	Signatures []Signature `yaml:"Signatures,omitempty"`
+	Fields     []Field     `yaml:"Fields,omitempty"`
+}
+
+// Signature is text expected on the screen. With a Row and Column the text
+// must appear at that position; with only a Row it may appear anywhere on that
+// row; with neither it may appear anywhere on the screen.
+type Signature struct {
+	Row    int    `yaml:"Row,omitempty"`
+	Column int    `yaml:"Column,omitempty"`
+	Text   string `yaml:"Text"`
+}
+
+// Field is an input field expected on the screen. Length is only compared when
+// it is set.
+type Field struct {
+	Row    int `yaml:"Row"`
+	Column int `yaml:"Column"`
+	Length int `yaml:"Length,omitempty"`
+}
+
+// Source provides the current screen contents, as implemented by
+// connect3270.Emulator.
+type Source interface {
+	ScreenText() ([]string, error)
+	Fields() ([]connect3270.Field, error)
+}
+
+// Load reads a catalogue from a YAML or JSON file. Unknown fields are rejected.
+func Load(path string) (*Catalogue, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	var c Catalogue
+	if err := decoder.Decode(&c); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := c.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return &c, nil
+}
+
+func (c *Catalogue) validate() error {
+	seen := map[string]bool{}
+	for i, s := range c.Screens {
+		if s.Name == "" {
+			return fmt.Errorf("screen %d has no Name", i+1)
+		}
+		if seen[s.Name] {
+			return fmt.Errorf("screen %s is defined more than once", s.Name)
+		}
+		seen[s.Name] = true
+		if len(s.Signatures) == 0 && len(s.Fields) == 0 {
+			return fmt.Errorf("screen %s has no Signatures or Fields", s.Name)
+		}
+		for _, sig := range s.Signatures {
+			if sig.Text == "" {
+				return fmt.Errorf("screen %s has a signature without Text", s.Name)
+			}
+			if sig.Row < 0 || sig.Row > connect3270.ScreenRows || sig.Column < 0 || sig.Column > connect3270.ScreenColumns {
+				return fmt.Errorf("screen %s has a signature outside the screen", s.Name)
+			}
+			if sig.Column > 0 && sig.Row == 0 {
+				return fmt.Errorf("screen %s has a signature with a Column but no Row", s.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Has reports whether the catalogue defines a screen called name.
+func (c *Catalogue) Has(name string) bool {
+	for _, s := range c.Screens {
+		if s.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Identify returns the name of the first screen that matches the given screen
+// text and fields, or "" if none matches.
+func (c *Catalogue) Identify(text []string, fields []connect3270.Field) string {
+	for _, s := range c.Screens {
+		if s.matches(text, fields) {
+			return s.Name
+		}
+	}
+	return ""
+}
+
+// IdentifyCurrent reads the current screen from src and identifies it. Fields
+// are only read if a screen in the catalogue needs them.
+func (c *Catalogue) IdentifyCurrent(src Source) (string, error) {
+	text, err := src.ScreenText()
+	if err != nil {
+		return "", err
+	}
+	var fields []connect3270.Field
+	if c.usesFields() {
+		if fields, err = src.Fields(); err != nil {
+			return "", err
+		}
+	}
+	return c.Identify(text, fields), nil
+}
+
+func (c *Catalogue) usesFields() bool {
+	for _, s := range c.Screens {
+		if len(s.Fields) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Screen) matches(text []string, fields []connect3270.Field) bool {
+	for _, sig := range s.Signatures {
+		if !sig.matches(text) {
+			return false
+		}
+	}
+	for _, want := range s.Fields {
+		found := false
+		for _, f := range fields {
+			if !f.Protected && f.Row == want.Row && f.Column == want.Column && (want.Length == 0 || f.Length == want.Length) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (sig *Signature) matches(text []string) bool {
+	switch {
+	case sig.Row == 0:
+		return strings.Contains(strings.Join(text, "\n"), sig.Text)
+	case sig.Row > len(text):
+		return false
+	case sig.Column == 0:
+		return strings.Contains(text[sig.Row-1], sig.Text)
+	default:
+		line := text[sig.Row-1]
+		return sig.Column-1 <= len(line) && strings.HasPrefix(line[sig.Column-1:], sig.Text)
+	}
+}
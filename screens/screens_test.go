@@ -0,0 +1,121 @@
+package screens
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	connect3270 "github.com/3270io/3270Connect/connect3270"
+)
+
+var catalogue = &Catalogue{Screens: []Screen{
+	{
+		Name: "LOGON",
+		Signatures: []Signature{
+			{Row: 1, Column: 3, Text: "WELCOME"},
+			{Row: 3, Text: "USERID"},
+		},
+		Fields: []Field{{Row: 3, Column: 12, Length: 8}},
+	},
+	{
+		Name:       "MENU",
+		Signatures: []Signature{{Text: "SELECT OPTION"}},
+	},
+	{
+		Name:   "INPUT_ONLY",
+		Fields: []Field{{Row: 2, Column: 1}},
+	},
+}}
+
+func TestIdentify(t *testing.T) {
+	logonText := []string{"  WELCOME", "", " USERID ==> "}
+	logonFields := []connect3270.Field{{Row: 3, Column: 12, Length: 8}}
+	tests := []struct {
+		name   string
+		text   []string
+		fields []connect3270.Field
+		want   string
+	}{
+		{"all signatures and fields", logonText, logonFields, "LOGON"},
+		{"text in the wrong column", []string{" WELCOME", "", " USERID ==> "}, logonFields, ""},
+		{"field missing", logonText, nil, ""},
+		{"field of another length", logonText, []connect3270.Field{{Row: 3, Column: 12, Length: 9}}, ""},
+		{"field protected", logonText, []connect3270.Field{{Row: 3, Column: 12, Length: 8, Protected: true}}, ""},
+		{"text anywhere", []string{"MAIN", "  SELECT OPTION ==>"}, nil, "MENU"},
+		{"first match wins", []string{"  WELCOME", "SELECT OPTION", " USERID"}, logonFields, "LOGON"},
+		{"field only", []string{"", ""}, []connect3270.Field{{Row: 2, Column: 1, Length: 5}}, "INPUT_ONLY"},
+		{"row past the screen", []string{"  WELCOME"}, logonFields, ""},
+		{"unknown screen", []string{"GOODBYE"}, nil, ""},
+	}
+	for _, tt := range tests {
+		if got := catalogue.Identify(tt.text, tt.fields); got != tt.want {
+			t.Errorf("%s: Identify = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// fakeSource is a screen read by IdentifyCurrent.
+type fakeSource struct {
+	text       []string
+	fields     []connect3270.Field
+	fieldsRead bool
+}
+
+func (s *fakeSource) ScreenText() ([]string, error) {
+	return s.text, nil
+}
+
+func (s *fakeSource) Fields() ([]connect3270.Field, error) {
+	s.fieldsRead = true
+	return s.fields, nil
+}
+
+func TestIdentifyCurrentReadsFieldsOnlyWhenNeeded(t *testing.T) {
+	src := &fakeSource{text: []string{"SELECT OPTION"}}
+	textOnly := &Catalogue{Screens: catalogue.Screens[1:2]}
+	if name, err := textOnly.IdentifyCurrent(src); err != nil || name != "MENU" {
+		t.Errorf("IdentifyCurrent = %q, %v, want MENU", name, err)
+	}
+	if src.fieldsRead {
+		t.Error("fields were read for a catalogue without Fields")
+	}
+	if name, err := catalogue.IdentifyCurrent(src); err != nil || name != "MENU" {
+		t.Errorf("IdentifyCurrent = %q, %v, want MENU", name, err)
+	}
+	if !src.fieldsRead {
+		t.Error("fields were not read for a catalogue with Fields")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"valid", "Screens:\n  - Name: A\n    Signatures: [{Row: 1, Text: x}]\n", ""},
+		{"unknown field", "Screens:\n  - Name: A\n    Signature: [{Text: x}]\n", "field Signature not found"},
+		{"no name", "Screens:\n  - Signatures: [{Text: x}]\n", "has no Name"},
+		{"duplicate", "Screens:\n  - {Name: A, Signatures: [{Text: x}]}\n  - {Name: A, Signatures: [{Text: y}]}\n", "more than once"},
+		{"empty screen", "Screens:\n  - Name: A\n", "no Signatures or Fields"},
+		{"column without row", "Screens:\n  - {Name: A, Signatures: [{Column: 2, Text: x}]}\n", "Column but no Row"},
+		{"outside the screen", "Screens:\n  - {Name: A, Signatures: [{Row: 99, Text: x}]}\n", "outside the screen"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		path := filepath.Join(dir, "catalogue.yaml")
+		if err := ioutil.WriteFile(path, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		c, err := Load(path)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: Load failed: %v", tt.name, err)
+		case tt.wantErr == "" && !c.Has("A"):
+			t.Errorf("%s: screen A was not loaded", tt.name)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: Load error = %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+// Package secrets resolves ${env:NAME} and ${file:/path} references in
+// configuration values and masks secret values in anything 3270Connect writes
+// out, such as logs and screen captures.
+package secrets
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Mask is the text that replaces a secret value.
+const Mask = "********"
+
+var (
+	values      []string       // Longest first
+	counts      map[string]int // Registrations of each value not yet released
+	valuesMutex sync.RWMutex
+)
+
+// Register marks value as secret so that Redact masks it for the life of the
+// process. Empty values are ignored.
+func Register(value string) {
+	(*Scope)(nil).Register(value)
+}
+
+// Scope holds secrets that only need masking for a while, such as those of
+// one API request, so that they do not pile up in a long-running process. A
+// nil *Scope registers secrets for the life of the process.
+type Scope struct {
+	values []string
+}
+
+// Register marks value as secret until the scope is released. Empty values
+// are ignored.
+func (sc *Scope) Register(value string) {
+	if value == "" {
+		return
+	}
+	valuesMutex.Lock()
+	defer valuesMutex.Unlock()
+	if sc != nil {
+		sc.values = append(sc.values, value)
+	}
+	if counts == nil {
+		counts = map[string]int{}
+	}
+	counts[value]++
+	if counts[value] > 1 {
+		return
+	}
+	values = append(values, value)
+	// Replace longer values first so that a secret containing another secret
+	// is masked as a whole.
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+}
+
+// Release stops masking the secrets registered in the scope, unless they
+// have also been registered elsewhere.
+func (sc *Scope) Release() {
+	if sc == nil {
+		return
+	}
+	valuesMutex.Lock()
+	defer valuesMutex.Unlock()
+	for _, value := range sc.values {
+		if counts[value]--; counts[value] > 0 {
+			continue
+		}
+		delete(counts, value)
+		for i, v := range values {
+			if v == value {
+				values = append(values[:i], values[i+1:]...)
+				break
+			}
+		}
+	}
+	sc.values = nil
+}
+
+// Redact returns s with every registered secret value replaced by Mask.
+func Redact(s string) string {
+	valuesMutex.RLock()
+	defer valuesMutex.RUnlock()
+	for _, v := range values {
+		s = strings.ReplaceAll(s, v, Mask)
+	}
+	return s
+}
+
+// Resolve replaces ${env:NAME} and ${file:/path} references in s with the
+// value of the environment variable or the contents of the file, without a
+// trailing newline. $${ is written out as a literal ${. Resolved values are
+// registered as secrets for the life of the process.
+func Resolve(s string) (string, error) {
+	return (*Scope)(nil).Resolve(s)
+}
+
+// Resolve is like the Resolve function, but registers the resolved values in
+// the scope.
+func (sc *Scope) Resolve(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	parts, err := Split(s)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	for _, part := range parts {
+		if part.Source == "" {
+			out.WriteString(part.Text)
+			continue
+		}
+		value, err := lookup(part.Source + ":" + part.Text)
+		if err != nil {
+			return "", err
+		}
+		sc.Register(value)
+		out.WriteString(value)
+	}
+	return out.String(), nil
+}
+
+// Part is a piece of a configuration value: literal Text if Source is empty,
+// or a reference to the environment variable or file named by Text if Source
+// is "env" or "file".
+type Part struct {
+	Source string
+	Text   string
+}
+
+// Split breaks s into literal text and references without resolving them, so
+// that they can be written out as lookups in another language.
+func Split(s string) ([]Part, error) {
+	var parts []Part
+	var literal strings.Builder
+	flush := func() {
+		if literal.Len() > 0 {
+			parts = append(parts, Part{Text: literal.String()})
+			literal.Reset()
+		}
+	}
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			literal.WriteString(s)
+			flush()
+			return parts, nil
+		}
+		if start > 0 && s[start-1] == '$' {
+			literal.WriteString(s[:start-1])
+			literal.WriteString("${")
+			s = s[start+2:]
+			continue
+		}
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated reference in %q", s)
+		}
+		literal.WriteString(s[:start])
+		reference := s[start+2 : start+end]
+		kind := strings.SplitN(reference, ":", 2)
+		if len(kind) != 2 || kind[1] == "" {
+			return nil, fmt.Errorf("invalid reference ${%s}, expected ${env:NAME} or ${file:/path}", reference)
+		}
+		if kind[0] != "env" && kind[0] != "file" {
+			return nil, fmt.Errorf("unknown reference type %q in ${%s}", kind[0], reference)
+		}
+		flush()
+		parts = append(parts, Part{Source: kind[0], Text: kind[1]})
+		s = s[start+end+1:]
+	}
+}
+
+// lookup resolves a single reference such as "env:NAME".
+func lookup(reference string) (string, error) {
+	parts := strings.SplitN(reference, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", fmt.Errorf("invalid reference ${%s}, expected ${env:NAME} or ${file:/path}", reference)
+	}
+	switch parts[0] {
+	case "env":
+		value, ok := os.LookupEnv(parts[1])
+		if !ok {
+			return "", fmt.Errorf("environment variable %s referenced by ${%s} is not set", parts[1], reference)
+		}
+		return value, nil
+	case "file":
+		data, err := ioutil.ReadFile(parts[1])
+		if err != nil {
+			return "", fmt.Errorf("error reading ${%s}: %v", reference, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	default:
+		return "", fmt.Errorf("unknown reference type %q in ${%s}", parts[0], reference)
+	}
+}
@@ -0,0 +1,125 @@
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// reset forgets every registered secret when the test ends.
+func reset(t *testing.T) {
+	t.Cleanup(func() {
+		valuesMutex.Lock()
+		values, counts = nil, nil
+		valuesMutex.Unlock()
+	})
+}
+
+func TestResolve(t *testing.T) {
+	reset(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(path, []byte("s3cr3t\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SECRETS_TEST_USER", "alice")
+	defer os.Unsetenv("SECRETS_TEST_USER")
+
+	tests := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"plain text", "plain text", false},
+		{"${env:SECRETS_TEST_USER}", "alice", false},
+		{"user ${env:SECRETS_TEST_USER}!", "user alice!", false},
+		{"${file:" + path + "}", "s3cr3t", false},
+		{"${env:SECRETS_TEST_USER}/${file:" + path + "}", "alice/s3cr3t", false},
+		{"$${env:SECRETS_TEST_USER}", "${env:SECRETS_TEST_USER}", false},
+		{"${env:SECRETS_TEST_UNSET}", "", true},
+		{"${file:" + filepath.Join(dir, "missing") + "}", "", true},
+		{"${env:SECRETS_TEST_USER", "", true},
+		{"${vault:key}", "", true},
+		{"${env:}", "", true},
+		{"${nothing}", "", true},
+	}
+	for _, tt := range tests {
+		got, err := Resolve(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Resolve(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Resolve(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if got := Redact("alice logged on with s3cr3t"); got != Mask+" logged on with "+Mask {
+		t.Errorf("resolved values are not masked: %q", got)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	got, err := Split("a${env:B}c$${d}${file:/e}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Part{{Text: "a"}, {Source: "env", Text: "B"}, {Text: "c${d}"}, {Source: "file", Text: "/e"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Split = %+v, want %+v", got, want)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	reset(t)
+	Register("pass")
+	Register("password1")
+	Register("")
+	Register("pass")
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"nothing secret", "nothing secret"},
+		{"pass", Mask},
+		{"password1 and pass", Mask + " and " + Mask},
+		{"passport", Mask + "port"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	reset(t)
+	Register("shared")
+	var a, b Scope
+	a.Register("request-a")
+	a.Register("shared")
+	b.Register("request-a")
+	if _, err := a.Resolve("${env:SECRETS_TEST_UNSET}"); err == nil {
+		t.Error("Resolve of an unset variable succeeded")
+	}
+
+	a.Release()
+	if got := Redact("shared request-a"); got != Mask+" "+Mask {
+		t.Errorf("after releasing one of two scopes, Redact = %q, want both masked", got)
+	}
+	b.Release()
+	if got := Redact("shared request-a"); got != Mask+" request-a" {
+		t.Errorf("after releasing both scopes, Redact = %q, want only the process-wide secret masked", got)
+	}
+	a.Release()
+	if got := Redact("shared"); got != Mask {
+		t.Errorf("releasing a scope twice unregistered a process-wide secret: %q", got)
+	}
+	valuesMutex.RLock()
+	defer valuesMutex.RUnlock()
+	if len(values) != 1 || len(counts) != 1 {
+		t.Errorf("released secrets are still held: values %q, counts %v", values, counts)
+	}
+}
@@ -0,0 +1,335 @@
+package main
+
+// Live sessions. Every workflow session is listed on the dashboard with the
+// step it is on, and its screen can be watched while it runs. A session that
+// fails keeps the screen it failed on, before OnFailure changes it, so that
+// it can still be looked at once the session has closed.
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/3270io/3270Connect/connect3270"
+	"github.com/3270io/3270Connect/secrets"
+)
+
+const (
+	failedSessionsKept = 20          // Failed sessions, with their final screens, kept after they close
+	screenPollInterval = time.Second // How often a watched screen is read
+)
+
+// States of a session.
+const (
+	sessionRunning = "running" // Running Setup or an iteration
+	sessionWaiting = "waiting" // Between iterations of a KeepSession workflow
+	sessionClosing = "closing" // Running Teardown and Finally
+	sessionFailed  = "failed"  // Failed, and running OnFailure and Finally or closed
+)
+
+// sessionInfo describes a workflow session. VU is the number of its workflow
+// in the logs.
+type sessionInfo struct {
+	VU        int64      `json:"vu"`
+	Host      string     `json:"host"`
+	Script    string     `json:"script,omitempty"` // Script port of the emulator, or how it takes commands
+	Iteration int        `json:"iteration"`
+	Step      string     `json:"step,omitempty"` // Running or last step, as stepName
+	State     string     `json:"state"`
+	Error     string     `json:"error,omitempty"`
+	Started   time.Time  `json:"started"`         // Start of the iteration
+	Ended     *time.Time `json:"ended,omitempty"` // When the iteration failed
+}
+
+// sessionScreen is the screen of a session as the screen viewer shows it.
+type sessionScreen struct {
+	sessionInfo
+	Rows        []string `json:"rows,omitempty"`
+	Final       bool     `json:"final,omitempty"`       // Rows are the screen the session failed on
+	ScreenError string   `json:"screenError,omitempty"` // Why there are no rows
+}
+
+// liveSession is a workflow session as the dashboard sees it.
+type liveSession struct {
+	emulator *connect3270.Emulator
+	mu       sync.Mutex
+	info     sessionInfo
+	final    []string // Screen the session failed on
+}
+
+var (
+	liveSessions      = map[int64]*liveSession{}
+	failedSessions    []*liveSession // Closed after failing, oldest first
+	liveSessionsMutex sync.Mutex
+)
+
+// watch lists the session as workflow id, running its first iteration.
+func (s *workflowSession) watch(id int64, config *Configuration) {
+	ls := &liveSession{
+		emulator: s.emulator,
+		info: sessionInfo{
+			VU:        id,
+			Host:      fmt.Sprintf("%s:%d", config.Host, config.Port),
+			Iteration: 1,
+			State:     sessionRunning,
+			Started:   time.Now(),
+		},
+	}
+	s.live = ls
+	liveSessionsMutex.Lock()
+	liveSessions[id] = ls
+	liveSessionsMutex.Unlock()
+}
+
+// unwatch takes the session off the list once it has closed, unless it
+// failed: the last failedSessionsKept of those stay to be looked at.
+func (s *workflowSession) unwatch() {
+	ls := s.live
+	if ls == nil {
+		return
+	}
+	ls.mu.Lock()
+	failed := ls.info.State == sessionFailed
+	ls.mu.Unlock()
+	liveSessionsMutex.Lock()
+	defer liveSessionsMutex.Unlock()
+	delete(liveSessions, ls.info.VU)
+	if failed {
+		failedSessions = append(failedSessions, ls)
+		if len(failedSessions) > failedSessionsKept {
+			failedSessions = failedSessions[len(failedSessions)-failedSessionsKept:]
+		}
+	}
+}
+
+// updateSession changes the session's info with f, if the session is listed.
+func (s *workflowSession) updateSession(f func(info *sessionInfo)) {
+	if s.live == nil {
+		return
+	}
+	s.live.mu.Lock()
+	f(&s.live.info)
+	s.live.mu.Unlock()
+}
+
+// beginIteration marks the session as running iteration.
+func (s *workflowSession) beginIteration(iteration int) {
+	s.updateSession(func(info *sessionInfo) {
+		info.Iteration = iteration
+		info.State = sessionRunning
+		info.Started = time.Now()
+	})
+}
+
+// setSessionState marks the session as waiting or closing.
+func (s *workflowSession) setSessionState(state string) {
+	s.updateSession(func(info *sessionInfo) {
+		if info.State != sessionFailed {
+			info.State = state
+		}
+	})
+}
+
+// watchStep records the step the session is running.
+func (s *workflowSession) watchStep(list string, index int, step Step) {
+	s.updateSession(func(info *sessionInfo) {
+		info.Step = stepName(list, index, step)
+	})
+}
+
+// watchFailure marks the session as failed with err and keeps the screen it
+// is on, if it is connected and someone may want to look at it.
+func (s *workflowSession) watchFailure(err error) {
+	if s.live == nil {
+		return
+	}
+	var final []string
+	if s.connected && !aborting() && (dashboardStarted || agentMode) {
+		if rows, screenErr := s.emulator.PeekScreen(); screenErr == nil {
+			final = redactRows(rows)
+		}
+	}
+	script := sessionScript(s.emulator)
+	now := time.Now()
+	s.live.mu.Lock()
+	s.live.info.State = sessionFailed
+	s.live.info.Error = secrets.Redact(err.Error())
+	s.live.info.Script = script
+	s.live.info.Ended = &now
+	s.live.final = final
+	s.live.mu.Unlock()
+}
+
+// snapshot returns the session's info.
+func (ls *liveSession) snapshot() sessionInfo {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	info := ls.info
+	if info.State != sessionFailed {
+		info.Script = sessionScript(ls.emulator)
+	}
+	return info
+}
+
+// sessionScript returns the script port of e, or how it takes commands with
+// another transport.
+func sessionScript(e *connect3270.Emulator) string {
+	switch connect3270.Transport {
+	case connect3270.TransportSocket, connect3270.TransportStdin:
+		return e.Where()
+	}
+	return e.CurrentScriptPort()
+}
+
+// currentSessions returns the open sessions and the failed ones that were
+// kept, in the order of their workflows.
+func currentSessions() []sessionInfo {
+	liveSessionsMutex.Lock()
+	all := make([]*liveSession, 0, len(liveSessions)+len(failedSessions))
+	for _, ls := range liveSessions {
+		all = append(all, ls)
+	}
+	all = append(all, failedSessions...)
+	liveSessionsMutex.Unlock()
+	list := make([]sessionInfo, len(all))
+	for i, ls := range all {
+		list[i] = ls.snapshot()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].VU < list[j].VU })
+	return list
+}
+
+// readSessionScreen returns the screen of workflow vu: the screen it is on,
+// or the one it failed on. It reports false if there is no such session.
+func readSessionScreen(vu int64) (sessionScreen, bool) {
+	liveSessionsMutex.Lock()
+	ls := liveSessions[vu]
+	for i := 0; ls == nil && i < len(failedSessions); i++ {
+		if failedSessions[i].info.VU == vu {
+			ls = failedSessions[i]
+		}
+	}
+	liveSessionsMutex.Unlock()
+	if ls == nil {
+		return sessionScreen{}, false
+	}
+	screen := sessionScreen{sessionInfo: ls.snapshot()}
+	ls.mu.Lock()
+	final := ls.final
+	ls.mu.Unlock()
+	switch {
+	case screen.State == sessionFailed && final != nil:
+		screen.Rows, screen.Final = final, true
+	case screen.State == sessionFailed:
+		screen.ScreenError = "No final screen was kept for this session"
+	default:
+		rows, err := ls.emulator.PeekScreen()
+		if err != nil {
+			screen.ScreenError = "The screen cannot be read yet: " + err.Error()
+		} else {
+			screen.Rows = redactRows(rows)
+		}
+	}
+	return screen, true
+}
+
+// redactRows masks secrets on a screen.
+func redactRows(rows []string) []string {
+	for i, row := range rows {
+		rows[i] = secrets.Redact(row)
+	}
+	return rows
+}
+
+// ownSession reports whether a session listed on the dashboard for pid and
+// agent can be watched from this process: it is one of this process's, or
+// it runs on an agent of this controller.
+func ownSession(pid int, agent string) bool {
+	if agent == "" {
+		return pid == os.Getpid()
+	}
+	for _, m := range readMetricsFiles() {
+		if m.Agent == agent {
+			return true
+		}
+	}
+	return false
+}
+
+// screenHandler streams the screen of the session given by vu, and the pid
+// and agent of its process as the dashboard lists them, as server-sent
+// events: a screen event whenever it changes, and an ended event once the
+// session has closed. The screen a session failed on ends the stream too.
+func screenHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	vu, err := strconv.ParseInt(query.Get("vu"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid vu", http.StatusBadRequest)
+		return
+	}
+	pid, _ := strconv.Atoi(query.Get("pid"))
+	agent := query.Get("agent")
+	if !ownSession(pid, agent) {
+		http.Error(w, "Only the sessions of the process serving the dashboard, and of its agents, can be watched", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	var last dashboardEvent
+	lastSent := time.Now()
+	for {
+		var screen *sessionScreen
+		var err error
+		if agent == "" {
+			if s, ok := readSessionScreen(vu); ok {
+				screen = &s
+			}
+		} else {
+			var reply agentScreen
+			err = callAgent(http.MethodGet, agent, fmt.Sprintf("/agent/screen?vu=%d", vu), nil, &reply)
+			screen = reply.Screen
+		}
+		var e dashboardEvent
+		switch {
+		case err != nil:
+			e = event("screenError", fmt.Sprintf("Agent %s: %v", agent, err))
+		case screen == nil:
+			e = event("ended", vu)
+		default:
+			e = event("screen", screen)
+		}
+		if e.name != last.name || !bytes.Equal(e.data, last.data) {
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.name, e.data); err != nil {
+				return
+			}
+			flusher.Flush()
+			last, lastSent = e, time.Now()
+		} else if time.Since(lastSent) >= dashboardKeepAlive {
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+			lastSent = time.Now()
+		}
+		if err == nil && (screen == nil || screen.State == sessionFailed) {
+			return
+		}
+		select {
+		case <-time.After(screenPollInterval):
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
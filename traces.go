@@ -0,0 +1,169 @@
+package main
+
+// Tracing. With -traceFile or -traceEndpoint every workflow iteration is
+// recorded as an OpenTelemetry trace: a workflow span with a child span for
+// each step, and under those a span for each command sent to the emulator.
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/3270io/3270Connect/connect3270"
+	"github.com/3270io/3270Connect/tracing"
+)
+
+var (
+	traceFile     string  // File spans are appended to as OTLP JSON, set with -traceFile
+	traceEndpoint string  // OTLP/HTTP collector spans are sent to, set with -traceEndpoint
+	traceSample   float64 // Fraction of iterations traced, set with -traceSample
+)
+
+// tracer records the traces of workflows. It is nil, and tracing does
+// nothing, unless -traceFile or -traceEndpoint is set.
+var tracer *tracing.Tracer
+
+// startTracing starts the tracer if -traceFile or -traceEndpoint is set.
+func startTracing() error {
+	if traceSample < 0 || traceSample > 1 {
+		return fmt.Errorf("-traceSample %g is not between 0 and 1", traceSample)
+	}
+	var exporters tracing.MultiExporter
+	if traceFile != "" {
+		x, err := tracing.NewFileExporter(traceFile)
+		if err != nil {
+			return fmt.Errorf("-traceFile: %v", err)
+		}
+		exporters = append(exporters, x)
+	}
+	if traceEndpoint != "" {
+		x, err := tracing.NewHTTPExporter(traceEndpoint)
+		if err != nil {
+			exporters.Close()
+			return fmt.Errorf("-traceEndpoint: %v", err)
+		}
+		exporters = append(exporters, x)
+	}
+	if len(exporters) == 0 {
+		return nil
+	}
+	host, _ := os.Hostname()
+	tracer = tracing.NewTracer(exporters, traceSample,
+		tracing.String("service.name", "3270Connect"),
+		tracing.String("service.version", version),
+		tracing.String("host.name", host),
+		tracing.Int("process.pid", int64(os.Getpid())),
+	)
+	return nil
+}
+
+// stopTracing exports the spans that have not been exported yet.
+func stopTracing() {
+	tracer.Shutdown()
+}
+
+// startTrace starts the trace of an iteration of workflow id, or of the
+// Setup or Teardown of its session when name says so.
+func (s *workflowSession) startTrace(name string, config *Configuration, id int64, iteration int) {
+	span := tracer.Start(nil, name,
+		tracing.String("workflow.name", runLabel()),
+		tracing.Int("workflow.vu", id),
+		tracing.Int("workflow.iteration", int64(iteration)),
+		tracing.String("server.address", config.Host),
+		tracing.Int("server.port", int64(config.Port)),
+	)
+	s.spanMutex.Lock()
+	s.span = span
+	s.spanMutex.Unlock()
+}
+
+// endTrace ends the trace started by startTrace, failed if err is set.
+func (s *workflowSession) endTrace(err error) {
+	s.spanMutex.Lock()
+	span := s.span
+	s.span = nil
+	script := s.script
+	s.spanMutex.Unlock()
+	span.SetAttributes(script...)
+	if se, ok := err.(*stepError); ok {
+		span.SetAttributes(tracing.String("error.step", stepName(se.List, se.Index, se.Step)))
+		if se.Screen != "" {
+			span.SetAttributes(tracing.String("screen.id", se.Screen))
+		}
+	}
+	span.End(err)
+}
+
+// startStepSpan starts the span of the step at index in list under the
+// running trace.
+func (s *workflowSession) startStepSpan(list string, index int, step Step) {
+	s.spanMutex.Lock()
+	defer s.spanMutex.Unlock()
+	s.stepSpan = s.span.Tracer().Start(s.span, stepName(list, index, step),
+		tracing.String("step.list", list),
+		tracing.Int("step.index", int64(index+1)),
+		tracing.String("step.type", step.Type),
+	)
+	if step.Screen != "" {
+		s.stepSpan.SetAttributes(tracing.String("screen.id", step.Screen))
+	}
+}
+
+// endStepSpan ends the span of the running step. A step that failed is given
+// the screen it failed on, if the catalogue knows it.
+func (s *workflowSession) endStepSpan(step Step, attempts int, err error) {
+	s.spanMutex.Lock()
+	span := s.stepSpan
+	s.stepSpan = nil
+	if step.Type == "Connect" && err == nil {
+		s.script = scriptAttributes(s.emulator)
+	}
+	s.spanMutex.Unlock()
+	if span == nil {
+		return
+	}
+	span.SetAttributes(tracing.Int("step.attempts", int64(attempts)))
+	if err != nil && step.Screen == "" {
+		if screen := s.identifyScreen(); screen != "" {
+			span.SetAttributes(tracing.String("screen.id", screen))
+		}
+	}
+	span.End(err)
+}
+
+// traceCommand is the emulator's CommandHook. It starts a span for a command
+// under the running step and returns the function that ends it.
+func (s *workflowSession) traceCommand(command string) func(error) {
+	s.spanMutex.Lock()
+	parent := s.stepSpan
+	if parent == nil {
+		parent = s.span
+	}
+	s.spanMutex.Unlock()
+	span := parent.Tracer().StartClient(parent, commandName(command), tracing.String("emulator.command", command))
+	span.SetAttributes(scriptAttributes(s.emulator)...)
+	return span.End
+}
+
+// scriptAttributes describe where e takes script commands, if it has been
+// given a script port or takes them some other way.
+func scriptAttributes(e *connect3270.Emulator) []tracing.Attribute {
+	if port, err := strconv.Atoi(e.CurrentScriptPort()); err == nil {
+		return []tracing.Attribute{tracing.Int("emulator.script_port", int64(port))}
+	}
+	switch connect3270.Transport {
+	case connect3270.TransportSocket, connect3270.TransportStdin:
+		return []tracing.Attribute{tracing.String("emulator.script", e.Where())}
+	}
+	return nil
+}
+
+// commandName returns the action of a script command, such as String for
+// String("text"), to name its span.
+func commandName(command string) string {
+	if i := strings.IndexByte(command, '('); i > 0 {
+		return command[:i]
+	}
+	return command
+}
@@ -0,0 +1,224 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ScopeName names the instrumentation scope of every span.
+const ScopeName = "github.com/3270io/3270Connect"
+
+// The OTLP JSON encoding of an ExportTraceServiceRequest. Trace and span IDs
+// are hex strings and 64-bit integers are decimal strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+	}
+)
+
+func otlpAttributes(attributes []Attribute) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attributes))
+	for _, a := range attributes {
+		var v otlpValue
+		switch value := a.Value.(type) {
+		case string:
+			v.StringValue = &value
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &value
+		case bool:
+			v.BoolValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, otlpKeyValue{Key: a.Key, Value: v})
+	}
+	return kvs
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// encode returns the spans as an OTLP JSON ExportTraceServiceRequest.
+func encode(resource []Attribute, spans []*Span) ([]byte, error) {
+	encoded := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		s.mu.Lock()
+		encoded[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+			Attributes:        otlpAttributes(s.attributes),
+			Status:            otlpStatus{Code: s.status, Message: s.message},
+		}
+		if s.hasParent {
+			encoded[i].ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		s.mu.Unlock()
+	}
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(resource)},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: ScopeName}, Spans: encoded}},
+	}}})
+}
+
+// FileExporter appends each batch of spans to a file as one line of OTLP
+// JSON, the format of the OpenTelemetry Collector's file exporter, which its
+// otlpjsonfile receiver can read back.
+type FileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileExporter opens path for appending spans, creating it if needed.
+func NewFileExporter(path string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: f}, nil
+}
+
+// Export writes spans as a line of the file.
+func (x *FileExporter) Export(resource []Attribute, spans []*Span) error {
+	data, err := encode(resource, spans)
+	if err != nil {
+		return err
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	_, err = x.file.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the file.
+func (x *FileExporter) Close() error {
+	return x.file.Close()
+}
+
+// HTTPExporter posts batches of spans to an OTLP/HTTP collector in the JSON
+// encoding.
+type HTTPExporter struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPExporter returns an exporter for the collector at endpoint, such as
+// http://collector:4318. The traces path /v1/traces is added if endpoint has
+// no path.
+func NewHTTPExporter(endpoint string) (*HTTPExporter, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%s is not an http or https URL", endpoint)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/traces"
+	}
+	return &HTTPExporter{url: u.String(), client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+// Export posts spans to the collector.
+func (x *HTTPExporter) Export(resource []Attribute, spans []*Span) error {
+	data, err := encode(resource, spans)
+	if err != nil {
+		return err
+	}
+	resp, err := x.client.Post(x.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s %s", x.url, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// Close does nothing; every batch has been posted by the time it returns.
+func (x *HTTPExporter) Close() error {
+	return nil
+}
+
+// MultiExporter exports every batch with each of its exporters.
+type MultiExporter []Exporter
+
+// Export exports spans with every exporter and returns the first error.
+func (m MultiExporter) Export(resource []Attribute, spans []*Span) error {
+	var first error
+	for _, x := range m {
+		if err := x.Export(resource, spans); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Close closes every exporter and returns the first error.
+func (m MultiExporter) Close() error {
+	var first error
+	for _, x := range m {
+		if err := x.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
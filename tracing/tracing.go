@@ -0,0 +1,249 @@
+// Package tracing records traces of workflows as OpenTelemetry spans and
+// exports them in the OTLP JSON encoding, to a file for offline use or to an
+// OTLP/HTTP collector. It implements only what 3270Connect needs: spans with
+// attributes and a status, sampled per trace and exported in batches.
+//
+// A nil *Tracer and a nil *Span are valid and do nothing, so code can trace
+// without checking whether tracing is enabled.
+package tracing
+
+import (
+	"crypto/rand"
+	"log"
+	mathrand "math/rand"
+	"sync"
+	"time"
+)
+
+// Status codes of a span, as in OTLP.
+const (
+	StatusUnset = 0
+	StatusOK    = 1
+	StatusError = 2
+)
+
+// Kinds of span, as in OTLP.
+const (
+	KindInternal = 1
+	KindClient   = 3
+)
+
+// batchSize is the most spans exported at once, and flushInterval how long a
+// span waits at most before it is exported.
+const (
+	batchSize     = 512
+	flushInterval = 5 * time.Second
+	queueSize     = 4 * batchSize
+)
+
+// Attribute is a key and a string, int64, float64 or bool value.
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute.
+func String(key, value string) Attribute { return Attribute{key, value} }
+
+// Int returns an integer attribute.
+func Int(key string, value int64) Attribute { return Attribute{key, value} }
+
+// Float returns a floating-point attribute.
+func Float(key string, value float64) Attribute { return Attribute{key, value} }
+
+// Bool returns a boolean attribute.
+func Bool(key string, value bool) Attribute { return Attribute{key, value} }
+
+// Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(resource []Attribute, spans []*Span) error
+	Close() error
+}
+
+// Tracer starts spans and exports them in batches once they end.
+type Tracer struct {
+	exporter Exporter
+	resource []Attribute
+	sample   float64
+	queue    chan *Span
+	done     chan struct{}
+	dropped  int64
+	mu       sync.Mutex
+	closed   bool
+}
+
+// NewTracer returns a tracer that samples the given fraction of traces and
+// exports them with exporter. The resource attributes describe the process,
+// such as its service.name.
+func NewTracer(exporter Exporter, sample float64, resource ...Attribute) *Tracer {
+	t := &Tracer{
+		exporter: exporter,
+		resource: resource,
+		sample:   sample,
+		queue:    make(chan *Span, queueSize),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Span is a timed operation in a trace.
+type Span struct {
+	tracer     *Tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	hasParent  bool
+	name       string
+	kind       int
+	start, end time.Time
+	mu         sync.Mutex
+	attributes []Attribute
+	status     int
+	message    string
+	ended      bool
+}
+
+// Start starts a span named name. With a nil parent it starts a new trace,
+// which is sampled at the tracer's rate; a span is nil if its trace is not
+// sampled.
+func (t *Tracer) Start(parent *Span, name string, attributes ...Attribute) *Span {
+	return t.start(parent, name, KindInternal, attributes)
+}
+
+// StartClient is Start for a span that calls out to another process, such
+// as a command sent to the emulator.
+func (t *Tracer) StartClient(parent *Span, name string, attributes ...Attribute) *Span {
+	return t.start(parent, name, KindClient, attributes)
+}
+
+func (t *Tracer) start(parent *Span, name string, kind int, attributes []Attribute) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now(), attributes: attributes}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.hasParent = true
+	} else {
+		if t.sample < 1 && mathrand.Float64() >= t.sample {
+			return nil
+		}
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// Tracer returns the tracer that started s, so that children can be started
+// from a span alone.
+func (s *Span) Tracer() *Tracer {
+	if s == nil {
+		return nil
+	}
+	return s.tracer
+}
+
+// SetAttributes adds attributes to s.
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attributes = append(s.attributes, attributes...)
+	s.mu.Unlock()
+}
+
+// End ends s, with an error status if err is set, and queues it for export.
+// Only the first call has an effect.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	if err != nil {
+		s.status, s.message = StatusError, err.Error()
+	} else {
+		s.status = StatusOK
+	}
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		// The exporter is not keeping up; drop the span rather than slow
+		// down the workflows.
+		t.dropped++
+	}
+}
+
+// run exports queued spans in batches until the queue is closed.
+func (t *Tracer) run() {
+	defer close(t.done)
+	var batch []*Span
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.Export(t.resource, batch); err != nil {
+			log.Printf("Error exporting %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Shutdown exports the spans that have ended and closes the exporter. Spans
+// that end later are not exported.
+func (t *Tracer) Shutdown() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return
+	}
+	t.closed = true
+	close(t.queue)
+	dropped := t.dropped
+	t.mu.Unlock()
+	<-t.done
+	if dropped > 0 {
+		log.Printf("%d spans were dropped because the exporter did not keep up", dropped)
+	}
+	if err := t.exporter.Close(); err != nil {
+		log.Printf("Error closing the span exporter: %v", err)
+	}
+}